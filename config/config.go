@@ -3,14 +3,33 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	ServerAddr     string
-	MysqlDSN       string
-	JWTSecret      string
-	UploadDir      string
-	AllowedOrigins string
+	ServerAddr      string
+	MysqlDSN        string
+	JWTSecret       string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	AdminUsers      map[string]bool // 管理员用户名
+	UploadDir       string
+	AllowedOrigins  string
+	RecallWindow    time.Duration
+	MaxPins         int
+	RedisURL        string
+	PubSubBackend   string
+	LoginLimiter    string // 登录失败计数的存储后端
+
+	// 推送通知，未配置的平台不推送
+	APNsKeyFile        string
+	APNsKeyID          string
+	APNsTeamID         string
+	APNsTopic          string
+	APNsSandbox        bool
+	FCMCredentialsFile string
 }
 
 var Cfg *Config
@@ -41,11 +60,109 @@ func Load() {
 		log.Fatal("PORT environment variable is required")
 	}
 
+	// 访问令牌短期有效，过期后用刷新令牌换取新的令牌对；刷新令牌超过该时间未使用则会话失效
+	accessTokenTTL := 15 * time.Minute
+	if v := os.Getenv("ACCESS_TOKEN_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid ACCESS_TOKEN_TTL: %q", v)
+		}
+		accessTokenTTL = d
+	}
+	refreshTokenTTL := 30 * 24 * time.Hour
+	if v := os.Getenv("REFRESH_TOKEN_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid REFRESH_TOKEN_TTL: %q", v)
+		}
+		refreshTokenTTL = d
+	}
+
+	// 逗号分隔的管理员用户名，可以为其他用户生成密码重置令牌
+	adminUsers := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			adminUsers[name] = true
+		}
+	}
+
+	// 发送者撤回消息的时间窗口，群主和管理员删除消息不受此限制
+	recallWindow := 2 * time.Minute
+	if v := os.Getenv("MESSAGE_RECALL_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid MESSAGE_RECALL_WINDOW: %q", v)
+		}
+		recallWindow = d
+	}
+
+	// 每个会话最多置顶的消息数
+	maxPins := 50
+	if v := os.Getenv("MAX_PINNED_MESSAGES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid MAX_PINNED_MESSAGES: %q", v)
+		}
+		maxPins = n
+	}
+
+	// 多节点部署时通过 Redis 在节点间分发 WebSocket 事件
+	redisURL := os.Getenv("REDIS_URL")
+	pubSubBackend := os.Getenv("PUBSUB_BACKEND")
+	switch pubSubBackend {
+	case "":
+		pubSubBackend = "memory"
+	case "memory":
+	case "redis":
+		if redisURL == "" {
+			log.Fatal("REDIS_URL environment variable is required when PUBSUB_BACKEND is redis")
+		}
+	default:
+		log.Fatalf("invalid PUBSUB_BACKEND: %q", pubSubBackend)
+	}
+
+	// 登录失败计数保存在本进程内时，多节点部署下每个节点单独计数，应使用 Redis 共享
+	loginLimiter := os.Getenv("LOGIN_LIMITER_BACKEND")
+	switch loginLimiter {
+	case "":
+		loginLimiter = "memory"
+	case "memory":
+	case "redis":
+		if redisURL == "" {
+			log.Fatal("REDIS_URL environment variable is required when LOGIN_LIMITER_BACKEND is redis")
+		}
+	default:
+		log.Fatalf("invalid LOGIN_LIMITER_BACKEND: %q", loginLimiter)
+	}
+
+	apnsKeyFile := os.Getenv("APNS_KEY_FILE")
+	apnsKeyID := os.Getenv("APNS_KEY_ID")
+	apnsTeamID := os.Getenv("APNS_TEAM_ID")
+	apnsTopic := os.Getenv("APNS_TOPIC")
+	if apnsKeyFile != "" && (apnsKeyID == "" || apnsTeamID == "" || apnsTopic == "") {
+		log.Fatal("APNS_KEY_ID, APNS_TEAM_ID and APNS_TOPIC are required when APNS_KEY_FILE is set")
+	}
+
 	Cfg = &Config{
-		ServerAddr:     ":" + port,
-		MysqlDSN:       mysqlDSN,
-		JWTSecret:      jwtSecret,
-		UploadDir:      uploadDir,
-		AllowedOrigins: allowedOrigins,
+		ServerAddr:      ":" + port,
+		MysqlDSN:        mysqlDSN,
+		JWTSecret:       jwtSecret,
+		AccessTokenTTL:  accessTokenTTL,
+		RefreshTokenTTL: refreshTokenTTL,
+		AdminUsers:      adminUsers,
+		UploadDir:       uploadDir,
+		AllowedOrigins:  allowedOrigins,
+		RecallWindow:    recallWindow,
+		MaxPins:         maxPins,
+		RedisURL:        redisURL,
+		PubSubBackend:   pubSubBackend,
+		LoginLimiter:    loginLimiter,
+
+		APNsKeyFile:        apnsKeyFile,
+		APNsKeyID:          apnsKeyID,
+		APNsTeamID:         apnsTeamID,
+		APNsTopic:          apnsTopic,
+		APNsSandbox:        os.Getenv("APNS_SANDBOX") == "true",
+		FCMCredentialsFile: os.Getenv("FCM_CREDENTIALS_FILE"),
 	}
 }
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"talkbox/config"
+)
+
+const redisDeniedSessionPrefix = "talkbox:denied_session:"
+
+// 已撤销会话的黑名单。访问令牌是无状态的 JWT，会话被撤销后在过期前仍能通过签名校验，
+// 认证时需检查其会话是否在黑名单中。条目只需保留到该会话签发的访问令牌全部过期。
+// 配置了 Redis 时保存在 Redis 中供所有节点共享；否则只缓存在本进程内，未命中时以 sessions 表的 revoked_at 为准，
+// 进程重启或其他节点撤销的会话同样会被拒绝
+var (
+	deniedMu       sync.Mutex
+	deniedSessions = make(map[string]time.Time)
+)
+
+// DenySession 将会话加入黑名单，ttl 为访问令牌的有效期
+func DenySession(sessionID string, ttl time.Duration) error {
+	if Redis != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return Redis.Set(ctx, redisDeniedSessionPrefix+sessionID, 1, ttl).Err()
+	}
+
+	now := time.Now()
+	deniedMu.Lock()
+	defer deniedMu.Unlock()
+	for id, expiresAt := range deniedSessions {
+		if now.After(expiresAt) {
+			delete(deniedSessions, id)
+		}
+	}
+	deniedSessions[sessionID] = now.Add(ttl)
+	return nil
+}
+
+// IsSessionDenied 判断会话是否已被撤销
+func IsSessionDenied(sessionID string) (bool, error) {
+	if Redis != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		n, err := Redis.Exists(ctx, redisDeniedSessionPrefix+sessionID).Result()
+		return n > 0, err
+	}
+
+	now := time.Now()
+	deniedMu.Lock()
+	expiresAt, ok := deniedSessions[sessionID]
+	deniedMu.Unlock()
+	if ok && now.Before(expiresAt) {
+		return true, nil
+	}
+
+	// 会话记录在访问令牌全部过期后才会被清理，找不到记录的令牌不应再有效
+	var revokedAt sql.NullTime
+	err := DB.QueryRow("SELECT revoked_at FROM sessions WHERE id = ?", sessionID).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !revokedAt.Valid {
+		return false, nil
+	}
+
+	deniedMu.Lock()
+	deniedSessions[sessionID] = revokedAt.Time.Add(config.Cfg.AccessTokenTTL)
+	deniedMu.Unlock()
+	return true, nil
+}
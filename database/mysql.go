@@ -42,6 +42,13 @@ func CreateTables() error {
 			nickname    VARCHAR(100),
 			avatar      VARCHAR(255),
 			password    VARCHAR(255) NOT NULL,
+			status      ENUM('online', 'away', 'busy', 'invisible') NOT NULL DEFAULT 'online',
+			last_seen_at DATETIME NULL,
+			dnd_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			dnd_start   CHAR(5) NOT NULL DEFAULT '22:00',
+			dnd_end     CHAR(5) NOT NULL DEFAULT '08:00',
+			timezone    VARCHAR(64) NOT NULL DEFAULT '',
+			deleted_at  DATETIME NULL,
 			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at  DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			UNIQUE KEY uk_username (username)
@@ -52,6 +59,7 @@ func CreateTables() error {
 			name        VARCHAR(100),
 			avatar      VARCHAR(255),
 			owner_id    VARCHAR(36),
+			pin_permission ENUM('admins', 'members') NOT NULL DEFAULT 'admins',
 			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at  DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			INDEX idx_owner (owner_id)
@@ -62,6 +70,10 @@ func CreateTables() error {
 			user_id         VARCHAR(36) NOT NULL,
 			role            ENUM('owner', 'admin', 'member') DEFAULT 'member',
 			nickname        VARCHAR(100),
+			last_read_message_id VARCHAR(36) NULL,
+			last_read_at    DATETIME NULL,
+			notify_level    ENUM('all', 'mentions') NOT NULL DEFAULT 'all',
+			muted_until     DATETIME NULL,
 			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at      DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			UNIQUE KEY uk_conv_user (conversation_id, user_id),
@@ -72,13 +84,42 @@ func CreateTables() error {
 			conversation_id VARCHAR(36) NOT NULL,
 			sender_id       VARCHAR(36) NOT NULL,
 			sender_type     ENUM('user', 'bot') DEFAULT 'user',
-			type            ENUM('text', 'image', 'video', 'file', 'card') NOT NULL,
+			type            ENUM('text', 'image', 'video', 'file', 'card', 'merged') NOT NULL,
 			content         JSON NOT NULL,
 			reply_to_id     VARCHAR(36),
+			thread_root_id  VARCHAR(36) NULL,
+			forwarded_message_id      VARCHAR(36) NULL,
+			forwarded_conversation_id VARCHAR(36) NULL,
+			forwarded_sender_id       VARCHAR(36) NULL,
+			forwarded_sender_type     ENUM('user', 'bot') NULL,
+			forwarded_created_at      DATETIME NULL,
+			edited_at       DATETIME NULL,
+			recalled_at     DATETIME NULL,
+			recalled_by     VARCHAR(36) NULL,
+			client_msg_id   VARCHAR(64) NULL,
 			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at      DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			INDEX idx_conv_time (conversation_id, created_at),
-			INDEX idx_reply (reply_to_id)
+			INDEX idx_reply (reply_to_id),
+			INDEX idx_thread (thread_root_id, created_at),
+			UNIQUE KEY uk_sender_client_msg (sender_id, conversation_id, client_msg_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS message_edits (
+			id          VARCHAR(36) PRIMARY KEY,
+			message_id  VARCHAR(36) NOT NULL,
+			content     JSON NOT NULL,
+			edited_by   VARCHAR(36) NOT NULL,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_message (message_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS message_reactions (
+			id          VARCHAR(36) PRIMARY KEY,
+			message_id  VARCHAR(36) NOT NULL,
+			user_id     VARCHAR(36) NOT NULL,
+			emoji       VARCHAR(32) NOT NULL,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY uk_message_user_emoji (message_id, user_id, emoji),
+			INDEX idx_user (user_id)
 		)`,
 		`CREATE TABLE IF NOT EXISTS mentions (
 			id          VARCHAR(36) PRIMARY KEY,
@@ -88,6 +129,48 @@ func CreateTables() error {
 			INDEX idx_message (message_id),
 			INDEX idx_user (user_id)
 		)`,
+		`CREATE TABLE IF NOT EXISTS message_pins (
+			id              VARCHAR(36) PRIMARY KEY,
+			conversation_id VARCHAR(36) NOT NULL,
+			message_id      VARCHAR(36) NOT NULL,
+			pinned_by       VARCHAR(36) NOT NULL,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY uk_message (message_id),
+			INDEX idx_conv_time (conversation_id, created_at)
+		)`,
+		// 定时消息。发送时以 sched:<id> 作为 client_msg_id，重启后重新投递也不会重复发送
+		`CREATE TABLE IF NOT EXISTS scheduled_messages (
+			id              VARCHAR(36) PRIMARY KEY,
+			conversation_id VARCHAR(36) NOT NULL,
+			sender_id       VARCHAR(36) NOT NULL,
+			sender_type     ENUM('user', 'bot') NOT NULL,
+			type            ENUM('text', 'image', 'video', 'file', 'card') NOT NULL,
+			content         JSON NOT NULL,
+			reply_to_id     VARCHAR(36) NULL,
+			thread_root_id  VARCHAR(36) NULL,
+			send_at         DATETIME NOT NULL,
+			status          ENUM('pending', 'sending', 'sent', 'canceled', 'failed') NOT NULL DEFAULT 'pending',
+			message_id      VARCHAR(36) NULL,
+			error           VARCHAR(255) NULL,
+			attempts        INT NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NULL,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at      DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			INDEX idx_status_send_at (status, send_at),
+			INDEX idx_sender (sender_id, sender_type, status)
+		)`,
+		// 话题参与者：发过回复、被 @ 或发起根消息的用户，(last_read_at, last_read_message_id) 为话题内的已读位置
+		`CREATE TABLE IF NOT EXISTS thread_participants (
+			thread_root_id  VARCHAR(36) NOT NULL,
+			conversation_id VARCHAR(36) NOT NULL,
+			user_id         VARCHAR(36) NOT NULL,
+			last_read_message_id VARCHAR(36) NULL,
+			last_read_at    DATETIME NULL,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (thread_root_id, user_id),
+			INDEX idx_user (user_id),
+			INDEX idx_conv (conversation_id)
+		)`,
 		`CREATE TABLE IF NOT EXISTS bots (
 			id          VARCHAR(36) PRIMARY KEY,
 			name        VARCHAR(100) NOT NULL,
@@ -112,11 +195,93 @@ func CreateTables() error {
 		`CREATE TABLE IF NOT EXISTS device_tokens (
 			id          VARCHAR(36) PRIMARY KEY,
 			user_id     VARCHAR(36) NOT NULL,
+			session_id  VARCHAR(36) NULL,
 			platform    ENUM('ios', 'android') NOT NULL,
 			token       VARCHAR(255) NOT NULL,
+			locale      VARCHAR(16) NOT NULL DEFAULT '',
 			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at  DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-			UNIQUE KEY uk_user_platform (user_id, platform)
+			UNIQUE KEY uk_session (session_id),
+			INDEX idx_user (user_id)
+		)`,
+		// 登录会话，访问令牌通过 sid 关联会话，撤销会话即令其所有令牌失效
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id           VARCHAR(36) PRIMARY KEY,
+			user_id      VARCHAR(36) NOT NULL,
+			device_name  VARCHAR(100) NOT NULL DEFAULT '',
+			platform     VARCHAR(32) NOT NULL DEFAULT '',
+			ip           VARCHAR(45) NOT NULL DEFAULT '',
+			user_agent   VARCHAR(255) NOT NULL DEFAULT '',
+			created_at   DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_used_at DATETIME NOT NULL,
+			expires_at   DATETIME NOT NULL,
+			revoked_at   DATETIME NULL,
+			INDEX idx_user (user_id)
+		)`,
+		// 刷新令牌只保存哈希。每次刷新都会签发新令牌并标记旧令牌已使用，已使用的令牌再次出现说明令牌已泄露
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token_hash  CHAR(64) PRIMARY KEY,
+			session_id  VARCHAR(36) NOT NULL,
+			used_at     DATETIME NULL,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_session (session_id)
+		)`,
+		// 管理员生成的密码重置令牌，只保存哈希，使用一次后失效
+		`CREATE TABLE IF NOT EXISTS password_resets (
+			token_hash  CHAR(64) PRIMARY KEY,
+			user_id     VARCHAR(36) NOT NULL,
+			created_by  VARCHAR(36) NOT NULL,
+			expires_at  DATETIME NOT NULL,
+			used_at     DATETIME NULL,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_user (user_id)
+		)`,
+		// 两步验证的 TOTP 密钥，enabled_at 为空表示已生成密钥但尚未验证启用。
+		// last_step 为最近一次通过验证的时间步，同一验证码不能重复使用
+		`CREATE TABLE IF NOT EXISTS user_totp (
+			user_id     VARCHAR(36) PRIMARY KEY,
+			secret      VARCHAR(64) NOT NULL,
+			enabled_at  DATETIME NULL,
+			last_step   BIGINT NOT NULL DEFAULT 0,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			code_hash   CHAR(64) PRIMARY KEY,
+			user_id     VARCHAR(36) NOT NULL,
+			used_at     DATETIME NULL,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_user (user_id)
+		)`,
+		// 管理员在运行时修改的全局设置
+		`CREATE TABLE IF NOT EXISTS settings (
+			name        VARCHAR(64) PRIMARY KEY,
+			value       VARCHAR(255) NOT NULL,
+			updated_by  VARCHAR(36) NULL,
+			updated_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		// 安全相关事件的审计记录，user_id 为空表示无法对应到用户，例如按 IP 锁定
+		`CREATE TABLE IF NOT EXISTS audit_logs (
+			id          BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id     VARCHAR(36) NULL,
+			action      VARCHAR(50) NOT NULL,
+			ip          VARCHAR(64) NOT NULL DEFAULT '',
+			detail      VARCHAR(255) NOT NULL DEFAULT '',
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_user_created (user_id, created_at),
+			INDEX idx_action_created (action, created_at)
+		)`,
+		// 增量同步的变更记录。user_id 为空表示会话内所有成员可见，否则只对该用户可见
+		`CREATE TABLE IF NOT EXISTS sync_changes (
+			id              BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id         VARCHAR(36) NULL,
+			conversation_id VARCHAR(36) NOT NULL,
+			entity          ENUM('conversation', 'member', 'bot', 'message', 'read_state') NOT NULL,
+			entity_id       VARCHAR(36) NOT NULL,
+			action          ENUM('upsert', 'delete') NOT NULL,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_user (user_id, id),
+			INDEX idx_conversation (conversation_id, id),
+			INDEX idx_created (created_at)
 		)`,
 	}
 
@@ -126,6 +291,166 @@ func CreateTables() error {
 		}
 	}
 
+	if err := migrateColumns(); err != nil {
+		return err
+	}
+
+	if err := migrateColumnTypes(); err != nil {
+		return err
+	}
+
+	if err := migrateIndexes(); err != nil {
+		return err
+	}
+
+	if err := migrateDeviceTokens(); err != nil {
+		return err
+	}
+
 	log.Println("Database tables created successfully")
 	return nil
 }
+
+// migrateColumns 为旧版本创建的表补充新增的列，CREATE TABLE IF NOT EXISTS 不会修改已有表
+func migrateColumns() error {
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+	}{
+		{"conversations", "pin_permission", "ENUM('admins', 'members') NOT NULL DEFAULT 'admins'"},
+		{"users", "status", "ENUM('online', 'away', 'busy', 'invisible') NOT NULL DEFAULT 'online'"},
+		{"users", "last_seen_at", "DATETIME NULL"},
+		{"users", "dnd_enabled", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"users", "dnd_start", "CHAR(5) NOT NULL DEFAULT '22:00'"},
+		{"users", "dnd_end", "CHAR(5) NOT NULL DEFAULT '08:00'"},
+		{"users", "timezone", "VARCHAR(64) NOT NULL DEFAULT ''"},
+		{"users", "deleted_at", "DATETIME NULL"},
+		{"messages", "edited_at", "DATETIME NULL"},
+		{"messages", "recalled_at", "DATETIME NULL"},
+		{"messages", "recalled_by", "VARCHAR(36) NULL"},
+		{"messages", "client_msg_id", "VARCHAR(64) NULL"},
+		{"messages", "thread_root_id", "VARCHAR(36) NULL"},
+		{"messages", "forwarded_message_id", "VARCHAR(36) NULL"},
+		{"messages", "forwarded_conversation_id", "VARCHAR(36) NULL"},
+		{"messages", "forwarded_sender_id", "VARCHAR(36) NULL"},
+		{"messages", "forwarded_sender_type", "ENUM('user', 'bot') NULL"},
+		{"messages", "forwarded_created_at", "DATETIME NULL"},
+		{"conversation_members", "last_read_message_id", "VARCHAR(36) NULL"},
+		{"conversation_members", "last_read_at", "DATETIME NULL"},
+		{"scheduled_messages", "attempts", "INT NOT NULL DEFAULT 0"},
+		{"scheduled_messages", "next_attempt_at", "DATETIME NULL"},
+		{"thread_participants", "last_read_message_id", "VARCHAR(36) NULL"},
+		{"conversation_members", "notify_level", "ENUM('all', 'mentions') NOT NULL DEFAULT 'all'"},
+		{"conversation_members", "muted_until", "DATETIME NULL"},
+		{"device_tokens", "locale", "VARCHAR(16) NOT NULL DEFAULT ''"},
+		{"device_tokens", "session_id", "VARCHAR(36) NULL"},
+		{"sessions", "device_name", "VARCHAR(100) NOT NULL DEFAULT ''"},
+		{"sessions", "platform", "VARCHAR(32) NOT NULL DEFAULT ''"},
+		{"sessions", "ip", "VARCHAR(45) NOT NULL DEFAULT ''"},
+		{"sessions", "user_agent", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	}
+
+	for _, col := range columns {
+		var exists bool
+		err := DB.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?)
+		`, col.table, col.column).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := DB.Exec("ALTER TABLE " + col.table + " ADD COLUMN " + col.column + " " + col.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateColumnTypes 修改旧版本创建的列的类型，如为 ENUM 增加新的取值。
+// columnType 为 information_schema 中的 COLUMN_TYPE，与之不同时才执行 MODIFY
+func migrateColumnTypes() error {
+	columns := []struct {
+		table      string
+		column     string
+		columnType string
+		definition string
+	}{
+		{"messages", "type", "enum('text','image','video','file','card','merged')", "ENUM('text', 'image', 'video', 'file', 'card', 'merged') NOT NULL"},
+	}
+
+	for _, col := range columns {
+		var current string
+		err := DB.QueryRow(`
+			SELECT COLUMN_TYPE FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+		`, col.table, col.column).Scan(&current)
+		if err != nil {
+			return err
+		}
+		if current == col.columnType {
+			continue
+		}
+		if _, err := DB.Exec("ALTER TABLE " + col.table + " MODIFY COLUMN " + col.column + " " + col.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateIndexes 为旧版本创建的表补充新增的索引
+func migrateIndexes() error {
+	indexes := []struct {
+		table      string
+		name       string
+		definition string
+	}{
+		{"messages", "uk_sender_client_msg", "UNIQUE KEY uk_sender_client_msg (sender_id, conversation_id, client_msg_id)"},
+		{"messages", "idx_thread", "INDEX idx_thread (thread_root_id, created_at)"},
+		{"device_tokens", "uk_session", "UNIQUE KEY uk_session (session_id)"},
+		{"device_tokens", "idx_user", "INDEX idx_user (user_id)"},
+	}
+
+	for _, idx := range indexes {
+		var exists bool
+		err := DB.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM information_schema.STATISTICS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?)
+		`, idx.table, idx.name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := DB.Exec("ALTER TABLE " + idx.table + " ADD " + idx.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateDeviceTokens 将设备令牌从每个用户每个平台一个改为每个登录会话一个。
+// 旧记录不属于任何会话，其登录令牌也已失效，客户端重新登录后会重新注册
+func migrateDeviceTokens() error {
+	var exists bool
+	err := DB.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'device_tokens' AND INDEX_NAME = 'uk_user_platform')
+	`).Scan(&exists)
+	if err != nil || !exists {
+		return err
+	}
+
+	if _, err := DB.Exec("ALTER TABLE device_tokens DROP INDEX uk_user_platform"); err != nil {
+		return err
+	}
+	_, err = DB.Exec("DELETE FROM device_tokens WHERE session_id IS NULL")
+	return err
+}
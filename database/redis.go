@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	"log"
+	"talkbox/config"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis 在配置了 REDIS_URL 时可用，否则为 nil
+var Redis *redis.Client
+
+func ConnectRedis() error {
+	if config.Cfg.RedisURL == "" {
+		return nil
+	}
+
+	opts, err := redis.ParseURL(config.Cfg.RedisURL)
+	if err != nil {
+		return err
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return err
+	}
+
+	Redis = client
+	log.Println("Redis connected successfully")
+	return nil
+}
@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/database"
+	"talkbox/middleware"
+	"talkbox/models"
+	"talkbox/services"
+	"talkbox/utils"
+	"talkbox/websocket"
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// ChangePassword 修改密码，当前会话保持登录，其他会话全部下线
+func ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	err := services.ChangePassword(middleware.GetUserID(c), middleware.GetSessionID(c), req.CurrentPassword, req.NewPassword)
+	switch {
+	case errors.Is(err, services.ErrWrongPassword):
+		utils.Forbidden(c, err.Error())
+	case errors.Is(err, services.ErrSamePassword):
+		utils.BadRequest(c, err.Error())
+	case err != nil:
+		utils.InternalError(c, "failed to change password")
+	default:
+		utils.Success(c, nil)
+	}
+}
+
+// CreatePasswordReset 由管理员为用户生成密码重置令牌，令牌需通过其他渠道交给用户
+func CreatePasswordReset(c *gin.Context) {
+	token, expiresAt, err := services.CreatePasswordReset(c.Param("id"), middleware.GetUserID(c))
+	if errors.Is(err, services.ErrUserNotFound) {
+		utils.NotFound(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "failed to create reset token")
+		return
+	}
+
+	utils.Success(c, gin.H{"token": token, "expires_at": expiresAt})
+}
+
+// ResetPassword 使用重置令牌设置新密码，不需要登录，用户的所有会话都会下线
+func ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	err := services.ResetPassword(req.Token, req.NewPassword)
+	if errors.Is(err, services.ErrInvalidResetToken) {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "failed to reset password")
+		return
+	}
+
+	utils.Success(c, nil)
+}
+
+// DeleteAccount 注销当前账号。用户退出所有会话，所拥有的群转让给其他成员，Bot 被移出所有会话并作废 Token，
+// 所有登录会话下线。用户记录保留并清除个人信息，已发送的消息显示为已注销用户。
+// 数据库修改在同一个事务中完成，变更记录和会话下线在提交后进行，失败时可以安全重试
+func DeleteAccount(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	var req DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	err := services.VerifyPassword(userID, req.Password)
+	if errors.Is(err, services.ErrWrongPassword) {
+		utils.Forbidden(c, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrUserNotFound) {
+		utils.NotFound(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	changes, leftConvIDs, err := deleteAccount(userID)
+	if errors.Is(err, services.ErrUserNotFound) {
+		utils.NotFound(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "failed to delete account")
+		return
+	}
+
+	services.RecordChanges(changes...)
+	for _, convID := range leftConvIDs {
+		websocket.HubInstance.MemberRemoved(convID, userID)
+	}
+	if _, err := services.RevokeOtherSessions(userID, ""); err != nil {
+		log.Printf("failed to revoke sessions of deleted account %s: %v", userID, err)
+	}
+
+	utils.Success(c, nil)
+}
+
+// deleteAccount 在一个事务中匿名化用户、退出所有会话、回收 Bot 并清理个人数据，
+// 返回提交后需要记录的变更和用户退出的会话。用户已注销时返回 ErrUserNotFound
+func deleteAccount(userID string) ([]services.Change, []string, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// 先更新用户行，并发的注销请求在此串行，后到的看到 deleted_at 已设置
+	now := time.Now()
+	result, err := tx.Exec(`
+		UPDATE users SET username = ?, nickname = ?, avatar = NULL, password = '', status = 'invisible',
+			dnd_enabled = FALSE, timezone = '', deleted_at = ?, updated_at = ?
+		WHERE id = ? AND deleted_at IS NULL
+	`, "deleted-"+userID, models.DeletedUserNickname, now, now, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return nil, nil, services.ErrUserNotFound
+	}
+
+	changes, convIDs, err := leaveAllConversations(tx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	botChanges, err := retireBots(tx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes = append(changes, botChanges...)
+
+	cleanup := []string{
+		"UPDATE scheduled_messages SET status = 'canceled', error = 'sender account deleted' WHERE sender_type = 'user' AND sender_id = ? AND status = 'pending'",
+		"DELETE FROM password_resets WHERE user_id = ?",
+		"DELETE FROM user_totp WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM device_tokens WHERE user_id = ?",
+	}
+	for _, stmt := range cleanup {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return changes, convIDs, nil
+}
+
+// leaveAllConversations 让用户退出所有会话。用户是群主时把群转让给最早加入的管理员或成员，
+// 群里没有其他成员时删除该群
+func leaveAllConversations(tx *sql.Tx, userID string) ([]services.Change, []string, error) {
+	rows, err := tx.Query(`
+		SELECT m.conversation_id, c.type, m.role
+		FROM conversation_members m
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE m.user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type membership struct {
+		convID, convType, role string
+	}
+	var memberships []membership
+	for rows.Next() {
+		var m membership
+		if err := rows.Scan(&m.convID, &m.convType, &m.role); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		memberships = append(memberships, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var changes []services.Change
+	var convIDs []string
+	for _, m := range memberships {
+		convIDs = append(convIDs, m.convID)
+		if m.convType == "group" && m.role == "owner" {
+			handOver, err := handOverGroup(tx, m.convID, userID)
+			if err != nil {
+				return nil, nil, err
+			}
+			changes = append(changes, handOver...)
+			continue
+		}
+
+		if _, err := tx.Exec(
+			"DELETE FROM conversation_members WHERE conversation_id = ? AND user_id = ?",
+			m.convID, userID,
+		); err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, memberRemovedChanges(m.convID, userID)...)
+	}
+
+	if _, err := tx.Exec("DELETE FROM thread_participants WHERE user_id = ?", userID); err != nil {
+		return nil, nil, err
+	}
+	return changes, convIDs, nil
+}
+
+func handOverGroup(tx *sql.Tx, convID, ownerID string) ([]services.Change, error) {
+	var successor string
+	err := tx.QueryRow(`
+		SELECT user_id FROM conversation_members
+		WHERE conversation_id = ? AND user_id != ?
+		ORDER BY role = 'admin' DESC, created_at ASC
+		LIMIT 1
+	`, convID, ownerID).Scan(&successor)
+	if err == sql.ErrNoRows {
+		if err := deleteConversationTx(tx, convID); err != nil {
+			return nil, err
+		}
+		return memberRemovedChanges(convID, ownerID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(
+		"UPDATE conversation_members SET role = 'owner', updated_at = ? WHERE conversation_id = ? AND user_id = ?",
+		now, convID, successor,
+	); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE conversations SET owner_id = ?, updated_at = ? WHERE id = ?", successor, now, convID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM conversation_members WHERE conversation_id = ? AND user_id = ?", convID, ownerID); err != nil {
+		return nil, err
+	}
+
+	changes := memberRemovedChanges(convID, ownerID)
+	changes = append(changes,
+		services.Change{ConversationID: convID, Entity: services.EntityMember, EntityID: successor, Action: services.ChangeUpsert},
+		services.Change{ConversationID: convID, Entity: services.EntityConversation, EntityID: convID, Action: services.ChangeUpsert},
+	)
+	return changes, nil
+}
+
+// retireBots 将用户的 Bot 移出所有会话并作废其 Token。Bot 记录保留，已发送的消息仍能显示发送者
+func retireBots(tx *sql.Tx, ownerID string) ([]services.Change, error) {
+	rows, err := tx.Query(`
+		SELECT bc.bot_id, bc.conversation_id
+		FROM bot_conversations bc
+		JOIN bots b ON b.id = bc.bot_id
+		WHERE b.owner_id = ?
+	`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []services.Change
+	for rows.Next() {
+		var botID, convID string
+		if err := rows.Scan(&botID, &convID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changes = append(changes, services.Change{ConversationID: convID, Entity: services.EntityBot, EntityID: botID, Action: services.ChangeDelete})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(
+		"DELETE bc FROM bot_conversations bc JOIN bots b ON b.id = bc.bot_id WHERE b.owner_id = ?",
+		ownerID,
+	); err != nil {
+		return nil, err
+	}
+
+	botIDs, err := ownedBotIDs(tx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, botID := range botIDs {
+		if _, err := tx.Exec(
+			"UPDATE bots SET token = ?, updated_at = ? WHERE id = ?",
+			utils.GenerateBotToken(), time.Now(), botID,
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+func ownedBotIDs(tx *sql.Tx, ownerID string) ([]string, error) {
+	rows, err := tx.Query("SELECT id FROM bots WHERE owner_id = ?", ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// isActiveUser 判断用户存在且未注销
+func isActiveUser(userID string) bool {
+	var exists bool
+	database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND deleted_at IS NULL)", userID).Scan(&exists)
+	return exists
+}
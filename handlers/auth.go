@@ -2,29 +2,47 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 	"talkbox/database"
+	"talkbox/middleware"
 	"talkbox/models"
+	"talkbox/services"
 	"talkbox/utils"
 )
 
+// DeviceInfo 是登录时客户端上报的设备信息，显示在会话列表中
+type DeviceInfo struct {
+	DeviceName string `json:"device_name" binding:"max=100"`
+	Platform   string `json:"platform" binding:"max=32"` // 如 ios、android、web、macos、windows
+}
+
 type RegisterRequest struct {
 	Username string `json:"username" binding:"required,min=3,max=50"`
 	Password string `json:"password" binding:"required,min=6"`
 	Nickname string `json:"nickname"`
+	DeviceInfo
 }
 
 type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	DeviceInfo
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
 type AuthResponse struct {
-	Token string              `json:"token"`
-	User  models.UserResponse `json:"user"`
+	models.TokenPair
+	User models.UserResponse `json:"user"`
+	// RecoveryCodes 只在登录过程中完成两步验证绑定时返回
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
 }
 
 func Register(c *gin.Context) {
@@ -67,20 +85,20 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	token, err := utils.GenerateToken(id)
+	// 管理员要求启用两步验证时，新用户与登录一样先完成绑定才能拿到令牌
+	user := models.User{ID: id, Username: req.Username, Nickname: nickname}
+	device := sessionDevice(c, req.DeviceInfo)
+	challenge, err := services.LoginChallengeFor(user.ID, device)
 	if err != nil {
-		utils.InternalError(c, "failed to generate token")
+		utils.InternalError(c, "failed to check two-factor authentication")
+		return
+	}
+	if challenge != nil {
+		utils.Success(c, challenge)
 		return
 	}
 
-	utils.Success(c, AuthResponse{
-		Token: token,
-		User: models.UserResponse{
-			ID:       id,
-			Username: req.Username,
-			Nickname: nickname,
-		},
-	})
+	completeLogin(c, &user, device, nil)
 }
 
 func Login(c *gin.Context) {
@@ -90,18 +108,19 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	ip := c.ClientIP()
+	if wait := services.CheckLogin(req.Username, ip); wait > 0 {
+		utils.TooManyRequests(c, "too many failed login attempts, try again later", wait)
+		return
+	}
+
 	var user models.User
 	var avatar sql.NullString
 	err := database.DB.QueryRow(
-		"SELECT id, username, nickname, avatar, password FROM users WHERE username = ?",
+		"SELECT id, username, nickname, avatar, password FROM users WHERE username = ? AND deleted_at IS NULL",
 		req.Username,
 	).Scan(&user.ID, &user.Username, &user.Nickname, &avatar, &user.Password)
-
-	if err == sql.ErrNoRows {
-		utils.Unauthorized(c, "invalid username or password")
-		return
-	}
-	if err != nil {
+	if err != nil && err != sql.ErrNoRows {
 		utils.InternalError(c, "database error")
 		return
 	}
@@ -109,35 +128,98 @@ func Login(c *gin.Context) {
 		user.Avatar = avatar.String
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+	// 用户不存在时也做一次同样代价的比对，响应时间不会暴露用户名是否存在
+	hash := []byte(user.Password)
+	if err == sql.ErrNoRows {
+		hash = dummyPasswordHash()
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || err == sql.ErrNoRows {
+		if wait := services.RecordLoginFailure(req.Username, ip, user.ID); wait > 0 {
+			utils.TooManyRequests(c, "too many failed login attempts, try again later", wait)
+			return
+		}
 		utils.Unauthorized(c, "invalid username or password")
 		return
 	}
 
-	token, err := utils.GenerateToken(user.ID)
+	// 启用了两步验证或管理员要求启用时只返回挑战令牌，失败计数在验证码通过后才清除
+	device := sessionDevice(c, req.DeviceInfo)
+	challenge, err := services.LoginChallengeFor(user.ID, device)
+	if err != nil {
+		utils.InternalError(c, "failed to check two-factor authentication")
+		return
+	}
+	if challenge != nil {
+		utils.Success(c, challenge)
+		return
+	}
+	services.RecordLoginSuccess(req.Username)
+
+	completeLogin(c, &user, device, nil)
+}
+
+// completeLogin 为通过认证的用户创建会话并返回令牌
+func completeLogin(c *gin.Context, user *models.User, device services.SessionDevice, recoveryCodes []string) {
+	tokens, err := services.CreateSession(user.ID, device)
 	if err != nil {
-		utils.InternalError(c, "failed to generate token")
+		utils.InternalError(c, "failed to create session")
 		return
 	}
 
 	utils.Success(c, AuthResponse{
-		Token: token,
-		User:  *user.ToResponse(),
+		TokenPair:     *tokens,
+		User:          *user.ToResponse(),
+		RecoveryCodes: recoveryCodes,
 	})
 }
 
+// dummyPasswordHash 是用于不存在的用户的 bcrypt 哈希，与真实密码使用相同的代价
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte(utils.GenerateRefreshToken()), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// Logout 撤销当前会话，该会话的访问令牌和刷新令牌立即失效
 func Logout(c *gin.Context) {
+	err := services.RevokeSession(middleware.GetUserID(c), middleware.GetSessionID(c))
+	if err != nil && !errors.Is(err, services.ErrSessionNotFound) {
+		utils.InternalError(c, "failed to revoke session")
+		return
+	}
+
 	utils.Success(c, nil)
 }
 
+// RefreshToken 用刷新令牌换取新的令牌对，不需要访问令牌，访问令牌过期后也可调用
 func RefreshToken(c *gin.Context) {
-	userID := c.GetString("user_id")
+	var req RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
 
-	token, err := utils.GenerateToken(userID)
+	tokens, err := services.RefreshSession(req.RefreshToken, c.ClientIP(), c.Request.UserAgent())
+	if errors.Is(err, services.ErrInvalidRefreshToken) || errors.Is(err, services.ErrRefreshTokenReused) ||
+		errors.Is(err, services.ErrTwoFactorRequired) {
+		utils.Unauthorized(c, err.Error())
+		return
+	}
 	if err != nil {
-		utils.InternalError(c, "failed to generate token")
+		utils.InternalError(c, "failed to refresh token")
 		return
 	}
 
-	utils.Success(c, gin.H{"token": token})
+	utils.Success(c, tokens)
+}
+
+func sessionDevice(c *gin.Context, info DeviceInfo) services.SessionDevice {
+	return services.SessionDevice{
+		Name:      info.DeviceName,
+		Platform:  info.Platform,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
 }
@@ -9,6 +9,7 @@ import (
 	"talkbox/database"
 	"talkbox/middleware"
 	"talkbox/models"
+	"talkbox/services"
 	"talkbox/utils"
 )
 
@@ -25,8 +26,11 @@ type UpdateBotRequest struct {
 }
 
 type BotSendMessageRequest struct {
-	Type    string          `json:"type" binding:"required,oneof=text image video file card"`
-	Content json.RawMessage `json:"content" binding:"required"`
+	Type         string          `json:"type" binding:"required,oneof=text image video file card"`
+	Content      json.RawMessage `json:"content" binding:"required"`
+	ReplyToID    string          `json:"reply_to_id"`
+	ThreadRootID string          `json:"thread_root_id"`
+	ClientMsgID  string          `json:"client_msg_id" binding:"max=64"`
 }
 
 func GetMyBots(c *gin.Context) {
@@ -172,8 +176,21 @@ func DeleteBot(c *gin.Context) {
 		return
 	}
 
+	// 记录 Bot 从哪些会话中移除，供增量同步使用
+	var changes []services.Change
+	if rows, err := database.DB.Query("SELECT conversation_id FROM bot_conversations WHERE bot_id = ?", botID); err == nil {
+		for rows.Next() {
+			var convID string
+			if err := rows.Scan(&convID); err == nil {
+				changes = append(changes, services.Change{ConversationID: convID, Entity: services.EntityBot, EntityID: botID, Action: services.ChangeDelete})
+			}
+		}
+		rows.Close()
+	}
+
 	// Clean up bot conversations (ignore error as bot is already deleted)
 	_, _ = database.DB.Exec("DELETE FROM bot_conversations WHERE bot_id = ?", botID)
+	services.RecordChanges(changes...)
 
 	utils.Success(c, nil)
 }
@@ -265,20 +282,54 @@ func BotSendMessage(c *gin.Context) {
 		return
 	}
 
-	msgID := utils.GenerateUUID()
-	now := time.Now()
+	msg, err := services.SendMessage(&services.SendMessageInput{
+		ConversationID: convID,
+		SenderID:       botID,
+		SenderType:     "bot",
+		Type:           req.Type,
+		Content:        req.Content,
+		ReplyToID:      req.ReplyToID,
+		ThreadRootID:   req.ThreadRootID,
+		ClientMsgID:    req.ClientMsgID,
+	})
+	if err != nil {
+		respondSendError(c, err)
+		return
+	}
 
-	_, err = database.DB.Exec(`
-		INSERT INTO messages (id, conversation_id, sender_id, sender_type, type, content, created_at, updated_at)
-		VALUES (?, ?, ?, 'bot', ?, ?, ?, ?)
-	`, msgID, convID, botID, req.Type, string(req.Content), now, now)
+	utils.Success(c, gin.H{"message_id": msg.ID, "message": msg})
+}
 
-	if err != nil {
-		utils.InternalError(c, "failed to send message")
+func BotEditMessage(c *gin.Context) {
+	botID := middleware.GetBotID(c)
+	convID := c.Param("conversation_id")
+
+	var exists bool
+	err := database.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM bot_conversations WHERE bot_id = ? AND conversation_id = ?)",
+		botID, convID,
+	).Scan(&exists)
+	if err != nil || !exists {
+		utils.Forbidden(c, "bot is not a member of this conversation")
 		return
 	}
 
-	_, _ = database.DB.Exec("UPDATE conversations SET updated_at = ? WHERE id = ?", now, convID)
+	editMessage(c, convID, c.Param("msg_id"), "bot", botID)
+}
+
+func BotRecallMessage(c *gin.Context) {
+	botID := middleware.GetBotID(c)
+	convID := c.Param("conversation_id")
+
+	var exists bool
+	err := database.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM bot_conversations WHERE bot_id = ? AND conversation_id = ?)",
+		botID, convID,
+	).Scan(&exists)
+	if err != nil || !exists {
+		utils.Forbidden(c, "bot is not a member of this conversation")
+		return
+	}
 
-	utils.Success(c, gin.H{"message_id": msgID})
+	recallMessage(c, convID, c.Param("msg_id"), "bot", botID, false)
 }
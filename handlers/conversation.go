@@ -8,7 +8,9 @@ import (
 	"talkbox/database"
 	"talkbox/middleware"
 	"talkbox/models"
+	"talkbox/services"
 	"talkbox/utils"
+	"talkbox/websocket"
 )
 
 type CreateConversationRequest struct {
@@ -18,8 +20,9 @@ type CreateConversationRequest struct {
 }
 
 type UpdateConversationRequest struct {
-	Name   string `json:"name"`
-	Avatar string `json:"avatar"`
+	Name          string `json:"name"`
+	Avatar        string `json:"avatar"`
+	PinPermission string `json:"pin_permission" binding:"omitempty,oneof=admins members"`
 }
 
 type AddMembersRequest struct {
@@ -33,33 +36,115 @@ type UpdateMemberRequest struct {
 func GetConversations(c *gin.Context) {
 	userID := middleware.GetUserID(c)
 
+	conversations, err := loadConversations(userID, nil)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	if conversations == nil {
+		conversations = []models.ConversationResponse{}
+	}
+
+	utils.Success(c, conversations)
+}
+
+// loadConversations 加载用户所在的会话及未读数和最后一条消息，convIDs 为 nil 时加载全部会话
+func loadConversations(userID string, convIDs []string) ([]models.ConversationResponse, error) {
+	filter := ""
+	args := []interface{}{userID}
+	if convIDs != nil {
+		if len(convIDs) == 0 {
+			return nil, nil
+		}
+		placeholders, idArgs := services.InClause(convIDs)
+		args = append(args, idArgs...)
+		filter = " AND c.id IN (" + placeholders + ")"
+	}
+
+	// 未读数以成员的已读位置 (last_read_at, last_read_message_id) 为界，与分页游标一样按 (created_at, id) 比较，
+	// 从未标记已读时以加入时间为界；自己发送的、已撤回的和话题内的消息不计入。
+	// 口径与 push.loadBadges 的角标一致，修改时需同步
 	rows, err := database.DB.Query(`
-		SELECT c.id, c.type, c.name, c.avatar, c.owner_id, c.created_at, c.updated_at
+		SELECT c.id, c.type, COALESCE(c.name, ''), COALESCE(c.avatar, ''), COALESCE(c.owner_id, ''), c.pin_permission, c.created_at, c.updated_at,
+			(SELECT COUNT(*) FROM messages msg
+				WHERE msg.conversation_id = c.id AND msg.recalled_at IS NULL AND msg.thread_root_id IS NULL
+				AND (msg.created_at > COALESCE(m.last_read_at, m.created_at)
+					OR (msg.created_at = m.last_read_at AND msg.id > COALESCE(m.last_read_message_id, '')))
+				AND NOT (msg.sender_type = 'user' AND msg.sender_id = m.user_id)) AS unread_count,
+			(SELECT COUNT(*) FROM mentions mn
+				JOIN messages msg ON msg.id = mn.message_id
+				WHERE mn.user_id = m.user_id AND msg.conversation_id = c.id AND msg.recalled_at IS NULL AND msg.thread_root_id IS NULL
+				AND (msg.created_at > COALESCE(m.last_read_at, m.created_at)
+					OR (msg.created_at = m.last_read_at AND msg.id > COALESCE(m.last_read_message_id, '')))
+				AND NOT (msg.sender_type = 'user' AND msg.sender_id = m.user_id)) AS unread_mention_count,
+			(SELECT msg.id FROM messages msg
+				WHERE msg.conversation_id = c.id AND msg.thread_root_id IS NULL
+				ORDER BY msg.created_at DESC, msg.id DESC LIMIT 1) AS last_message_id,
+			m.notify_level, m.muted_until
 		FROM conversations c
 		JOIN conversation_members m ON c.id = m.conversation_id
-		WHERE m.user_id = ?
+		WHERE m.user_id = ?`+filter+`
 		ORDER BY c.updated_at DESC
-	`, userID)
+	`, args...)
 	if err != nil {
-		utils.InternalError(c, "database error")
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
+	now := time.Now()
 	var conversations []models.ConversationResponse
+	var lastMessageIDs []string
 	for rows.Next() {
 		var conv models.Conversation
-		if err := rows.Scan(&conv.ID, &conv.Type, &conv.Name, &conv.Avatar, &conv.OwnerID, &conv.CreatedAt, &conv.UpdatedAt); err != nil {
+		var unreadCount, unreadMentionCount int
+		var lastMessageID sql.NullString
+		var notifyLevel string
+		var mutedUntil sql.NullTime
+		if err := rows.Scan(&conv.ID, &conv.Type, &conv.Name, &conv.Avatar, &conv.OwnerID, &conv.PinPermission, &conv.CreatedAt, &conv.UpdatedAt,
+			&unreadCount, &unreadMentionCount, &lastMessageID, &notifyLevel, &mutedUntil); err != nil {
 			continue
 		}
-		conversations = append(conversations, *conv.ToResponse())
+		resp := conv.ToResponse()
+		resp.UnreadCount = unreadCount
+		resp.UnreadMentionCount = unreadMentionCount
+		resp.NotifyLevel = notifyLevel
+		if mutedUntil.Valid {
+			resp.MutedUntil = &mutedUntil.Time
+		}
+		resp.BadgeCount = badgeCount(unreadCount, unreadMentionCount, notifyLevel, mutedUntil, now)
+		if lastMessageID.Valid {
+			lastMessageIDs = append(lastMessageIDs, lastMessageID.String)
+		}
+		conversations = append(conversations, *resp)
 	}
 
-	if conversations == nil {
-		conversations = []models.ConversationResponse{}
+	// 批量加载每个会话的最后一条消息
+	if lastMessages, err := services.LoadMessages(lastMessageIDs, ""); err == nil {
+		convIndex := make(map[string]int, len(conversations))
+		for i, conv := range conversations {
+			convIndex[conv.ID] = i
+		}
+		for _, msg := range lastMessages {
+			if idx, ok := convIndex[msg.ConversationID]; ok {
+				conversations[idx].LastMessage = msg
+			}
+		}
 	}
 
-	utils.Success(c, conversations)
+	return conversations, nil
+}
+
+// badgeCount 按通知设置计算会话计入角标的未读数，与 push.loadBadges 的过滤条件一致
+func badgeCount(unread, unreadMentions int, notifyLevel string, mutedUntil sql.NullTime, now time.Time) int {
+	switch {
+	case mutedUntil.Valid && mutedUntil.Time.After(now):
+		return 0
+	case notifyLevel == models.NotifyMentions:
+		return unreadMentions
+	default:
+		return unread
+	}
 }
 
 func CreateConversation(c *gin.Context) {
@@ -101,11 +186,16 @@ func CreateConversation(c *gin.Context) {
 		return
 	}
 
+	joined := []string{userID}
 	var failedMembers []string
 	for _, uid := range req.MemberIDs {
 		if uid == userID {
 			continue
 		}
+		if !isActiveUser(uid) {
+			failedMembers = append(failedMembers, uid)
+			continue
+		}
 		mid := utils.GenerateUUID()
 		_, err = tx.Exec(
 			"INSERT INTO conversation_members (id, conversation_id, user_id, role, created_at, updated_at) VALUES (?, ?, ?, 'member', ?, ?)",
@@ -113,7 +203,9 @@ func CreateConversation(c *gin.Context) {
 		)
 		if err != nil {
 			failedMembers = append(failedMembers, uid)
+			continue
 		}
+		joined = append(joined, uid)
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -121,6 +213,8 @@ func CreateConversation(c *gin.Context) {
 		return
 	}
 
+	services.RecordChanges(services.MemberChanges(convID, joined, services.EntityConversation, convID, services.ChangeUpsert)...)
+
 	response := gin.H{"id": convID}
 	if len(failedMembers) > 0 {
 		response["failed_members"] = failedMembers
@@ -138,10 +232,15 @@ func GetConversation(c *gin.Context) {
 	}
 
 	var conv models.Conversation
-	err := database.DB.QueryRow(
-		"SELECT id, type, name, avatar, owner_id, created_at, updated_at FROM conversations WHERE id = ?",
-		convID,
-	).Scan(&conv.ID, &conv.Type, &conv.Name, &conv.Avatar, &conv.OwnerID, &conv.CreatedAt, &conv.UpdatedAt)
+	var notifyLevel string
+	var mutedUntil sql.NullTime
+	err := database.DB.QueryRow(`
+		SELECT c.id, c.type, c.name, c.avatar, c.owner_id, c.pin_permission, c.created_at, c.updated_at, m.notify_level, m.muted_until
+		FROM conversations c
+		JOIN conversation_members m ON m.conversation_id = c.id AND m.user_id = ?
+		WHERE c.id = ?
+	`, userID, convID).Scan(&conv.ID, &conv.Type, &conv.Name, &conv.Avatar, &conv.OwnerID, &conv.PinPermission, &conv.CreatedAt, &conv.UpdatedAt,
+		&notifyLevel, &mutedUntil)
 
 	if err == sql.ErrNoRows {
 		utils.NotFound(c, "conversation not found")
@@ -153,7 +252,8 @@ func GetConversation(c *gin.Context) {
 	}
 
 	rows, err := database.DB.Query(`
-		SELECT m.id, m.user_id, m.role, COALESCE(m.nickname, ''), u.username, COALESCE(u.nickname, ''), COALESCE(u.avatar, '')
+		SELECT m.id, m.user_id, m.role, COALESCE(m.nickname, ''), COALESCE(m.last_read_message_id, ''), m.last_read_at,
+			u.username, COALESCE(u.nickname, ''), COALESCE(u.avatar, ''), u.status, u.last_seen_at
 		FROM conversation_members m
 		JOIN users u ON u.id = m.user_id
 		WHERE m.conversation_id = ?
@@ -168,10 +268,17 @@ func GetConversation(c *gin.Context) {
 	for rows.Next() {
 		var m models.MemberWithUser
 		var user models.User
-		if err := rows.Scan(&m.ID, &m.UserID, &m.Role, &m.Nickname, &user.Username, &user.Nickname, &user.Avatar); err != nil {
+		var lastReadAt, lastSeenAt sql.NullTime
+		var status string
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Role, &m.Nickname, &m.LastReadMessageID, &lastReadAt,
+			&user.Username, &user.Nickname, &user.Avatar, &status, &lastSeenAt); err != nil {
 			continue
 		}
+		if lastReadAt.Valid {
+			m.LastReadAt = &lastReadAt.Time
+		}
 		user.ID = m.UserID
+		applyPresence(&user, status, lastSeenAt, userID)
 		m.User = *user.ToResponse()
 		members = append(members, m)
 	}
@@ -198,9 +305,20 @@ func GetConversation(c *gin.Context) {
 		bots = append(bots, bot)
 	}
 
+	pins, err := loadPins(convID, userID)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
 	resp := conv.ToResponse()
 	resp.Members = members
 	resp.Bots = bots
+	resp.Pins = pins
+	resp.NotifyLevel = notifyLevel
+	if mutedUntil.Valid {
+		resp.MutedUntil = &mutedUntil.Time
+	}
 
 	utils.Success(c, resp)
 }
@@ -222,14 +340,16 @@ func UpdateConversation(c *gin.Context) {
 	}
 
 	_, err := database.DB.Exec(
-		"UPDATE conversations SET name = COALESCE(NULLIF(?, ''), name), avatar = COALESCE(NULLIF(?, ''), avatar), updated_at = ? WHERE id = ?",
-		req.Name, req.Avatar, time.Now(), convID,
+		"UPDATE conversations SET name = COALESCE(NULLIF(?, ''), name), avatar = COALESCE(NULLIF(?, ''), avatar), pin_permission = COALESCE(NULLIF(?, ''), pin_permission), updated_at = ? WHERE id = ?",
+		req.Name, req.Avatar, req.PinPermission, time.Now(), convID,
 	)
 	if err != nil {
 		utils.InternalError(c, "failed to update conversation")
 		return
 	}
 
+	services.RecordChanges(services.Change{ConversationID: convID, Entity: services.EntityConversation, EntityID: convID, Action: services.ChangeUpsert})
+
 	GetConversation(c)
 }
 
@@ -243,56 +363,19 @@ func DeleteConversation(c *gin.Context) {
 		return
 	}
 
-	tx, err := database.DB.Begin()
+	// 删除后成员已无法通过会话看到变更，需要逐个记录
+	memberIDs, err := conversationMemberIDs(convID)
 	if err != nil {
 		utils.InternalError(c, "database error")
 		return
 	}
 
-	// 删除提及记录
-	_, err = tx.Exec("DELETE FROM mentions WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)", convID)
-	if err != nil {
-		tx.Rollback()
-		utils.InternalError(c, "failed to delete mentions")
-		return
-	}
-
-	// 删除消息
-	_, err = tx.Exec("DELETE FROM messages WHERE conversation_id = ?", convID)
-	if err != nil {
-		tx.Rollback()
-		utils.InternalError(c, "failed to delete messages")
-		return
-	}
-
-	// 删除成员
-	_, err = tx.Exec("DELETE FROM conversation_members WHERE conversation_id = ?", convID)
-	if err != nil {
-		tx.Rollback()
-		utils.InternalError(c, "failed to delete members")
-		return
-	}
-
-	// 删除Bot关联
-	_, err = tx.Exec("DELETE FROM bot_conversations WHERE conversation_id = ?", convID)
-	if err != nil {
-		tx.Rollback()
-		utils.InternalError(c, "failed to delete bots")
-		return
-	}
-
-	// 删除会话
-	_, err = tx.Exec("DELETE FROM conversations WHERE id = ?", convID)
-	if err != nil {
-		tx.Rollback()
+	if err := deleteConversation(convID); err != nil {
 		utils.InternalError(c, "failed to delete conversation")
 		return
 	}
 
-	if err := tx.Commit(); err != nil {
-		utils.InternalError(c, "failed to commit transaction")
-		return
-	}
+	services.RecordChanges(services.MemberChanges(convID, memberIDs, services.EntityConversation, convID, services.ChangeDelete)...)
 
 	utils.Success(c, nil)
 }
@@ -314,22 +397,67 @@ func AddMembers(c *gin.Context) {
 	}
 
 	now := time.Now()
+	var changes []services.Change
 	for _, uid := range req.UserIDs {
-		if isConversationMember(convID, uid) {
+		if isConversationMember(convID, uid) || !isActiveUser(uid) {
 			continue
 		}
 		memberID := utils.GenerateUUID()
-		database.DB.Exec(
+		_, err := database.DB.Exec(
 			"INSERT INTO conversation_members (id, conversation_id, user_id, role, created_at, updated_at) VALUES (?, ?, ?, 'member', ?, ?)",
 			memberID, convID, uid, now, now,
 		)
+		if err != nil {
+			continue
+		}
+		changes = append(changes,
+			services.Change{ConversationID: convID, Entity: services.EntityMember, EntityID: uid, Action: services.ChangeUpsert},
+			services.Change{UserID: uid, ConversationID: convID, Entity: services.EntityConversation, EntityID: convID, Action: services.ChangeUpsert},
+		)
 	}
 
 	database.DB.Exec("UPDATE conversations SET updated_at = ? WHERE id = ?", now, convID)
+	services.RecordChanges(changes...)
 
 	utils.Success(c, gin.H{"message": "members added"})
 }
 
+// deleteConversation 删除会话及其消息、成员和所有关联数据
+func deleteConversation(convID string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteConversationTx(tx, convID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteConversationTx 在调用方的事务中删除会话及其消息、成员等所有数据
+func deleteConversationTx(tx *sql.Tx, convID string) error {
+	statements := []string{
+		"DELETE FROM mentions WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM message_edits WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM message_reactions WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM scheduled_messages WHERE conversation_id = ?",
+		"DELETE FROM message_pins WHERE conversation_id = ?",
+		"DELETE FROM thread_participants WHERE conversation_id = ?",
+		"DELETE FROM messages WHERE conversation_id = ?",
+		"DELETE FROM conversation_members WHERE conversation_id = ?",
+		"DELETE FROM bot_conversations WHERE conversation_id = ?",
+		"DELETE FROM conversations WHERE id = ?",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, convID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func RemoveMember(c *gin.Context) {
 	userID := middleware.GetUserID(c)
 	convID := c.Param("id")
@@ -347,6 +475,8 @@ func RemoveMember(c *gin.Context) {
 			utils.InternalError(c, "failed to leave conversation")
 			return
 		}
+		services.RecordChanges(memberRemovedChanges(convID, userID)...)
+		websocket.HubInstance.MemberRemoved(convID, userID)
 		utils.Success(c, nil)
 		return
 	}
@@ -375,6 +505,9 @@ func RemoveMember(c *gin.Context) {
 		return
 	}
 
+	services.RecordChanges(memberRemovedChanges(convID, targetUserID)...)
+	websocket.HubInstance.MemberRemoved(convID, targetUserID)
+
 	utils.Success(c, nil)
 }
 
@@ -404,6 +537,8 @@ func UpdateMember(c *gin.Context) {
 		return
 	}
 
+	services.RecordChanges(services.Change{ConversationID: convID, Entity: services.EntityMember, EntityID: targetUserID, Action: services.ChangeUpsert})
+
 	utils.Success(c, nil)
 }
 
@@ -446,6 +581,8 @@ func AddBotToConversation(c *gin.Context) {
 		return
 	}
 
+	services.RecordChanges(services.Change{ConversationID: convID, Entity: services.EntityBot, EntityID: botID, Action: services.ChangeUpsert})
+
 	utils.Success(c, nil)
 }
 
@@ -469,6 +606,8 @@ func RemoveBotFromConversation(c *gin.Context) {
 		return
 	}
 
+	services.RecordChanges(services.Change{ConversationID: convID, Entity: services.EntityBot, EntityID: botID, Action: services.ChangeDelete})
+
 	utils.Success(c, nil)
 }
 
@@ -481,6 +620,32 @@ func isConversationMember(convID, userID string) bool {
 	return exists
 }
 
+// memberRemovedChanges 通知其余成员有人离开，并通知被移出的用户会话已不可见
+func memberRemovedChanges(convID, userID string) []services.Change {
+	return []services.Change{
+		{ConversationID: convID, Entity: services.EntityMember, EntityID: userID, Action: services.ChangeDelete},
+		{UserID: userID, ConversationID: convID, Entity: services.EntityConversation, EntityID: convID, Action: services.ChangeDelete},
+	}
+}
+
+func conversationMemberIDs(convID string) ([]string, error) {
+	rows, err := database.DB.Query("SELECT user_id FROM conversation_members WHERE conversation_id = ?", convID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
 func getConversationRole(convID, userID string) string {
 	var role string
 	database.DB.QueryRow(
@@ -544,5 +709,7 @@ func FindOrCreatePrivateConversation(userA, userB string) (string, error) {
 		return "", err
 	}
 
+	services.RecordChanges(services.MemberChanges(convID, []string{userA, userB}, services.EntityConversation, convID, services.ChangeUpsert)...)
+
 	return convID, nil
 }
@@ -3,21 +3,37 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"talkbox/config"
 	"talkbox/database"
 	"talkbox/middleware"
 	"talkbox/models"
+	"talkbox/services"
 	"talkbox/utils"
+	"talkbox/websocket"
 )
 
 type SendMessageRequest struct {
-	Type      string          `json:"type" binding:"required,oneof=text image video file card"`
-	Content   json.RawMessage `json:"content" binding:"required"`
-	ReplyToID string          `json:"reply_to_id"`
+	Type         string          `json:"type" binding:"required,oneof=text image video file card"`
+	Content      json.RawMessage `json:"content" binding:"required"`
+	ReplyToID    string          `json:"reply_to_id"`
+	ThreadRootID string          `json:"thread_root_id"`
+	ClientMsgID  string          `json:"client_msg_id" binding:"max=64"`
+}
+
+type ForwardMessagesRequest struct {
+	MessageIDs      []string `json:"message_ids" binding:"required"`
+	ConversationIDs []string `json:"conversation_ids" binding:"required"`
+	Mode            string   `json:"mode" binding:"omitempty,oneof=single merged"` // 默认 single 逐条转发
+}
+
+type EditMessageRequest struct {
+	Content json.RawMessage `json:"content" binding:"required"`
 }
 
 // escapeLikePattern 转义 SQL LIKE 查询中的特殊字符
@@ -37,143 +53,195 @@ func GetMessages(c *gin.Context) {
 		return
 	}
 
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
-	if limit > 100 {
-		limit = 100
+	req, ok := bindMessagePage(c)
+	if !ok {
+		return
 	}
 
-	before := c.Query("before")
+	messages, info, err := services.ListConversationMessages(convID, userID, req)
+	if errors.Is(err, services.ErrMessageNotFound) {
+		utils.NotFound(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
 
-	var rows *sql.Rows
-	var err error
+	utils.Success(c, models.MessagePage{Messages: messages, PageInfo: info})
+}
 
-	// 使用 LEFT JOIN 一次性获取消息和发送者信息，解决 N+1 问题
-	baseQuery := `
-		SELECT m.id, m.conversation_id, m.sender_id, m.sender_type, m.type, m.content, m.reply_to_id, m.created_at,
-			   COALESCE(u.id, '') as user_id, COALESCE(u.username, '') as username, COALESCE(u.nickname, '') as user_nickname, COALESCE(u.avatar, '') as user_avatar,
-			   COALESCE(b.id, '') as bot_id, COALESCE(b.name, '') as bot_name, COALESCE(b.avatar, '') as bot_avatar
-		FROM messages m
-		LEFT JOIN users u ON m.sender_type = 'user' AND m.sender_id = u.id
-		LEFT JOIN bots b ON m.sender_type = 'bot' AND m.sender_id = b.id
-		WHERE m.conversation_id = ?`
+// bindMessagePage 解析分页参数：before、after 为上一页返回的游标，around 为消息 ID，三者至多提供一个
+func bindMessagePage(c *gin.Context) (services.MessagePageRequest, bool) {
+	req := services.MessagePageRequest{Around: c.Query("around")}
 
-	if before != "" {
-		rows, err = database.DB.Query(baseQuery+` AND m.created_at < ? ORDER BY m.created_at DESC LIMIT ?`, convID, before, limit)
-	} else {
-		rows, err = database.DB.Query(baseQuery+` ORDER BY m.created_at DESC LIMIT ?`, convID, limit)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 {
+		limit = 50
 	}
+	req.Limit = min(limit, 100)
 
-	if err != nil {
-		utils.InternalError(c, "database error")
-		return
+	var ok bool
+	if req.Before, ok = queryMessageCursor(c, "before"); !ok {
+		return req, false
+	}
+	if req.After, ok = queryMessageCursor(c, "after"); !ok {
+		return req, false
 	}
-	defer rows.Close()
 
-	// 收集所有消息和需要查询回复的消息ID
-	var messages []models.MessageResponse
-	var replyIDs []string
-	replyIDMap := make(map[string]int) // replyID -> message index
+	provided := 0
+	for _, set := range []bool{req.Before != nil, req.After != nil, req.Around != ""} {
+		if set {
+			provided++
+		}
+	}
+	if provided > 1 {
+		utils.BadRequest(c, "only one of before, after and around may be provided")
+		return req, false
+	}
+	return req, true
+}
 
+func queryMessageCursor(c *gin.Context, name string) (*services.MessageCursor, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, true
+	}
+	cursor, err := services.DecodeMessageCursor(raw)
+	if err != nil {
+		utils.BadRequest(c, "invalid "+name+" cursor")
+		return nil, false
+	}
+	return &cursor, true
+}
+
+// collectMessages 读取查询结果中的消息 ID，批量加载后按原顺序返回
+func collectMessages(rows *sql.Rows, viewerID string) ([]models.MessageResponse, error) {
+	var ids []string
 	for rows.Next() {
-		var msgID, cID, senderID, senderType, msgType string
-		var contentJSON []byte
-		var replyToID sql.NullString
-		var createdAt time.Time
-		var userID, username, userNickname, userAvatar string
-		var botID, botName, botAvatar string
-
-		if err := rows.Scan(&msgID, &cID, &senderID, &senderType, &msgType, &contentJSON, &replyToID, &createdAt,
-			&userID, &username, &userNickname, &userAvatar, &botID, &botName, &botAvatar); err != nil {
+		var id string
+		if err := rows.Scan(&id); err != nil {
 			continue
 		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		resp := models.MessageResponse{
-			ID:             msgID,
-			ConversationID: cID,
-			Type:           msgType,
-			Content:        json.RawMessage(contentJSON),
-			CreatedAt:      createdAt,
-		}
+	loaded, err := services.LoadMessages(ids, viewerID)
+	if err != nil {
+		return nil, err
+	}
 
-		if replyToID.Valid {
-			resp.ReplyToID = replyToID.String
-			replyIDMap[replyToID.String] = len(messages)
-			replyIDs = append(replyIDs, replyToID.String)
+	messages := make([]models.MessageResponse, 0, len(ids))
+	for _, id := range ids {
+		if msg, ok := loaded[id]; ok {
+			messages = append(messages, *msg)
 		}
+	}
+	return messages, nil
+}
 
-		if senderType == "user" {
-			resp.Sender = models.SenderInfo{
-				ID:       userID,
-				Type:     "user",
-				Nickname: userNickname,
-				Avatar:   userAvatar,
-			}
-		} else {
-			resp.Sender = models.SenderInfo{
-				ID:       botID,
-				Type:     "bot",
-				Nickname: botName,
-				Avatar:   botAvatar,
-			}
-		}
+func SendMessage(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
 
-		messages = append(messages, resp)
+	if !isConversationMember(convID, userID) {
+		utils.Forbidden(c, "not a member of this conversation")
+		return
 	}
 
-	// 批量查询回复消息信息
-	if len(replyIDs) > 0 {
-		placeholders := strings.Repeat("?,", len(replyIDs)-1) + "?"
-		args := make([]interface{}, len(replyIDs))
-		for i, id := range replyIDs {
-			args[i] = id
-		}
+	var req SendMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
 
-		replyRows, err := database.DB.Query(`
-			SELECT m.id, m.type, m.content, m.sender_id, m.sender_type,
-				   COALESCE(u.nickname, '') as user_nickname,
-				   COALESCE(b.name, '') as bot_name
-			FROM messages m
-			LEFT JOIN users u ON m.sender_type = 'user' AND m.sender_id = u.id
-			LEFT JOIN bots b ON m.sender_type = 'bot' AND m.sender_id = b.id
-			WHERE m.id IN (`+placeholders+`)
-		`, args...)
-
-		if err == nil {
-			defer replyRows.Close()
-			for replyRows.Next() {
-				var replyMsgID, replyType, replySenderID, replySenderType string
-				var replyContent []byte
-				var userNickname, botName string
-
-				if err := replyRows.Scan(&replyMsgID, &replyType, &replyContent, &replySenderID, &replySenderType, &userNickname, &botName); err != nil {
-					continue
-				}
-
-				if idx, ok := replyIDMap[replyMsgID]; ok {
-					reply := models.ReplyInfo{
-						ID:      replyMsgID,
-						Type:    replyType,
-						Content: json.RawMessage(replyContent),
-					}
-					if replySenderType == "user" {
-						reply.SenderName = userNickname
-					} else {
-						reply.SenderName = botName
-					}
-					messages[idx].ReplyTo = &reply
-				}
-			}
+	msg, err := services.SendMessage(&services.SendMessageInput{
+		ConversationID: convID,
+		SenderID:       userID,
+		SenderType:     "user",
+		Type:           req.Type,
+		Content:        req.Content,
+		ReplyToID:      req.ReplyToID,
+		ThreadRootID:   req.ThreadRootID,
+		ClientMsgID:    req.ClientMsgID,
+	})
+	if err != nil {
+		respondSendError(c, err)
+		return
+	}
+
+	utils.Success(c, gin.H{"message_id": msg.ID, "message": msg})
+}
+
+// HandleSendMessageAction 处理 WebSocket 的 send_message 动作，并向发起连接回复 ack 或 error
+func HandleSendMessageAction(c *websocket.Client, msg *websocket.ClientMessage) {
+	sent, err := services.SendMessage(&services.SendMessageInput{
+		ConversationID: msg.ConversationID,
+		SenderID:       c.UserID,
+		SenderType:     "user",
+		Type:           msg.Type,
+		Content:        msg.Content,
+		ReplyToID:      msg.ReplyToID,
+		ThreadRootID:   msg.ThreadRootID,
+		ClientMsgID:    msg.ClientMsgID,
+	})
+	if err != nil {
+		var validationErr *services.ValidationError
+		switch {
+		case errors.Is(err, services.ErrNotMember):
+			c.Error(msg, websocket.ErrCodeNotMember, err.Error(), nil)
+		case errors.As(err, &validationErr):
+			c.Error(msg, websocket.ErrCodeInvalidPayload, validationErr.Error(), gin.H{"errors": validationErr.Errors})
+		default:
+			c.Error(msg, websocket.ErrCodeInternal, "failed to send message", nil)
 		}
+		return
 	}
 
-	if messages == nil {
-		messages = []models.MessageResponse{}
+	c.Ack(msg, gin.H{
+		"client_msg_id": msg.ClientMsgID,
+		"message":       sent,
+	})
+}
+
+func ForwardMessages(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	var req ForwardMessagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
 	}
 
-	utils.Success(c, messages)
+	sent, failed, err := services.ForwardMessages(userID, req.MessageIDs, req.ConversationIDs, req.Mode == "merged")
+	if err != nil {
+		respondSendError(c, err)
+		return
+	}
+
+	response := gin.H{"messages": sent}
+	if len(failed) > 0 {
+		response["failed_conversations"] = failed
+	}
+	utils.Success(c, response)
 }
 
-func SendMessage(c *gin.Context) {
+func respondSendError(c *gin.Context, err error) {
+	var validationErr *services.ValidationError
+	switch {
+	case errors.Is(err, services.ErrNotMember):
+		utils.Forbidden(c, err.Error())
+	case errors.As(err, &validationErr):
+		utils.BadRequestWithData(c, validationErr.Error(), validationErr)
+	default:
+		utils.InternalError(c, "failed to send message")
+	}
+}
+
+func EditMessage(c *gin.Context) {
 	userID := middleware.GetUserID(c)
 	convID := c.Param("id")
 
@@ -182,41 +250,325 @@ func SendMessage(c *gin.Context) {
 		return
 	}
 
-	var req SendMessageRequest
+	editMessage(c, convID, c.Param("msg_id"), "user", userID)
+}
+
+func GetMessageEdits(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+	msgID := c.Param("msg_id")
+
+	if !isConversationMember(convID, userID) {
+		utils.Forbidden(c, "not a member of this conversation")
+		return
+	}
+
+	var exists bool
+	err := database.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND conversation_id = ?)",
+		msgID, convID,
+	).Scan(&exists)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+	if !exists {
+		utils.NotFound(c, "message not found")
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, message_id, content, edited_by, created_at
+		FROM message_edits WHERE message_id = ?
+		ORDER BY created_at DESC
+	`, msgID)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+	defer rows.Close()
+
+	var edits []models.MessageEdit
+	for rows.Next() {
+		var edit models.MessageEdit
+		var content []byte
+		if err := rows.Scan(&edit.ID, &edit.MessageID, &content, &edit.EditedBy, &edit.CreatedAt); err != nil {
+			continue
+		}
+		edit.Content = json.RawMessage(content)
+		edits = append(edits, edit)
+	}
+
+	if edits == nil {
+		edits = []models.MessageEdit{}
+	}
+
+	utils.Success(c, edits)
+}
+
+// editMessage 替换消息内容并保存旧版本，仅允许原发送者（用户或 Bot）编辑
+func editMessage(c *gin.Context, convID, msgID, senderType, senderID string) {
+	var req EditMessageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		utils.BadRequest(c, err.Error())
 		return
 	}
 
-	msgID := utils.GenerateUUID()
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var msgSenderID, msgSenderType, msgType string
+	var oldContent []byte
+	var recalled, forwarded bool
+	err = tx.QueryRow(
+		"SELECT sender_id, sender_type, type, content, recalled_at IS NOT NULL, forwarded_message_id IS NOT NULL FROM messages WHERE id = ? AND conversation_id = ? FOR UPDATE",
+		msgID, convID,
+	).Scan(&msgSenderID, &msgSenderType, &msgType, &oldContent, &recalled, &forwarded)
+	if err == sql.ErrNoRows {
+		utils.NotFound(c, "message not found")
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	if msgSenderType != senderType || msgSenderID != senderID {
+		utils.Forbidden(c, "only the sender can edit this message")
+		return
+	}
+
+	if recalled {
+		utils.BadRequest(c, "cannot edit a recalled message")
+		return
+	}
+
+	if forwarded {
+		utils.BadRequest(c, "cannot edit a forwarded message")
+		return
+	}
+
+	if err := services.ValidateContent(convID, msgType, req.Content); err != nil {
+		respondSendError(c, err)
+		return
+	}
+
 	now := time.Now()
 
-	_, err := database.DB.Exec(`
-		INSERT INTO messages (id, conversation_id, sender_id, sender_type, type, content, reply_to_id, created_at, updated_at)
-		VALUES (?, ?, ?, 'user', ?, ?, ?, ?, ?)
-	`, msgID, convID, userID, req.Type, string(req.Content), sql.NullString{String: req.ReplyToID, Valid: req.ReplyToID != ""}, now, now)
+	_, err = tx.Exec(
+		"INSERT INTO message_edits (id, message_id, content, edited_by, created_at) VALUES (?, ?, ?, ?, ?)",
+		utils.GenerateUUID(), msgID, string(oldContent), senderID, now,
+	)
+	if err != nil {
+		utils.InternalError(c, "failed to save edit history")
+		return
+	}
 
+	_, err = tx.Exec(
+		"UPDATE messages SET content = ?, edited_at = ?, updated_at = ? WHERE id = ?",
+		string(req.Content), now, now, msgID,
+	)
 	if err != nil {
-		utils.InternalError(c, "failed to send message")
+		utils.InternalError(c, "failed to edit message")
 		return
 	}
 
-	if req.Type == "text" {
-		var textContent models.TextContent
-		if err := json.Unmarshal(req.Content, &textContent); err == nil && len(textContent.Mentions) > 0 {
-			for _, mentionedUserID := range textContent.Mentions {
-				mentionID := utils.GenerateUUID()
-				database.DB.Exec(
-					"INSERT INTO mentions (id, message_id, user_id, created_at) VALUES (?, ?, ?, ?)",
-					mentionID, msgID, mentionedUserID, now,
-				)
+	// 编辑后 @ 列表可能变化，重建提及记录；只向新增的被提及用户发送 mentioned
+	var addedMentions []string
+	if msgType == "text" {
+		previous, err := mentionedUserIDs(tx, msgID)
+		if err != nil {
+			utils.InternalError(c, "failed to update mentions")
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM mentions WHERE message_id = ?", msgID); err != nil {
+			utils.InternalError(c, "failed to update mentions")
+			return
+		}
+		for _, mentionedUserID := range services.ParseMentions(msgType, req.Content) {
+			_, err := tx.Exec(
+				"INSERT INTO mentions (id, message_id, user_id, created_at) VALUES (?, ?, ?, ?)",
+				utils.GenerateUUID(), msgID, mentionedUserID, now,
+			)
+			if err != nil {
+				utils.InternalError(c, "failed to update mentions")
+				return
+			}
+			if !previous[mentionedUserID] {
+				addedMentions = append(addedMentions, mentionedUserID)
 			}
 		}
 	}
 
-	database.DB.Exec("UPDATE conversations SET updated_at = ? WHERE id = ?", now, convID)
+	if err := tx.Commit(); err != nil {
+		utils.InternalError(c, "failed to commit transaction")
+		return
+	}
+
+	services.RecordChanges(services.Change{ConversationID: convID, Entity: services.EntityMessage, EntityID: msgID, Action: services.ChangeUpsert})
+
+	loaded, err := services.LoadMessages([]string{msgID}, "")
+	if err != nil || loaded[msgID] == nil {
+		utils.InternalError(c, "failed to load message")
+		return
+	}
+	msg := loaded[msgID]
+
+	websocket.BroadcastToConversation(convID, &websocket.Message{
+		Event: "message_edited",
+		Data:  msg,
+	})
+	services.SendMentionEvents(msg, addedMentions)
+
+	utils.Success(c, msg)
+}
+
+// mentionedUserIDs 返回消息当前提及的用户
+func mentionedUserIDs(tx *sql.Tx, msgID string) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT user_id FROM mentions WHERE message_id = ?", msgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+func RecallMessage(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
 
-	utils.Success(c, gin.H{"message_id": msgID})
+	role := getConversationRole(convID, userID)
+	if role == "" {
+		utils.Forbidden(c, "not a member of this conversation")
+		return
+	}
+
+	recallMessage(c, convID, c.Param("msg_id"), "user", userID, role == "owner" || role == "admin")
+}
+
+// recallMessage 将消息替换为撤回占位：保留行以免破坏分页和引用，清空内容、编辑历史、表情和提及记录。
+// 发送者只能在配置的时间窗口内撤回，群主和管理员（moderator）可随时删除任意消息。
+func recallMessage(c *gin.Context, convID, msgID, actorType, actorID string, moderator bool) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var msgSenderID, msgSenderType, convType, threadRootID string
+	var recalledAt sql.NullTime
+	var createdAt time.Time
+	err = tx.QueryRow(`
+		SELECT m.sender_id, m.sender_type, m.recalled_at, m.created_at, COALESCE(m.thread_root_id, ''), c.type
+		FROM messages m
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE m.id = ? AND m.conversation_id = ?
+		FOR UPDATE
+	`, msgID, convID).Scan(&msgSenderID, &msgSenderType, &recalledAt, &createdAt, &threadRootID, &convType)
+	if err == sql.ErrNoRows {
+		utils.NotFound(c, "message not found")
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	if recalledAt.Valid {
+		utils.BadRequest(c, "message already recalled")
+		return
+	}
+
+	now := time.Now()
+	isSender := msgSenderType == actorType && msgSenderID == actorID
+
+	if !(moderator && convType == "group") {
+		if !isSender {
+			utils.Forbidden(c, "only the sender or a group owner/admin can recall this message")
+			return
+		}
+		if now.Sub(createdAt) > config.Cfg.RecallWindow {
+			utils.Forbidden(c, "recall window has expired")
+			return
+		}
+	}
+
+	_, err = tx.Exec(
+		"UPDATE messages SET content = '{}', edited_at = NULL, recalled_at = ?, recalled_by = ?, updated_at = ? WHERE id = ?",
+		now, actorID, now, msgID,
+	)
+	if err != nil {
+		utils.InternalError(c, "failed to recall message")
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM mentions WHERE message_id = ?", msgID); err != nil {
+		utils.InternalError(c, "failed to delete mentions")
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM message_edits WHERE message_id = ?", msgID); err != nil {
+		utils.InternalError(c, "failed to delete edit history")
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM message_reactions WHERE message_id = ?", msgID); err != nil {
+		utils.InternalError(c, "failed to delete reactions")
+		return
+	}
+
+	// 撤回的消息同时取消置顶
+	unpinned, err := tx.Exec("DELETE FROM message_pins WHERE message_id = ?", msgID)
+	if err != nil {
+		utils.InternalError(c, "failed to delete pin")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.InternalError(c, "failed to commit transaction")
+		return
+	}
+
+	changes := []services.Change{{ConversationID: convID, Entity: services.EntityMessage, EntityID: msgID, Action: services.ChangeUpsert}}
+	if threadRootID != "" {
+		// 撤回的回复不再计入根消息的话题回复数
+		changes = append(changes, services.Change{ConversationID: convID, Entity: services.EntityMessage, EntityID: threadRootID, Action: services.ChangeUpsert})
+	}
+	services.RecordChanges(changes...)
+
+	data := gin.H{
+		"id":              msgID,
+		"conversation_id": convID,
+		"recalled_by":     actorID,
+		"recalled_at":     now,
+	}
+	if threadRootID != "" {
+		data["thread_root_id"] = threadRootID
+	}
+
+	websocket.BroadcastToConversation(convID, &websocket.Message{
+		Event: "message_recalled",
+		Data:  data,
+	})
+	if rowsAffected, _ := unpinned.RowsAffected(); rowsAffected > 0 {
+		broadcastUnpinned(convID, msgID, actorID)
+	}
+
+	utils.Success(c, data)
 }
 
 func SearchMessages(c *gin.Context) {
@@ -240,10 +592,10 @@ func SearchMessages(c *gin.Context) {
 	}
 
 	rows, err := database.DB.Query(`
-		SELECT m.id, m.conversation_id, m.sender_id, m.sender_type, m.type, m.content, m.reply_to_id, m.created_at
+		SELECT m.id
 		FROM messages m
-		WHERE m.conversation_id = ? AND m.type = 'text' AND MATCH(content) AGAINST(? IN NATURAL LANGUAGE MODE)
-		ORDER BY m.created_at DESC
+		WHERE m.conversation_id = ? AND m.type = 'text' AND m.recalled_at IS NULL AND MATCH(content) AGAINST(? IN NATURAL LANGUAGE MODE)
+		ORDER BY m.created_at DESC, m.id DESC
 		LIMIT ?
 	`, convID, query, limit)
 
@@ -251,10 +603,10 @@ func SearchMessages(c *gin.Context) {
 		// 转义 LIKE 特殊字符防止意外匹配
 		escapedQuery := "%" + escapeLikePattern(query) + "%"
 		rows, err = database.DB.Query(`
-			SELECT m.id, m.conversation_id, m.sender_id, m.sender_type, m.type, m.content, m.reply_to_id, m.created_at
+			SELECT m.id
 			FROM messages m
-			WHERE m.conversation_id = ? AND m.type = 'text' AND m.content LIKE ? ESCAPE '\\'
-			ORDER BY m.created_at DESC
+			WHERE m.conversation_id = ? AND m.type = 'text' AND m.recalled_at IS NULL AND m.content LIKE ? ESCAPE '\\'
+			ORDER BY m.created_at DESC, m.id DESC
 			LIMIT ?
 		`, convID, escapedQuery, limit)
 		if err != nil {
@@ -264,60 +616,10 @@ func SearchMessages(c *gin.Context) {
 	}
 	defer rows.Close()
 
-	var messages []models.MessageResponse
-	for rows.Next() {
-		var msgID, cID, senderID, senderType, msgType string
-		var contentJSON []byte
-		var replyToID sql.NullString
-		var createdAt time.Time
-
-		if err := rows.Scan(&msgID, &cID, &senderID, &senderType, &msgType, &contentJSON, &replyToID, &createdAt); err != nil {
-			continue
-		}
-
-		resp := models.MessageResponse{
-			ID:             msgID,
-			ConversationID: cID,
-			Type:           msgType,
-			Content:        json.RawMessage(contentJSON),
-			CreatedAt:      createdAt,
-		}
-
-		if replyToID.Valid {
-			resp.ReplyToID = replyToID.String
-		}
-
-		if senderType == "user" {
-			var user models.User
-			database.DB.QueryRow(
-				"SELECT id, username, nickname, avatar FROM users WHERE id = ?",
-				senderID,
-			).Scan(&user.ID, &user.Username, &user.Nickname, &user.Avatar)
-			resp.Sender = models.SenderInfo{
-				ID:       user.ID,
-				Type:     "user",
-				Nickname: user.Nickname,
-				Avatar:   user.Avatar,
-			}
-		} else {
-			var bot models.Bot
-			database.DB.QueryRow(
-				"SELECT id, name, avatar FROM bots WHERE id = ?",
-				senderID,
-			).Scan(&bot.ID, &bot.Name, &bot.Avatar)
-			resp.Sender = models.SenderInfo{
-				ID:       bot.ID,
-				Type:     "bot",
-				Nickname: bot.Name,
-				Avatar:   bot.Avatar,
-			}
-		}
-
-		messages = append(messages, resp)
-	}
-
-	if messages == nil {
-		messages = []models.MessageResponse{}
+	messages, err := collectMessages(rows, userID)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
 	}
 
 	utils.Success(c, messages)
@@ -334,6 +636,11 @@ func StartPrivateChat(c *gin.Context) {
 		return
 	}
 
+	if !isActiveUser(req.UserID) {
+		utils.NotFound(c, "user not found")
+		return
+	}
+
 	convID, err := FindOrCreatePrivateConversation(userID, req.UserID)
 	if err != nil {
 		utils.InternalError(c, "failed to create conversation")
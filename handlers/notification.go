@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"database/sql"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/database"
+	"talkbox/middleware"
+	"talkbox/models"
+	"talkbox/services"
+	"talkbox/utils"
+	"talkbox/websocket"
+)
+
+var clockPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// ConversationNotificationRequest 整体替换当前用户在会话中的通知设置，muted_until 为 null 表示取消静音
+type ConversationNotificationRequest struct {
+	Level      string     `json:"level" binding:"required,oneof=all mentions"`
+	MutedUntil *time.Time `json:"muted_until"`
+}
+
+type conversationNotification struct {
+	ConversationID string     `json:"conversation_id"`
+	Level          string     `json:"level"`
+	MutedUntil     *time.Time `json:"muted_until"`
+}
+
+func UpdateConversationNotification(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+
+	var req ConversationNotificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	result, err := database.DB.Exec(
+		"UPDATE conversation_members SET notify_level = ?, muted_until = ? WHERE conversation_id = ? AND user_id = ?",
+		req.Level, req.MutedUntil, convID, userID,
+	)
+	if err != nil {
+		utils.InternalError(c, "failed to update notification settings")
+		return
+	}
+	// 设置未变化时 RowsAffected 也为 0，需再确认成员身份
+	if affected, _ := result.RowsAffected(); affected == 0 && !isConversationMember(convID, userID) {
+		utils.Forbidden(c, "not a member of this conversation")
+		return
+	}
+
+	// 通知设置只对本人可见，变更只同步给本人
+	services.RecordChanges(services.Change{UserID: userID, ConversationID: convID, Entity: services.EntityConversation, EntityID: convID, Action: services.ChangeUpsert})
+
+	settings := &conversationNotification{
+		ConversationID: convID,
+		Level:          req.Level,
+		MutedUntil:     req.MutedUntil,
+	}
+	websocket.HubInstance.SendToUser(userID, &websocket.Message{
+		Event: "conversation_notification_updated",
+		Data:  settings,
+	})
+
+	utils.Success(c, settings)
+}
+
+func GetNotificationSettings(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	settings, err := loadNotificationSettings(userID)
+	if err == sql.ErrNoRows {
+		utils.NotFound(c, "user not found")
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	utils.Success(c, settings)
+}
+
+func UpdateNotificationSettings(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	var req models.NotificationSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+	if !clockPattern.MatchString(req.DNDStart) || !clockPattern.MatchString(req.DNDEnd) {
+		utils.BadRequest(c, "dnd_start and dnd_end must be in HH:MM format")
+		return
+	}
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			utils.BadRequest(c, "invalid timezone")
+			return
+		}
+	}
+
+	_, err := database.DB.Exec(
+		"UPDATE users SET dnd_enabled = ?, dnd_start = ?, dnd_end = ?, timezone = ?, updated_at = ? WHERE id = ?",
+		req.DNDEnabled, req.DNDStart, req.DNDEnd, req.Timezone, time.Now(), userID,
+	)
+	if err != nil {
+		utils.InternalError(c, "failed to update notification settings")
+		return
+	}
+
+	utils.Success(c, req)
+}
+
+func loadNotificationSettings(userID string) (*models.NotificationSettings, error) {
+	var s models.NotificationSettings
+	err := database.DB.QueryRow(
+		"SELECT dnd_enabled, dnd_start, dnd_end, timezone FROM users WHERE id = ?",
+		userID,
+	).Scan(&s.DNDEnabled, &s.DNDStart, &s.DNDEnd, &s.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
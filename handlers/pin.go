@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/config"
+	"talkbox/database"
+	"talkbox/middleware"
+	"talkbox/models"
+	"talkbox/services"
+	"talkbox/utils"
+	"talkbox/websocket"
+)
+
+func GetPins(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+
+	if !isConversationMember(convID, userID) {
+		utils.Forbidden(c, "not a member of this conversation")
+		return
+	}
+
+	pins, err := loadPins(convID, userID)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	utils.Success(c, pins)
+}
+
+func PinMessage(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+	msgID := c.Param("msg_id")
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+	defer tx.Rollback()
+
+	// 锁住会话行，保证并发置顶时数量上限准确
+	var convType, pinPermission string
+	err = tx.QueryRow(
+		"SELECT type, pin_permission FROM conversations WHERE id = ? FOR UPDATE",
+		convID,
+	).Scan(&convType, &pinPermission)
+	if err == sql.ErrNoRows {
+		utils.NotFound(c, "conversation not found")
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	if !canPin(convType, pinPermission, getConversationRole(convID, userID)) {
+		utils.Forbidden(c, "you are not allowed to pin messages in this conversation")
+		return
+	}
+
+	var recalled bool
+	err = tx.QueryRow(
+		"SELECT recalled_at IS NOT NULL FROM messages WHERE id = ? AND conversation_id = ?",
+		msgID, convID,
+	).Scan(&recalled)
+	if err == sql.ErrNoRows || recalled {
+		utils.NotFound(c, "message not found")
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	var pinnedBy string
+	var pinnedAt time.Time
+	err = tx.QueryRow(
+		"SELECT pinned_by, created_at FROM message_pins WHERE message_id = ?",
+		msgID,
+	).Scan(&pinnedBy, &pinnedAt)
+	if err == nil {
+		// 已置顶时直接返回原记录
+		tx.Rollback()
+		respondPin(c, msgID, userID, pinnedBy, pinnedAt)
+		return
+	}
+	if err != sql.ErrNoRows {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM message_pins WHERE conversation_id = ?", convID).Scan(&count); err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+	if count >= config.Cfg.MaxPins {
+		utils.BadRequest(c, "pinned message limit reached")
+		return
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(
+		"INSERT INTO message_pins (id, conversation_id, message_id, pinned_by, created_at) VALUES (?, ?, ?, ?, ?)",
+		utils.GenerateUUID(), convID, msgID, userID, now,
+	)
+	if err != nil {
+		utils.InternalError(c, "failed to pin message")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		utils.InternalError(c, "failed to commit transaction")
+		return
+	}
+
+	services.RecordChanges(services.Change{ConversationID: convID, Entity: services.EntityMessage, EntityID: msgID, Action: services.ChangeUpsert})
+
+	if respondPin(c, msgID, userID, userID, now) == nil {
+		return
+	}
+
+	// 响应中的表情 reacted 是置顶者视角，广播给所有成员的副本不带查看者
+	loaded, err := services.LoadMessages([]string{msgID}, "")
+	if err != nil {
+		log.Printf("failed to load pinned message %s: %v", msgID, err)
+		return
+	}
+	if msg, ok := loaded[msgID]; ok {
+		websocket.BroadcastToConversation(convID, &websocket.Message{
+			Event: "message_pinned",
+			Data:  &models.PinnedMessage{MessageResponse: *msg, PinnedBy: userID, PinnedAt: now},
+		})
+	}
+}
+
+// respondPin 加载置顶的消息并作为响应返回，加载失败时返回 nil
+func respondPin(c *gin.Context, msgID, viewerID, pinnedBy string, pinnedAt time.Time) *models.PinnedMessage {
+	loaded, err := services.LoadMessages([]string{msgID}, viewerID)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return nil
+	}
+	msg, ok := loaded[msgID]
+	if !ok {
+		utils.NotFound(c, "message not found")
+		return nil
+	}
+
+	pin := &models.PinnedMessage{MessageResponse: *msg, PinnedBy: pinnedBy, PinnedAt: pinnedAt}
+	utils.Success(c, pin)
+	return pin
+}
+
+func UnpinMessage(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+	msgID := c.Param("msg_id")
+
+	var convType, pinPermission string
+	err := database.DB.QueryRow(
+		"SELECT type, pin_permission FROM conversations WHERE id = ?",
+		convID,
+	).Scan(&convType, &pinPermission)
+	if err == sql.ErrNoRows {
+		utils.NotFound(c, "conversation not found")
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	if !canPin(convType, pinPermission, getConversationRole(convID, userID)) {
+		utils.Forbidden(c, "you are not allowed to unpin messages in this conversation")
+		return
+	}
+
+	result, err := database.DB.Exec(
+		"DELETE FROM message_pins WHERE conversation_id = ? AND message_id = ?",
+		convID, msgID,
+	)
+	if err != nil {
+		utils.InternalError(c, "failed to unpin message")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		utils.NotFound(c, "message is not pinned")
+		return
+	}
+
+	services.RecordChanges(services.Change{ConversationID: convID, Entity: services.EntityMessage, EntityID: msgID, Action: services.ChangeUpsert})
+
+	broadcastUnpinned(convID, msgID, userID)
+
+	utils.Success(c, nil)
+}
+
+func broadcastUnpinned(convID, msgID, actorID string) {
+	websocket.BroadcastToConversation(convID, &websocket.Message{
+		Event: "message_unpinned",
+		Data: gin.H{
+			"conversation_id": convID,
+			"message_id":      msgID,
+			"unpinned_by":     actorID,
+		},
+	})
+}
+
+// canPin 私聊双方都可以置顶；群聊按会话的 pin_permission 判断，role 为空表示不是成员
+func canPin(convType, pinPermission, role string) bool {
+	switch {
+	case role == "":
+		return false
+	case convType == "private", pinPermission == "members":
+		return true
+	default:
+		return role == "owner" || role == "admin"
+	}
+}
+
+// loadPins 按置顶时间倒序返回会话的置顶消息
+func loadPins(convID, viewerID string) ([]models.PinnedMessage, error) {
+	rows, err := database.DB.Query(
+		"SELECT message_id, pinned_by, created_at FROM message_pins WHERE conversation_id = ? ORDER BY created_at DESC",
+		convID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pins []models.PinnedMessage
+	var ids []string
+	for rows.Next() {
+		var pin models.PinnedMessage
+		if err := rows.Scan(&pin.ID, &pin.PinnedBy, &pin.PinnedAt); err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+		ids = append(ids, pin.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	loaded, err := services.LoadMessages(ids, viewerID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]models.PinnedMessage, 0, len(pins))
+	for _, pin := range pins {
+		if msg, ok := loaded[pin.ID]; ok {
+			pin.MessageResponse = *msg
+			result = append(result, pin)
+		}
+	}
+	return result, nil
+}
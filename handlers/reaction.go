@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/database"
+	"talkbox/middleware"
+	"talkbox/models"
+	"talkbox/services"
+	"talkbox/utils"
+	"talkbox/websocket"
+)
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji" binding:"required,max=32"`
+}
+
+func AddReaction(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+	msgID := c.Param("msg_id")
+
+	if !isConversationMember(convID, userID) {
+		utils.Forbidden(c, "not a member of this conversation")
+		return
+	}
+
+	var req ReactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	emoji := strings.TrimSpace(req.Emoji)
+	if !utils.IsEmoji(emoji) {
+		utils.BadRequest(c, "emoji must be a single emoji")
+		return
+	}
+
+	if !checkReactableMessage(c, convID, msgID) {
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		INSERT INTO message_reactions (id, message_id, user_id, emoji, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE id = id
+	`, utils.GenerateUUID(), msgID, userID, emoji, time.Now())
+	if err != nil {
+		utils.InternalError(c, "failed to add reaction")
+		return
+	}
+
+	// 重复点同一个表情不再广播
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 1 {
+		services.RecordChanges(services.Change{ConversationID: convID, Entity: services.EntityMessage, EntityID: msgID, Action: services.ChangeUpsert})
+		websocket.BroadcastToConversation(convID, &websocket.Message{
+			Event: "reaction_added",
+			Data: gin.H{
+				"message_id":      msgID,
+				"conversation_id": convID,
+				"user_id":         userID,
+				"emoji":           emoji,
+			},
+		})
+	}
+
+	respondReactions(c, msgID, userID)
+}
+
+func RemoveReaction(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+	msgID := c.Param("msg_id")
+	// 与 AddReaction 相同的规范化，保证能匹配到保存时的值
+	emoji := strings.TrimSpace(c.Param("emoji"))
+	if !utils.IsEmoji(emoji) {
+		utils.BadRequest(c, "emoji must be a single emoji")
+		return
+	}
+
+	if !isConversationMember(convID, userID) {
+		utils.Forbidden(c, "not a member of this conversation")
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		DELETE r FROM message_reactions r
+		JOIN messages m ON m.id = r.message_id
+		WHERE r.message_id = ? AND r.user_id = ? AND r.emoji = ? AND m.conversation_id = ?
+	`, msgID, userID, emoji, convID)
+	if err != nil {
+		utils.InternalError(c, "failed to remove reaction")
+		return
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		services.RecordChanges(services.Change{ConversationID: convID, Entity: services.EntityMessage, EntityID: msgID, Action: services.ChangeUpsert})
+		websocket.BroadcastToConversation(convID, &websocket.Message{
+			Event: "reaction_removed",
+			Data: gin.H{
+				"message_id":      msgID,
+				"conversation_id": convID,
+				"user_id":         userID,
+				"emoji":           emoji,
+			},
+		})
+	}
+
+	respondReactions(c, msgID, userID)
+}
+
+// checkReactableMessage 确认消息属于该会话且未被撤回，失败时已写入响应
+func checkReactableMessage(c *gin.Context, convID, msgID string) bool {
+	var recalled bool
+	err := database.DB.QueryRow(
+		"SELECT recalled_at IS NOT NULL FROM messages WHERE id = ? AND conversation_id = ?",
+		msgID, convID,
+	).Scan(&recalled)
+	if err == sql.ErrNoRows {
+		utils.NotFound(c, "message not found")
+		return false
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return false
+	}
+	if recalled {
+		utils.BadRequest(c, "cannot react to a recalled message")
+		return false
+	}
+	return true
+}
+
+func respondReactions(c *gin.Context, msgID, userID string) {
+	reactions, err := services.LoadReactions([]string{msgID}, userID)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	summaries := reactions[msgID]
+	if summaries == nil {
+		summaries = []models.ReactionSummary{}
+	}
+
+	utils.Success(c, gin.H{"message_id": msgID, "reactions": summaries})
+}
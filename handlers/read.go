@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/database"
+	"talkbox/middleware"
+	"talkbox/services"
+	"talkbox/utils"
+	"talkbox/websocket"
+)
+
+// 成员数不超过该值的群聊才广播已读回执，大群只同步给本人的其他设备
+const readReceiptMaxMembers = 20
+
+var (
+	errNotMember       = errors.New("not a member of this conversation")
+	errMessageNotFound = errors.New("message not found")
+)
+
+type MarkReadRequest struct {
+	MessageID string `json:"message_id"`
+}
+
+type readState struct {
+	ConversationID string    `json:"conversation_id"`
+	UserID         string    `json:"user_id"`
+	MessageID      string    `json:"message_id"`
+	ReadAt         time.Time `json:"read_at"`
+}
+
+func MarkConversationRead(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+
+	var req MarkReadRequest
+	// 请求体可省略，省略时标记到最新一条消息
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.BadRequest(c, err.Error())
+			return
+		}
+	}
+
+	state, err := markRead(convID, userID, req.MessageID)
+	switch {
+	case errors.Is(err, errNotMember):
+		utils.Forbidden(c, err.Error())
+		return
+	case errors.Is(err, errMessageNotFound):
+		utils.NotFound(c, err.Error())
+		return
+	case err != nil:
+		utils.InternalError(c, "failed to mark conversation as read")
+		return
+	}
+
+	utils.Success(c, state)
+}
+
+// HandleReadAction 处理 WebSocket 的 read 动作
+func HandleReadAction(c *websocket.Client, msg *websocket.ClientMessage) {
+	state, err := markRead(msg.ConversationID, c.UserID, msg.MessageID)
+	switch {
+	case errors.Is(err, errNotMember):
+		c.Error(msg, websocket.ErrCodeNotMember, err.Error(), nil)
+	case errors.Is(err, errMessageNotFound):
+		c.Error(msg, websocket.ErrCodeInvalidPayload, err.Error(), nil)
+	case err != nil:
+		c.Error(msg, websocket.ErrCodeInternal, "failed to mark conversation as read", nil)
+	default:
+		c.Ack(msg, state)
+	}
+}
+
+// markRead 将成员的已读位置推进到指定消息（为空时为最新消息），已读位置只前进不后退。
+// 已读位置按 (created_at, id) 比较，同一秒内的消息也能区分先后。
+// 推进成功后广播 read_receipt；会话中没有消息时返回 nil。
+func markRead(convID, userID, msgID string) (*readState, error) {
+	var convType string
+	err := database.DB.QueryRow(`
+		SELECT c.type FROM conversations c
+		JOIN conversation_members m ON m.conversation_id = c.id
+		WHERE c.id = ? AND m.user_id = ?
+	`, convID, userID).Scan(&convType)
+	if err == sql.ErrNoRows {
+		return nil, errNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var readAt time.Time
+	if msgID != "" {
+		err = database.DB.QueryRow(
+			"SELECT created_at FROM messages WHERE id = ? AND conversation_id = ? AND thread_root_id IS NULL",
+			msgID, convID,
+		).Scan(&readAt)
+		if err == sql.ErrNoRows {
+			return nil, errMessageNotFound
+		}
+	} else {
+		err = database.DB.QueryRow(
+			"SELECT id, created_at FROM messages WHERE conversation_id = ? AND thread_root_id IS NULL ORDER BY created_at DESC, id DESC LIMIT 1",
+			convID,
+		).Scan(&msgID, &readAt)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE conversation_members SET last_read_message_id = ?, last_read_at = ?
+		WHERE conversation_id = ? AND user_id = ?
+			AND (last_read_at IS NULL OR last_read_at < ?
+				OR (last_read_at = ? AND COALESCE(last_read_message_id, '') <= ?))
+	`, msgID, readAt, convID, userID, readAt, readAt, msgID)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &readState{
+		ConversationID: convID,
+		UserID:         userID,
+		MessageID:      msgID,
+		ReadAt:         readAt,
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return state, nil
+	}
+
+	services.RecordChanges(services.Change{UserID: userID, ConversationID: convID, Entity: services.EntityReadState, EntityID: convID, Action: services.ChangeUpsert})
+
+	event := &websocket.Message{Event: "read_receipt", Data: state}
+
+	var memberCount int
+	database.DB.QueryRow(
+		"SELECT COUNT(*) FROM conversation_members WHERE conversation_id = ?",
+		convID,
+	).Scan(&memberCount)
+
+	if convType == "private" || memberCount <= readReceiptMaxMembers {
+		websocket.BroadcastToConversation(convID, event)
+	} else {
+		websocket.HubInstance.SendToUser(userID, event)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/middleware"
+	"talkbox/services"
+	"talkbox/utils"
+)
+
+type ScheduleMessageRequest struct {
+	Type         string          `json:"type" binding:"required,oneof=text image video file card"`
+	Content      json.RawMessage `json:"content" binding:"required"`
+	ReplyToID    string          `json:"reply_to_id"`
+	ThreadRootID string          `json:"thread_root_id"`
+	SendAt       time.Time       `json:"send_at" binding:"required"`
+}
+
+// UpdateScheduledMessageRequest 省略的字段保持不变，修改 type 时需同时提供 content
+type UpdateScheduledMessageRequest struct {
+	Type    string          `json:"type" binding:"omitempty,oneof=text image video file card"`
+	Content json.RawMessage `json:"content"`
+	SendAt  *time.Time      `json:"send_at"`
+}
+
+func ScheduleMessage(c *gin.Context) {
+	scheduleMessage(c, c.Param("id"), "user", middleware.GetUserID(c))
+}
+
+func BotScheduleMessage(c *gin.Context) {
+	scheduleMessage(c, c.Param("conversation_id"), "bot", middleware.GetBotID(c))
+}
+
+func scheduleMessage(c *gin.Context, convID, senderType, senderID string) {
+	var req ScheduleMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	s, err := services.ScheduleMessage(&services.ScheduleInput{
+		ConversationID: convID,
+		SenderID:       senderID,
+		SenderType:     senderType,
+		Type:           req.Type,
+		Content:        req.Content,
+		ReplyToID:      req.ReplyToID,
+		ThreadRootID:   req.ThreadRootID,
+		SendAt:         req.SendAt,
+	})
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	utils.Success(c, s)
+}
+
+func GetScheduledMessages(c *gin.Context) {
+	getScheduledMessages(c, "user", middleware.GetUserID(c))
+}
+
+func BotGetScheduledMessages(c *gin.Context) {
+	getScheduledMessages(c, "bot", middleware.GetBotID(c))
+}
+
+func getScheduledMessages(c *gin.Context, senderType, senderID string) {
+	list, err := services.ListScheduledMessages(senderType, senderID, c.Query("conversation_id"))
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	utils.Success(c, list)
+}
+
+func UpdateScheduledMessage(c *gin.Context) {
+	updateScheduledMessage(c, "user", middleware.GetUserID(c))
+}
+
+func BotUpdateScheduledMessage(c *gin.Context) {
+	updateScheduledMessage(c, "bot", middleware.GetBotID(c))
+}
+
+func updateScheduledMessage(c *gin.Context, senderType, senderID string) {
+	var req UpdateScheduledMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+	if req.Type != "" && req.Content == nil {
+		utils.BadRequest(c, "content is required when changing type")
+		return
+	}
+
+	s, err := services.UpdateScheduledMessage(c.Param("id"), senderType, senderID, &services.ScheduleUpdate{
+		Type:    req.Type,
+		Content: req.Content,
+		SendAt:  req.SendAt,
+	})
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	utils.Success(c, s)
+}
+
+func CancelScheduledMessage(c *gin.Context) {
+	cancelScheduledMessage(c, "user", middleware.GetUserID(c))
+}
+
+func BotCancelScheduledMessage(c *gin.Context) {
+	cancelScheduledMessage(c, "bot", middleware.GetBotID(c))
+}
+
+func cancelScheduledMessage(c *gin.Context, senderType, senderID string) {
+	s, err := services.CancelScheduledMessage(c.Param("id"), senderType, senderID)
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	utils.Success(c, s)
+}
+
+func respondScheduleError(c *gin.Context, err error) {
+	var validationErr *services.ValidationError
+	switch {
+	case errors.Is(err, services.ErrNotMember):
+		utils.Forbidden(c, err.Error())
+	case errors.As(err, &validationErr):
+		utils.BadRequestWithData(c, validationErr.Error(), validationErr)
+	case errors.Is(err, services.ErrScheduleNotFound):
+		utils.NotFound(c, err.Error())
+	case errors.Is(err, services.ErrScheduleNotPending):
+		utils.BadRequest(c, err.Error())
+	default:
+		utils.InternalError(c, "failed to save scheduled message")
+	}
+}
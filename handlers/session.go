@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/middleware"
+	"talkbox/services"
+	"talkbox/utils"
+)
+
+// GetSessions 返回当前用户所有有效的登录会话
+func GetSessions(c *gin.Context) {
+	sessions, err := services.ListSessions(middleware.GetUserID(c), middleware.GetSessionID(c))
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	utils.Success(c, sessions)
+}
+
+// RevokeSession 撤销指定会话，该设备立即下线并不再收到推送。撤销当前会话等同于登出
+func RevokeSession(c *gin.Context) {
+	err := services.RevokeSession(middleware.GetUserID(c), c.Param("session_id"))
+	if errors.Is(err, services.ErrSessionNotFound) {
+		utils.NotFound(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "failed to revoke session")
+		return
+	}
+
+	utils.Success(c, nil)
+}
+
+// RevokeOtherSessions 撤销当前会话以外的所有会话
+func RevokeOtherSessions(c *gin.Context) {
+	revoked, err := services.RevokeOtherSessions(middleware.GetUserID(c), middleware.GetSessionID(c))
+	if err != nil {
+		utils.InternalError(c, "failed to revoke sessions")
+		return
+	}
+
+	utils.Success(c, gin.H{"revoked": revoked})
+}
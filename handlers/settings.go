@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/middleware"
+	"talkbox/services"
+	"talkbox/utils"
+)
+
+// UpdateSettingsRequest 只修改提供的字段
+type UpdateSettingsRequest struct {
+	RequireTwoFactor *bool `json:"require_two_factor"`
+}
+
+func GetSettings(c *gin.Context) {
+	settings, err := services.GetSettings()
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	utils.Success(c, settings)
+}
+
+// UpdateSettings 修改全局设置。开启两步验证要求后，未启用的用户下次登录或刷新令牌时需要完成绑定
+func UpdateSettings(c *gin.Context) {
+	adminID := middleware.GetUserID(c)
+
+	var req UpdateSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	if req.RequireTwoFactor != nil {
+		if err := services.SetRequireTwoFactor(*req.RequireTwoFactor, adminID); err != nil {
+			utils.InternalError(c, "failed to update settings")
+			return
+		}
+		services.RecordAudit(adminID, services.AuditRequireTwoFactor, c.ClientIP(), "require_two_factor="+strconv.FormatBool(*req.RequireTwoFactor))
+	}
+
+	settings, err := services.GetSettings()
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	utils.Success(c, settings)
+}
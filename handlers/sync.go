@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/database"
+	"talkbox/middleware"
+	"talkbox/models"
+	"talkbox/services"
+	"talkbox/utils"
+)
+
+const (
+	syncDefaultLimit = 500
+	syncMaxLimit     = 1000
+)
+
+type syncKey struct {
+	entity         string
+	conversationID string
+	entityID       string
+}
+
+// Sync 返回游标之后调用者可见的所有变更。未提供游标或游标已过期时返回 reset，
+// 客户端需先通过会话和消息接口全量拉取，再用返回的 cursor 继续增量同步
+func Sync(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	limit := syncDefaultLimit
+	if l := c.Query("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed <= 0 {
+			utils.BadRequest(c, "invalid limit")
+			return
+		}
+		limit = min(parsed, syncMaxLimit)
+	}
+
+	resp := models.SyncResponse{
+		Conversations:        []models.ConversationResponse{},
+		DeletedConversations: []string{},
+		Members:              []models.SyncMember{},
+		RemovedMembers:       []models.SyncMemberRef{},
+		Bots:                 []models.SyncBot{},
+		RemovedBots:          []models.SyncBotRef{},
+		Messages:             []models.MessageResponse{},
+		ReadStates:           []models.SyncReadState{},
+	}
+
+	raw := c.Query("cursor")
+	var cursor services.SyncCursor
+	if raw != "" {
+		var err error
+		cursor, err = services.DecodeSyncCursor(raw)
+		if err != nil {
+			utils.BadRequest(c, err.Error())
+			return
+		}
+	}
+
+	if raw == "" || cursor.Expired(time.Now()) {
+		latest, err := services.LatestSyncCursor()
+		if err != nil {
+			utils.InternalError(c, "database error")
+			return
+		}
+		resp.Reset = true
+		resp.Cursor = latest.Encode()
+		utils.Success(c, resp)
+		return
+	}
+
+	changes, next, hasMore, err := services.ListChanges(userID, cursor, limit)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+	resp.Cursor = next.Encode()
+	resp.HasMore = hasMore
+
+	// 同一实体只保留最后一次变更
+	var order []syncKey
+	latest := make(map[syncKey]string)
+	for _, ch := range changes {
+		key := syncKey{entity: ch.Entity, conversationID: ch.ConversationID, entityID: ch.EntityID}
+		if _, ok := latest[key]; !ok {
+			order = append(order, key)
+		}
+		latest[key] = ch.Action
+	}
+
+	var convIDs, messageIDs, readConvIDs []string
+	memberKeys := make(map[syncKey]bool)
+	botKeys := make(map[syncKey]bool)
+	for _, key := range order {
+		action := latest[key]
+		switch key.entity {
+		case services.EntityConversation:
+			if action == services.ChangeDelete {
+				resp.DeletedConversations = append(resp.DeletedConversations, key.conversationID)
+			} else {
+				convIDs = append(convIDs, key.conversationID)
+			}
+		case services.EntityMember:
+			if action == services.ChangeDelete {
+				resp.RemovedMembers = append(resp.RemovedMembers, models.SyncMemberRef{ConversationID: key.conversationID, UserID: key.entityID})
+			} else {
+				memberKeys[key] = true
+			}
+		case services.EntityBot:
+			if action == services.ChangeDelete {
+				resp.RemovedBots = append(resp.RemovedBots, models.SyncBotRef{ConversationID: key.conversationID, BotID: key.entityID})
+			} else {
+				botKeys[key] = true
+			}
+		case services.EntityMessage:
+			messageIDs = append(messageIDs, key.entityID)
+		case services.EntityReadState:
+			readConvIDs = append(readConvIDs, key.conversationID)
+		}
+	}
+
+	if err := fillSync(&resp, userID, convIDs, messageIDs, readConvIDs, memberKeys, botKeys); err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	utils.Success(c, resp)
+}
+
+// fillSync 按变更加载各实体的当前状态，已不存在的实体会被跳过
+func fillSync(resp *models.SyncResponse, userID string, convIDs, messageIDs, readConvIDs []string,
+	memberKeys, botKeys map[syncKey]bool) error {
+	conversations, err := loadConversations(userID, convIDs)
+	if err != nil {
+		return err
+	}
+	resp.Conversations = append(resp.Conversations, conversations...)
+
+	if len(messageIDs) > 0 {
+		messages, err := services.LoadMessages(messageIDs, userID)
+		if err != nil {
+			return err
+		}
+		for _, id := range messageIDs {
+			if msg, ok := messages[id]; ok {
+				resp.Messages = append(resp.Messages, *msg)
+			}
+		}
+	}
+
+	if err := loadSyncMembers(resp, userID, memberKeys); err != nil {
+		return err
+	}
+	if err := loadSyncBots(resp, botKeys); err != nil {
+		return err
+	}
+	return loadSyncReadStates(resp, userID, readConvIDs)
+}
+
+func syncConversationIDs(keys map[syncKey]bool) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for key := range keys {
+		if !seen[key.conversationID] {
+			seen[key.conversationID] = true
+			ids = append(ids, key.conversationID)
+		}
+	}
+	return ids
+}
+
+func loadSyncMembers(resp *models.SyncResponse, viewerID string, keys map[syncKey]bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	placeholders, args := services.InClause(syncConversationIDs(keys))
+	rows, err := database.DB.Query(`
+		SELECT m.conversation_id, m.id, m.user_id, m.role, COALESCE(m.nickname, ''), COALESCE(m.last_read_message_id, ''), m.last_read_at,
+			u.username, COALESCE(u.nickname, ''), COALESCE(u.avatar, ''), u.status, u.last_seen_at
+		FROM conversation_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.conversation_id IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m models.SyncMember
+		var user models.User
+		var lastReadAt, lastSeenAt sql.NullTime
+		var status string
+		if err := rows.Scan(&m.ConversationID, &m.ID, &m.UserID, &m.Role, &m.Nickname, &m.LastReadMessageID, &lastReadAt,
+			&user.Username, &user.Nickname, &user.Avatar, &status, &lastSeenAt); err != nil {
+			return err
+		}
+		if !keys[syncKey{entity: services.EntityMember, conversationID: m.ConversationID, entityID: m.UserID}] {
+			continue
+		}
+		if lastReadAt.Valid {
+			m.LastReadAt = &lastReadAt.Time
+		}
+		user.ID = m.UserID
+		applyPresence(&user, status, lastSeenAt, viewerID)
+		m.User = *user.ToResponse()
+		resp.Members = append(resp.Members, m)
+	}
+	return rows.Err()
+}
+
+func loadSyncBots(resp *models.SyncResponse, keys map[syncKey]bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	placeholders, args := services.InClause(syncConversationIDs(keys))
+	rows, err := database.DB.Query(`
+		SELECT bc.conversation_id, b.id, b.name, COALESCE(b.avatar, ''), COALESCE(b.description, ''), b.created_at
+		FROM bots b
+		JOIN bot_conversations bc ON b.id = bc.bot_id
+		WHERE bc.conversation_id IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bot models.SyncBot
+		if err := rows.Scan(&bot.ConversationID, &bot.ID, &bot.Name, &bot.Avatar, &bot.Description, &bot.CreatedAt); err != nil {
+			return err
+		}
+		if keys[syncKey{entity: services.EntityBot, conversationID: bot.ConversationID, entityID: bot.ID}] {
+			resp.Bots = append(resp.Bots, bot)
+		}
+	}
+	return rows.Err()
+}
+
+func loadSyncReadStates(resp *models.SyncResponse, userID string, convIDs []string) error {
+	if len(convIDs) == 0 {
+		return nil
+	}
+
+	placeholders, idArgs := services.InClause(convIDs)
+	args := append([]interface{}{userID}, idArgs...)
+	rows, err := database.DB.Query(`
+		SELECT conversation_id, COALESCE(last_read_message_id, ''), last_read_at
+		FROM conversation_members
+		WHERE user_id = ? AND conversation_id IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var state models.SyncReadState
+		var lastReadAt sql.NullTime
+		if err := rows.Scan(&state.ConversationID, &state.LastReadMessageID, &lastReadAt); err != nil {
+			return err
+		}
+		if lastReadAt.Valid {
+			state.LastReadAt = &lastReadAt.Time
+		}
+		resp.ReadStates = append(resp.ReadStates, state)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/database"
+	"talkbox/middleware"
+	"talkbox/models"
+	"talkbox/services"
+	"talkbox/utils"
+	"talkbox/websocket"
+)
+
+// GetThread 返回话题根消息和按时间倒序分页的回复，分页参数与会话消息列表相同
+func GetThread(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+	rootID := c.Param("msg_id")
+
+	if !isConversationMember(convID, userID) {
+		utils.Forbidden(c, "not a member of this conversation")
+		return
+	}
+
+	if !isThreadRoot(convID, rootID) {
+		utils.NotFound(c, "message not found")
+		return
+	}
+
+	req, ok := bindMessagePage(c)
+	if !ok {
+		return
+	}
+
+	replies, info, err := services.ListThreadReplies(rootID, userID, req)
+	if errors.Is(err, services.ErrMessageNotFound) {
+		utils.NotFound(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	loaded, err := services.LoadMessages([]string{rootID}, userID)
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	utils.Success(c, models.ThreadPage{Root: loaded[rootID], Replies: replies, PageInfo: info})
+}
+
+// MarkThreadRead 将当前用户的话题已读位置推进到最新回复，只对话题参与者生效。
+// 已读位置记录最新回复的 (created_at, id)，只前进不后退；话题中没有回复时不做修改
+func MarkThreadRead(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	convID := c.Param("id")
+	rootID := c.Param("msg_id")
+
+	if !isConversationMember(convID, userID) {
+		utils.Forbidden(c, "not a member of this conversation")
+		return
+	}
+
+	var msgID string
+	var readAt time.Time
+	err := database.DB.QueryRow(
+		"SELECT id, created_at FROM messages WHERE thread_root_id = ? AND conversation_id = ? ORDER BY created_at DESC, id DESC LIMIT 1",
+		rootID, convID,
+	).Scan(&msgID, &readAt)
+	if err == sql.ErrNoRows {
+		utils.Success(c, gin.H{"conversation_id": convID, "thread_root_id": rootID})
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "failed to mark thread as read")
+		return
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE thread_participants SET last_read_message_id = ?, last_read_at = ?
+		WHERE thread_root_id = ? AND conversation_id = ? AND user_id = ?
+			AND (last_read_at IS NULL OR last_read_at < ?
+				OR (last_read_at = ? AND COALESCE(last_read_message_id, '') < ?))
+	`, msgID, readAt, rootID, convID, userID, readAt, readAt, msgID)
+	if err != nil {
+		utils.InternalError(c, "failed to mark thread as read")
+		return
+	}
+
+	state := gin.H{
+		"conversation_id": convID,
+		"thread_root_id":  rootID,
+		"message_id":      msgID,
+		"read_at":         readAt,
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		// 根消息上的话题未读数只对本人可见，变更只同步给本人
+		services.RecordChanges(services.Change{UserID: userID, ConversationID: convID, Entity: services.EntityMessage, EntityID: rootID, Action: services.ChangeUpsert})
+		websocket.HubInstance.SendToUser(userID, &websocket.Message{Event: "thread_read", Data: state})
+	}
+
+	utils.Success(c, state)
+}
+
+// isThreadRoot 判断消息是否属于会话且本身不是话题内的回复
+func isThreadRoot(convID, msgID string) bool {
+	var exists bool
+	database.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND conversation_id = ? AND thread_root_id IS NULL)",
+		msgID, convID,
+	).Scan(&exists)
+	return exists
+}
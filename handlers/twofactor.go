@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/database"
+	"talkbox/middleware"
+	"talkbox/models"
+	"talkbox/services"
+	"talkbox/utils"
+)
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"` // 6 位 TOTP 验证码或恢复码
+}
+
+type SetupTwoFactorRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type ChallengeRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+}
+
+type ChallengeCodeRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+func GetTwoFactorStatus(c *gin.Context) {
+	status, err := services.GetTwoFactorStatus(middleware.GetUserID(c))
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	utils.Success(c, status)
+}
+
+// SetupTwoFactor 校验当前密码后生成 TOTP 密钥，用验证码调用 EnableTwoFactor 后才生效。
+// 与关闭一样需要密码，只持有访问令牌的人不能绑定自己的验证器把用户锁在外面
+func SetupTwoFactor(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	var req SetupTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	username, ok := checkAccountAttempts(c, userID)
+	if !ok {
+		return
+	}
+	err := services.VerifyPassword(userID, req.Password)
+	if errors.Is(err, services.ErrWrongPassword) {
+		if !recordAccountFailure(c, username, userID) {
+			utils.Forbidden(c, err.Error())
+		}
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+
+	setup, err := services.BeginTwoFactorSetup(userID)
+	if !respondTwoFactorError(c, err) {
+		return
+	}
+
+	utils.Success(c, setup)
+}
+
+// EnableTwoFactor 校验验证器应用生成的验证码并启用两步验证，返回恢复码。验证码错误按用户名计入失败次数
+func EnableTwoFactor(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	username, ok := checkAccountAttempts(c, userID)
+	if !ok {
+		return
+	}
+	codes, err := services.EnableTwoFactor(userID, req.Code)
+	if errors.Is(err, services.ErrInvalidTwoFactorCode) {
+		if !recordAccountFailure(c, username, userID) {
+			utils.BadRequest(c, err.Error())
+		}
+		return
+	}
+	if !respondTwoFactorError(c, err) {
+		return
+	}
+	services.RecordAudit(userID, services.AuditTwoFactorEnabled, c.ClientIP(), "")
+
+	utils.Success(c, gin.H{"recovery_codes": codes})
+}
+
+// DisableTwoFactor 关闭两步验证，需要密码和验证码。管理员要求启用时不能关闭。
+// 密码和验证码错误与登录失败一样按用户名计数，避免用已登录的令牌暴力猜测
+func DisableTwoFactor(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	var req DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	required, err := services.TwoFactorRequired()
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+	if required {
+		utils.Forbidden(c, "two-factor authentication is required by the administrator")
+		return
+	}
+
+	username, ok := checkAccountAttempts(c, userID)
+	if !ok {
+		return
+	}
+	err = services.VerifyPassword(userID, req.Password)
+	if errors.Is(err, services.ErrWrongPassword) {
+		if !recordAccountFailure(c, username, userID) {
+			utils.Forbidden(c, err.Error())
+		}
+		return
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return
+	}
+	if !verifyAccountTwoFactorCode(c, username, userID, req.Code) {
+		return
+	}
+
+	if err := services.DisableTwoFactor(userID); err != nil {
+		utils.InternalError(c, "failed to disable two-factor authentication")
+		return
+	}
+	services.RecordAudit(userID, services.AuditTwoFactorDisabled, c.ClientIP(), "")
+
+	utils.Success(c, nil)
+}
+
+// RegenerateRecoveryCodes 用验证码换取一组新的恢复码，旧的恢复码全部作废。验证码错误按用户名计入失败次数
+func RegenerateRecoveryCodes(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	username, ok := checkAccountAttempts(c, userID)
+	if !ok {
+		return
+	}
+	if !verifyAccountTwoFactorCode(c, username, userID, req.Code) {
+		return
+	}
+	codes, err := services.RegenerateRecoveryCodes(userID)
+	if !respondTwoFactorError(c, err) {
+		return
+	}
+
+	utils.Success(c, gin.H{"recovery_codes": codes})
+}
+
+// VerifyLoginChallenge 用登录返回的挑战令牌和验证码完成登录。验证码错误与密码错误一样计入登录失败次数
+func VerifyLoginChallenge(c *gin.Context) {
+	var req ChallengeCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	claims, user, ok := loadChallenge(c, req.ChallengeToken)
+	if !ok {
+		return
+	}
+	if claims.Enroll {
+		utils.BadRequest(c, "two-factor enrollment required")
+		return
+	}
+
+	ip := c.ClientIP()
+	if wait := services.CheckLogin(user.Username, ip); wait > 0 {
+		utils.TooManyRequests(c, "too many failed login attempts, try again later", wait)
+		return
+	}
+
+	usedRecovery, err := services.VerifyTwoFactorCode(user.ID, req.Code)
+	if errors.Is(err, services.ErrInvalidTwoFactorCode) {
+		if wait := services.RecordLoginFailure(user.Username, ip, user.ID); wait > 0 {
+			utils.TooManyRequests(c, "too many failed login attempts, try again later", wait)
+			return
+		}
+		utils.Unauthorized(c, err.Error())
+		return
+	}
+	if !respondTwoFactorError(c, err) {
+		return
+	}
+	services.RecordLoginSuccess(user.Username)
+	if usedRecovery {
+		services.RecordAudit(user.ID, services.AuditRecoveryCodeUsed, ip, "")
+	}
+
+	completeLogin(c, user, sessionDevice(c, DeviceInfo{DeviceName: claims.DeviceName, Platform: claims.Platform}), nil)
+}
+
+// SetupTwoFactorWithChallenge 在管理员要求两步验证而用户尚未启用时，用挑战令牌生成 TOTP 密钥
+func SetupTwoFactorWithChallenge(c *gin.Context) {
+	var req ChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	_, user, ok := loadEnrollChallenge(c, req.ChallengeToken)
+	if !ok {
+		return
+	}
+
+	setup, err := services.BeginTwoFactorSetup(user.ID)
+	if !respondTwoFactorError(c, err) {
+		return
+	}
+
+	utils.Success(c, setup)
+}
+
+// EnableTwoFactorWithChallenge 用挑战令牌完成绑定并登录，返回令牌和恢复码
+func EnableTwoFactorWithChallenge(c *gin.Context) {
+	var req ChallengeCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	claims, user, ok := loadEnrollChallenge(c, req.ChallengeToken)
+	if !ok {
+		return
+	}
+
+	codes, err := services.EnableTwoFactor(user.ID, req.Code)
+	if !respondTwoFactorError(c, err) {
+		return
+	}
+	services.RecordAudit(user.ID, services.AuditTwoFactorEnabled, c.ClientIP(), "")
+	services.RecordLoginSuccess(user.Username)
+
+	completeLogin(c, user, sessionDevice(c, DeviceInfo{DeviceName: claims.DeviceName, Platform: claims.Platform}), codes)
+}
+
+// ResetUserTwoFactor 由管理员为丢失验证器和恢复码的用户关闭两步验证
+func ResetUserTwoFactor(c *gin.Context) {
+	userID := c.Param("id")
+	if !isActiveUser(userID) {
+		utils.NotFound(c, "user not found")
+		return
+	}
+
+	if err := services.DisableTwoFactor(userID); err != nil {
+		utils.InternalError(c, "failed to reset two-factor authentication")
+		return
+	}
+	services.RecordAudit(userID, services.AuditTwoFactorReset, c.ClientIP(), "by admin "+middleware.GetUserID(c))
+
+	utils.Success(c, nil)
+}
+
+// loadChallenge 校验挑战令牌并加载对应的用户，失败时已写入响应
+func loadChallenge(c *gin.Context, token string) (*utils.ChallengeClaims, *models.User, bool) {
+	claims, err := services.ParseLoginChallenge(token)
+	if err != nil {
+		utils.Unauthorized(c, err.Error())
+		return nil, nil, false
+	}
+
+	var user models.User
+	var avatar sql.NullString
+	err = database.DB.QueryRow(
+		"SELECT id, username, nickname, avatar FROM users WHERE id = ? AND deleted_at IS NULL",
+		claims.UserID,
+	).Scan(&user.ID, &user.Username, &user.Nickname, &avatar)
+	if err == sql.ErrNoRows {
+		utils.Unauthorized(c, services.ErrInvalidChallenge.Error())
+		return nil, nil, false
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return nil, nil, false
+	}
+	if avatar.Valid {
+		user.Avatar = avatar.String
+	}
+	return claims, &user, true
+}
+
+// loadEnrollChallenge 与 loadChallenge 相同，但只接受需要绑定两步验证的挑战令牌
+func loadEnrollChallenge(c *gin.Context, token string) (*utils.ChallengeClaims, *models.User, bool) {
+	claims, user, ok := loadChallenge(c, token)
+	if ok && !claims.Enroll {
+		utils.BadRequest(c, "two-factor authentication is already enabled")
+		return nil, nil, false
+	}
+	return claims, user, ok
+}
+
+// checkAccountAttempts 加载已登录用户的用户名，并检查该用户名是否因失败次数过多而被锁定。
+// 需要密码或验证码的账号操作与登录共用失败计数，失败时已写入响应
+func checkAccountAttempts(c *gin.Context, userID string) (string, bool) {
+	var username string
+	err := database.DB.QueryRow("SELECT username FROM users WHERE id = ? AND deleted_at IS NULL", userID).Scan(&username)
+	if err == sql.ErrNoRows {
+		utils.NotFound(c, services.ErrUserNotFound.Error())
+		return "", false
+	}
+	if err != nil {
+		utils.InternalError(c, "database error")
+		return "", false
+	}
+
+	if wait := services.CheckLogin(username, c.ClientIP()); wait > 0 {
+		utils.TooManyRequests(c, "too many failed attempts, try again later", wait)
+		return "", false
+	}
+	return username, true
+}
+
+// recordAccountFailure 记录一次账号操作的密码或验证码错误，触发锁定时写入 429 并返回 true
+func recordAccountFailure(c *gin.Context, username, userID string) bool {
+	if wait := services.RecordLoginFailure(username, c.ClientIP(), userID); wait > 0 {
+		utils.TooManyRequests(c, "too many failed attempts, try again later", wait)
+		return true
+	}
+	return false
+}
+
+// verifyAccountTwoFactorCode 校验已登录用户的验证码或恢复码，错误时计入失败次数并写入响应
+func verifyAccountTwoFactorCode(c *gin.Context, username, userID, code string) bool {
+	usedRecovery, err := services.VerifyTwoFactorCode(userID, code)
+	if errors.Is(err, services.ErrInvalidTwoFactorCode) {
+		if !recordAccountFailure(c, username, userID) {
+			utils.BadRequest(c, err.Error())
+		}
+		return false
+	}
+	if !respondTwoFactorError(c, err) {
+		return false
+	}
+	if usedRecovery {
+		services.RecordAudit(userID, services.AuditRecoveryCodeUsed, c.ClientIP(), "")
+	}
+	return true
+}
+
+// respondTwoFactorError 将两步验证的错误写入响应，err 为 nil 时返回 true
+func respondTwoFactorError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, services.ErrInvalidTwoFactorCode),
+		errors.Is(err, services.ErrTwoFactorAlreadyEnabled),
+		errors.Is(err, services.ErrTwoFactorNotEnabled),
+		errors.Is(err, services.ErrTwoFactorSetupRequired):
+		utils.BadRequest(c, err.Error())
+	case errors.Is(err, services.ErrUserNotFound):
+		utils.NotFound(c, err.Error())
+	default:
+		utils.InternalError(c, "two-factor authentication error")
+	}
+	return false
+}
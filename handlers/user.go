@@ -13,6 +13,7 @@ import (
 	"talkbox/middleware"
 	"talkbox/models"
 	"talkbox/utils"
+	"talkbox/websocket"
 )
 
 type UpdateUserRequest struct {
@@ -20,19 +21,26 @@ type UpdateUserRequest struct {
 	Avatar   string `json:"avatar"`
 }
 
+type UpdateStatusRequest struct {
+	Status string `json:"status" binding:"required,oneof=online away busy invisible"`
+}
+
 type DeviceTokenRequest struct {
 	Platform string `json:"platform" binding:"required,oneof=ios android"`
 	Token    string `json:"token" binding:"required"`
+	Locale   string `json:"locale" binding:"max=16"` // 推送文案的语言，如 zh-CN、en
 }
 
 func GetCurrentUser(c *gin.Context) {
 	userID := middleware.GetUserID(c)
 
 	var user models.User
+	var status string
+	var lastSeenAt sql.NullTime
 	err := database.DB.QueryRow(
-		"SELECT id, username, nickname, avatar, created_at FROM users WHERE id = ?",
+		"SELECT id, username, COALESCE(nickname, ''), COALESCE(avatar, ''), status, last_seen_at, created_at FROM users WHERE id = ?",
 		userID,
-	).Scan(&user.ID, &user.Username, &user.Nickname, &user.Avatar, &user.CreatedAt)
+	).Scan(&user.ID, &user.Username, &user.Nickname, &user.Avatar, &status, &lastSeenAt, &user.CreatedAt)
 
 	if err == sql.ErrNoRows {
 		utils.NotFound(c, "user not found")
@@ -43,9 +51,48 @@ func GetCurrentUser(c *gin.Context) {
 		return
 	}
 
+	applyPresence(&user, status, lastSeenAt, userID)
+
 	utils.Success(c, user.ToResponse())
 }
 
+func UpdateStatus(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+
+	var req UpdateStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.BadRequest(c, err.Error())
+		return
+	}
+
+	_, err := database.DB.Exec(
+		"UPDATE users SET status = ?, updated_at = ? WHERE id = ?",
+		req.Status, time.Now(), userID,
+	)
+	if err != nil {
+		utils.InternalError(c, "failed to update status")
+		return
+	}
+
+	websocket.HubInstance.StatusChanged(userID)
+
+	GetCurrentUser(c)
+}
+
+// applyPresence 按查看者计算用户状态：本人看到自己设置的状态，
+// 他人看到实际在线状态，隐身用户显示为 offline 且不暴露最后在线时间
+func applyPresence(user *models.User, status string, lastSeenAt sql.NullTime, viewerID string) {
+	self := user.ID == viewerID
+	if self {
+		user.Status = status
+	} else {
+		user.Status = websocket.HubInstance.Presence(user.ID, status)
+	}
+	if lastSeenAt.Valid && (self || status != websocket.StatusInvisible) {
+		user.LastSeenAt = &lastSeenAt.Time
+	}
+}
+
 func UpdateCurrentUser(c *gin.Context) {
 	userID := middleware.GetUserID(c)
 
@@ -127,8 +174,10 @@ func UploadAvatar(c *gin.Context) {
 	utils.Success(c, gin.H{"avatar": avatarURL})
 }
 
+// RegisterDeviceToken 为当前会话注册推送令牌，每个会话一个，会话被撤销或过期时随之删除
 func RegisterDeviceToken(c *gin.Context) {
 	userID := middleware.GetUserID(c)
+	sessionID := middleware.GetSessionID(c)
 
 	var req DeviceTokenRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -140,16 +189,22 @@ func RegisterDeviceToken(c *gin.Context) {
 	now := time.Now()
 
 	_, err := database.DB.Exec(`
-		INSERT INTO device_tokens (id, user_id, platform, token, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE token = ?, updated_at = ?
-	`, id, userID, req.Platform, req.Token, now, now, req.Token, now)
+		INSERT INTO device_tokens (id, user_id, session_id, platform, token, locale, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE platform = ?, token = ?, locale = ?, updated_at = ?
+	`, id, userID, sessionID, req.Platform, req.Token, req.Locale, now, now, req.Platform, req.Token, req.Locale, now)
 
 	if err != nil {
 		utils.InternalError(c, "failed to register device token")
 		return
 	}
 
+	// 设备重新登录或换了登录账号时，之前的会话不应再收到该设备的推送
+	database.DB.Exec(
+		"DELETE FROM device_tokens WHERE platform = ? AND token = ? AND session_id != ?",
+		req.Platform, req.Token, sessionID,
+	)
+
 	utils.Success(c, nil)
 }
 
@@ -163,8 +218,8 @@ func UnregisterDeviceToken(c *gin.Context) {
 	}
 
 	_, err := database.DB.Exec(
-		"DELETE FROM device_tokens WHERE user_id = ? AND platform = ?",
-		userID, req.Platform,
+		"DELETE FROM device_tokens WHERE user_id = ? AND (session_id = ? OR (platform = ? AND token = ?))",
+		userID, middleware.GetSessionID(c), req.Platform, req.Token,
 	)
 	if err != nil {
 		utils.InternalError(c, "failed to unregister device token")
@@ -178,8 +233,8 @@ func GetAllUsers(c *gin.Context) {
 	userID := middleware.GetUserID(c)
 
 	rows, err := database.DB.Query(`
-		SELECT id, username, nickname, avatar FROM users
-		WHERE id != ?
+		SELECT id, username, COALESCE(nickname, ''), COALESCE(avatar, ''), status, last_seen_at FROM users
+		WHERE id != ? AND deleted_at IS NULL
 		ORDER BY nickname, username
 	`, userID)
 	if err != nil {
@@ -191,9 +246,12 @@ func GetAllUsers(c *gin.Context) {
 	var users []models.UserResponse
 	for rows.Next() {
 		var user models.User
-		if err := rows.Scan(&user.ID, &user.Username, &user.Nickname, &user.Avatar); err != nil {
+		var status string
+		var lastSeenAt sql.NullTime
+		if err := rows.Scan(&user.ID, &user.Username, &user.Nickname, &user.Avatar, &status, &lastSeenAt); err != nil {
 			continue
 		}
+		applyPresence(&user, status, lastSeenAt, userID)
 		users = append(users, *user.ToResponse())
 	}
 
@@ -214,8 +272,8 @@ func SearchUsers(c *gin.Context) {
 	userID := middleware.GetUserID(c)
 
 	rows, err := database.DB.Query(`
-		SELECT id, username, nickname, avatar FROM users
-		WHERE id != ? AND (username LIKE ? OR nickname LIKE ?)
+		SELECT id, username, COALESCE(nickname, ''), COALESCE(avatar, ''), status, last_seen_at FROM users
+		WHERE id != ? AND deleted_at IS NULL AND (username LIKE ? OR nickname LIKE ?)
 		LIMIT 20
 	`, userID, "%"+query+"%", "%"+query+"%")
 	if err != nil {
@@ -227,9 +285,12 @@ func SearchUsers(c *gin.Context) {
 	var users []models.UserResponse
 	for rows.Next() {
 		var user models.User
-		if err := rows.Scan(&user.ID, &user.Username, &user.Nickname, &user.Avatar); err != nil {
+		var status string
+		var lastSeenAt sql.NullTime
+		if err := rows.Scan(&user.ID, &user.Username, &user.Nickname, &user.Avatar, &status, &lastSeenAt); err != nil {
 			continue
 		}
+		applyPresence(&user, status, lastSeenAt, userID)
 		users = append(users, *user.ToResponse())
 	}
 
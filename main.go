@@ -9,6 +9,8 @@ import (
 	"talkbox/database"
 	"talkbox/handlers"
 	"talkbox/middleware"
+	"talkbox/push"
+	"talkbox/services"
 	"talkbox/websocket"
 )
 
@@ -28,7 +30,26 @@ func main() {
 		log.Fatalf("Failed to create upload directory: %v", err)
 	}
 
-	websocket.InitHub()
+	if err := database.ConnectRedis(); err != nil {
+		log.Fatalf("Failed to connect to redis: %v", err)
+	}
+
+	if err := services.InitLoginGuard(); err != nil {
+		log.Fatalf("Failed to initialize login limiter: %v", err)
+	}
+
+	if err := websocket.InitHub(); err != nil {
+		log.Fatalf("Failed to start websocket hub: %v", err)
+	}
+
+	if err := push.Init(); err != nil {
+		log.Fatalf("Failed to initialize push notifications: %v", err)
+	}
+	services.StartSyncPruner()
+	services.StartScheduler()
+	services.StartSessionPruner()
+	websocket.HandleAction("send_message", handlers.HandleSendMessageAction)
+	websocket.HandleAction("read", handlers.HandleReadAction)
 
 	r := gin.Default()
 
@@ -43,7 +64,11 @@ func main() {
 		auth.POST("/register", handlers.Register)
 		auth.POST("/login", handlers.Login)
 		auth.POST("/logout", middleware.AuthMiddleware(), handlers.Logout)
-		auth.POST("/refresh", middleware.AuthMiddleware(), handlers.RefreshToken)
+		auth.POST("/refresh", handlers.RefreshToken)
+		auth.POST("/password/reset", handlers.ResetPassword)
+		auth.POST("/2fa/verify", handlers.VerifyLoginChallenge)
+		auth.POST("/2fa/setup", handlers.SetupTwoFactorWithChallenge)
+		auth.POST("/2fa/enable", handlers.EnableTwoFactorWithChallenge)
 	}
 
 	users := r.Group("/api/users")
@@ -52,12 +77,36 @@ func main() {
 		users.GET("", handlers.GetAllUsers)
 		users.GET("/me", handlers.GetCurrentUser)
 		users.PUT("/me", handlers.UpdateCurrentUser)
+		users.DELETE("/me", handlers.DeleteAccount)
+		users.PUT("/me/password", handlers.ChangePassword)
+		users.GET("/me/2fa", handlers.GetTwoFactorStatus)
+		users.POST("/me/2fa/setup", handlers.SetupTwoFactor)
+		users.POST("/me/2fa/enable", handlers.EnableTwoFactor)
+		users.DELETE("/me/2fa", handlers.DisableTwoFactor)
+		users.POST("/me/2fa/recovery-codes", handlers.RegenerateRecoveryCodes)
+		users.PUT("/me/status", handlers.UpdateStatus)
 		users.POST("/me/avatar", handlers.UploadAvatar)
 		users.POST("/me/device", handlers.RegisterDeviceToken)
 		users.DELETE("/me/device", handlers.UnregisterDeviceToken)
+		users.GET("/me/sessions", handlers.GetSessions)
+		users.DELETE("/me/sessions", handlers.RevokeOtherSessions)
+		users.DELETE("/me/sessions/:session_id", handlers.RevokeSession)
+		users.GET("/me/notifications", handlers.GetNotificationSettings)
+		users.PUT("/me/notifications", handlers.UpdateNotificationSettings)
 		users.GET("/search", handlers.SearchUsers)
 	}
 
+	r.GET("/api/sync", middleware.AuthMiddleware(), handlers.Sync)
+
+	admin := r.Group("/api/admin")
+	admin.Use(middleware.AuthMiddleware(), middleware.AdminMiddleware())
+	{
+		admin.POST("/users/:id/password-reset", handlers.CreatePasswordReset)
+		admin.DELETE("/users/:id/2fa", handlers.ResetUserTwoFactor)
+		admin.GET("/settings", handlers.GetSettings)
+		admin.PUT("/settings", handlers.UpdateSettings)
+	}
+
 	conversations := r.Group("/api/conversations")
 	conversations.Use(middleware.AuthMiddleware())
 	{
@@ -67,6 +116,9 @@ func main() {
 		conversations.GET("/:id", handlers.GetConversation)
 		conversations.PUT("/:id", handlers.UpdateConversation)
 		conversations.DELETE("/:id", handlers.DeleteConversation)
+		conversations.POST("/:id/read", handlers.MarkConversationRead)
+		conversations.GET("/:id/pins", handlers.GetPins)
+		conversations.PUT("/:id/notifications", handlers.UpdateConversationNotification)
 
 		conversations.POST("/:id/members", handlers.AddMembers)
 		conversations.DELETE("/:id/members/:user_id", handlers.RemoveMember)
@@ -77,7 +129,31 @@ func main() {
 
 		conversations.GET("/:id/messages", handlers.GetMessages)
 		conversations.POST("/:id/messages", handlers.SendMessage)
+		conversations.POST("/:id/scheduled-messages", handlers.ScheduleMessage)
 		conversations.GET("/:id/messages/search", handlers.SearchMessages)
+		conversations.PUT("/:id/messages/:msg_id", handlers.EditMessage)
+		conversations.DELETE("/:id/messages/:msg_id", handlers.RecallMessage)
+		conversations.GET("/:id/messages/:msg_id/edits", handlers.GetMessageEdits)
+		conversations.GET("/:id/messages/:msg_id/thread", handlers.GetThread)
+		conversations.POST("/:id/messages/:msg_id/thread/read", handlers.MarkThreadRead)
+		conversations.POST("/:id/messages/:msg_id/pin", handlers.PinMessage)
+		conversations.DELETE("/:id/messages/:msg_id/pin", handlers.UnpinMessage)
+		conversations.POST("/:id/messages/:msg_id/reactions", handlers.AddReaction)
+		conversations.DELETE("/:id/messages/:msg_id/reactions/:emoji", handlers.RemoveReaction)
+	}
+
+	messages := r.Group("/api/messages")
+	messages.Use(middleware.AuthMiddleware())
+	{
+		messages.POST("/forward", handlers.ForwardMessages)
+	}
+
+	scheduled := r.Group("/api/scheduled-messages")
+	scheduled.Use(middleware.AuthMiddleware())
+	{
+		scheduled.GET("", handlers.GetScheduledMessages)
+		scheduled.PUT("/:id", handlers.UpdateScheduledMessage)
+		scheduled.DELETE("/:id", handlers.CancelScheduledMessage)
 	}
 
 	files := r.Group("/api/files")
@@ -104,6 +180,12 @@ func main() {
 	botAPI.Use(middleware.BotAuthMiddleware())
 	{
 		botAPI.POST("/conversations/:conversation_id/messages", handlers.BotSendMessage)
+		botAPI.PUT("/conversations/:conversation_id/messages/:msg_id", handlers.BotEditMessage)
+		botAPI.DELETE("/conversations/:conversation_id/messages/:msg_id", handlers.BotRecallMessage)
+		botAPI.POST("/conversations/:conversation_id/scheduled-messages", handlers.BotScheduleMessage)
+		botAPI.GET("/scheduled-messages", handlers.BotGetScheduledMessages)
+		botAPI.PUT("/scheduled-messages/:id", handlers.BotUpdateScheduledMessage)
+		botAPI.DELETE("/scheduled-messages/:id", handlers.BotCancelScheduledMessage)
 	}
 
 	r.GET("/ws", websocket.HandleWebSocket)
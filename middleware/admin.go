@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"database/sql"
+
+	"github.com/gin-gonic/gin"
+	"talkbox/config"
+	"talkbox/database"
+	"talkbox/utils"
+)
+
+// AdminMiddleware 只允许 ADMIN_USERS 中配置的用户访问，需放在 AuthMiddleware 之后
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var username string
+		err := database.DB.QueryRow(
+			"SELECT username FROM users WHERE id = ? AND deleted_at IS NULL", GetUserID(c),
+		).Scan(&username)
+		if err != nil && err != sql.ErrNoRows {
+			utils.InternalError(c, "database error")
+			c.Abort()
+			return
+		}
+
+		if !config.Cfg.AdminUsers[username] {
+			utils.Forbidden(c, "admin access required")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"talkbox/database"
 	"talkbox/utils"
 )
 
@@ -30,7 +31,20 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		denied, err := database.IsSessionDenied(claims.SessionID)
+		if err != nil {
+			utils.InternalError(c, "failed to verify session")
+			c.Abort()
+			return
+		}
+		if denied {
+			utils.Unauthorized(c, "session has been revoked")
+			c.Abort()
+			return
+		}
+
 		c.Set("user_id", claims.UserID)
+		c.Set("session_id", claims.SessionID)
 		c.Next()
 	}
 }
@@ -38,3 +52,7 @@ func AuthMiddleware() gin.HandlerFunc {
 func GetUserID(c *gin.Context) string {
 	return c.GetString("user_id")
 }
+
+func GetSessionID(c *gin.Context) string {
+	return c.GetString("session_id")
+}
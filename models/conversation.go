@@ -3,53 +3,77 @@ package models
 import "time"
 
 type Conversation struct {
-	ID        string    `json:"id"`
-	Type      string    `json:"type"` // private, group
-	Name      string    `json:"name"`
-	Avatar    string    `json:"avatar"`
-	OwnerID   string    `json:"owner_id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID      string `json:"id"`
+	Type    string `json:"type"` // private, group
+	Name    string `json:"name"`
+	Avatar  string `json:"avatar"`
+	OwnerID string `json:"owner_id"`
+	// 群聊中谁可以置顶消息：admins（群主和管理员）或 members（所有成员），私聊双方都可以置顶
+	PinPermission string    `json:"pin_permission"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
 type ConversationMember struct {
-	ID             string    `json:"id"`
-	ConversationID string    `json:"conversation_id"`
-	UserID         string    `json:"user_id"`
-	Role           string    `json:"role"` // owner, admin, member
-	Nickname       string    `json:"nickname"`
-	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at"`
+	ID                string     `json:"id"`
+	ConversationID    string     `json:"conversation_id"`
+	UserID            string     `json:"user_id"`
+	Role              string     `json:"role"` // owner, admin, member
+	Nickname          string     `json:"nickname"`
+	LastReadMessageID *string    `json:"last_read_message_id,omitempty"`
+	LastReadAt        *time.Time `json:"last_read_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
 }
 
 type ConversationResponse struct {
-	ID        string           `json:"id"`
-	Type      string           `json:"type"`
-	Name      string           `json:"name"`
-	Avatar    string           `json:"avatar"`
-	OwnerID   string           `json:"owner_id"`
-	CreatedAt time.Time        `json:"created_at"`
-	UpdatedAt time.Time        `json:"updated_at"`
-	Members   []MemberWithUser `json:"members,omitempty"`
-	Bots      []BotResponse    `json:"bots,omitempty"`
+	ID                 string           `json:"id"`
+	Type               string           `json:"type"`
+	Name               string           `json:"name"`
+	Avatar             string           `json:"avatar"`
+	OwnerID            string           `json:"owner_id"`
+	PinPermission      string           `json:"pin_permission"`
+	CreatedAt          time.Time        `json:"created_at"`
+	UpdatedAt          time.Time        `json:"updated_at"`
+	Members            []MemberWithUser `json:"members,omitempty"`
+	Bots               []BotResponse    `json:"bots,omitempty"`
+	Pins               []PinnedMessage  `json:"pins,omitempty"`
+	UnreadCount        int              `json:"unread_count"`
+	UnreadMentionCount int              `json:"unread_mention_count"`
+	// BadgeCount 是该会话计入应用角标的未读数，按通知设置计算：静音中为 0，仅提及模式为未读 @ 数，
+	// 否则为未读数。所有会话之和即推送的角标
+	BadgeCount  int              `json:"badge_count"`
+	LastMessage *MessageResponse `json:"last_message,omitempty"`
+	// 当前用户对该会话的通知设置
+	NotifyLevel string     `json:"notify_level,omitempty"` // all, mentions
+	MutedUntil  *time.Time `json:"muted_until,omitempty"`
 }
 
+// 会话通知级别
+const (
+	NotifyAll      = "all"
+	NotifyMentions = "mentions"
+)
+
 type MemberWithUser struct {
-	ID       string       `json:"id"`
-	UserID   string       `json:"user_id"`
-	Role     string       `json:"role"`
-	Nickname string       `json:"nickname"`
-	User     UserResponse `json:"user"`
+	ID                string       `json:"id"`
+	UserID            string       `json:"user_id"`
+	Role              string       `json:"role"`
+	Nickname          string       `json:"nickname"`
+	LastReadMessageID string       `json:"last_read_message_id,omitempty"`
+	LastReadAt        *time.Time   `json:"last_read_at,omitempty"`
+	User              UserResponse `json:"user"`
 }
 
 func (c *Conversation) ToResponse() *ConversationResponse {
 	return &ConversationResponse{
-		ID:        c.ID,
-		Type:      c.Type,
-		Name:      c.Name,
-		Avatar:    c.Avatar,
-		OwnerID:   c.OwnerID,
-		CreatedAt: c.CreatedAt,
-		UpdatedAt: c.UpdatedAt,
+		ID:            c.ID,
+		Type:          c.Type,
+		Name:          c.Name,
+		Avatar:        c.Avatar,
+		OwnerID:       c.OwnerID,
+		PinPermission: c.PinPermission,
+		CreatedAt:     c.CreatedAt,
+		UpdatedAt:     c.UpdatedAt,
 	}
 }
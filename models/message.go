@@ -10,22 +10,80 @@ type Message struct {
 	ConversationID string          `json:"conversation_id"`
 	SenderID       string          `json:"sender_id"`
 	SenderType     string          `json:"sender_type"` // user, bot
-	Type           string          `json:"type"`        // text, image, video, file, card
+	Type           string          `json:"type"`        // text, image, video, file, card, merged
 	Content        json.RawMessage `json:"content"`
 	ReplyToID      *string         `json:"reply_to_id,omitempty"`
+	ThreadRootID   *string         `json:"thread_root_id,omitempty"`
+	EditedAt       *time.Time      `json:"edited_at,omitempty"`
+	RecalledAt     *time.Time      `json:"recalled_at,omitempty"`
+	RecalledBy     *string         `json:"recalled_by,omitempty"`
+	ClientMsgID    *string         `json:"client_msg_id,omitempty"`
 	CreatedAt      time.Time       `json:"created_at"`
 	UpdatedAt      time.Time       `json:"updated_at"`
 }
 
 type MessageResponse struct {
-	ID             string          `json:"id"`
-	ConversationID string          `json:"conversation_id"`
-	Sender         SenderInfo      `json:"sender"`
-	Type           string          `json:"type"`
-	Content        json.RawMessage `json:"content"`
-	ReplyToID      string          `json:"reply_to_id,omitempty"`
-	ReplyTo        *ReplyInfo      `json:"reply_to,omitempty"`
-	CreatedAt      time.Time       `json:"created_at"`
+	ID             string            `json:"id"`
+	ConversationID string            `json:"conversation_id"`
+	Sender         SenderInfo        `json:"sender"`
+	Type           string            `json:"type"`
+	Content        json.RawMessage   `json:"content"`
+	ReplyToID      string            `json:"reply_to_id,omitempty"`
+	ReplyTo        *ReplyInfo        `json:"reply_to,omitempty"`
+	ThreadRootID   string            `json:"thread_root_id,omitempty"` // 话题内的回复指向根消息
+	ForwardedFrom  *ForwardInfo      `json:"forwarded_from,omitempty"`
+	EditedAt       *time.Time        `json:"edited_at,omitempty"`
+	RecalledAt     *time.Time        `json:"recalled_at,omitempty"` // 已撤回的消息保留为占位，content 为空对象
+	RecalledBy     string            `json:"recalled_by,omitempty"`
+	Reactions      []ReactionSummary `json:"reactions,omitempty"`
+	ClientMsgID    string            `json:"client_msg_id,omitempty"` // 发送方生成的幂等 ID，用于匹配本地乐观显示的消息
+	Pinned         bool              `json:"pinned,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	*ThreadSummary
+}
+
+// PageInfo 是消息分页的游标信息。消息按时间倒序返回，PrevCursor 作为 before 加载更早的消息，
+// NextCursor 作为 after 加载更新的消息；HasMore 表示请求方向上是否还有消息
+type PageInfo struct {
+	HasMore       bool   `json:"has_more"`
+	HasMoreBefore bool   `json:"has_more_before"`
+	HasMoreAfter  bool   `json:"has_more_after"`
+	PrevCursor    string `json:"prev_cursor,omitempty"`
+	NextCursor    string `json:"next_cursor,omitempty"`
+}
+
+type MessagePage struct {
+	Messages []MessageResponse `json:"messages"`
+	PageInfo
+}
+
+type ThreadPage struct {
+	Root    *MessageResponse  `json:"root"`
+	Replies []MessageResponse `json:"replies"`
+	PageInfo
+}
+
+// PinnedMessage 是置顶的消息及置顶人和时间
+type PinnedMessage struct {
+	MessageResponse
+	PinnedBy string    `json:"pinned_by"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// ThreadSummary 是根消息上的话题聚合，没有回复的消息不返回。UnreadCount 为当前用户的话题未读数，
+// 只有参与者才有
+type ThreadSummary struct {
+	ReplyCount   int                 `json:"thread_reply_count"`
+	LastReplyAt  time.Time           `json:"last_reply_at"`
+	Participants []ThreadParticipant `json:"thread_participants"`
+	UnreadCount  int                 `json:"thread_unread_count,omitempty"`
+}
+
+// ThreadParticipant 用于在根消息上展示参与者头像
+type ThreadParticipant struct {
+	ID       string `json:"id"`
+	Nickname string `json:"nickname"`
+	Avatar   string `json:"avatar"`
 }
 
 type SenderInfo struct {
@@ -33,6 +91,16 @@ type SenderInfo struct {
 	Type     string `json:"type"` // user, bot
 	Nickname string `json:"nickname"`
 	Avatar   string `json:"avatar"`
+	Deleted  bool   `json:"deleted,omitempty"` // 发送者已注销
+}
+
+// ForwardInfo 是转发消息的来源，多次转发时保留最初的来源。原消息或会话删除后仍保留，ConversationName 可能为空
+type ForwardInfo struct {
+	MessageID        string     `json:"message_id"`
+	ConversationID   string     `json:"conversation_id"`
+	ConversationName string     `json:"conversation_name,omitempty"`
+	Sender           SenderInfo `json:"sender"`
+	CreatedAt        time.Time  `json:"created_at"`
 }
 
 type ReplyInfo struct {
@@ -40,6 +108,7 @@ type ReplyInfo struct {
 	Type       string          `json:"type"`
 	Content    json.RawMessage `json:"content"`
 	SenderName string          `json:"sender_name"`
+	Recalled   bool            `json:"recalled,omitempty"`
 }
 
 // Content types
@@ -78,6 +147,47 @@ type CardContent struct {
 	URL     string `json:"url,omitempty"`
 }
 
+// MessageTypeMerged 是合并转发的聊天记录，只能由转发接口生成
+const MessageTypeMerged = "merged"
+
+// MergedContent 是合并转发的聊天记录，保存转发时各条消息的快照
+type MergedContent struct {
+	ConversationID string          `json:"conversation_id"`
+	Messages       []MergedMessage `json:"messages"`
+}
+
+type MergedMessage struct {
+	ID        string          `json:"id"`
+	Sender    SenderInfo      `json:"sender"`
+	Type      string          `json:"type"`
+	Content   json.RawMessage `json:"content"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// MessageEdit 保存消息被编辑前的历史版本
+type MessageEdit struct {
+	ID        string          `json:"id"`
+	MessageID string          `json:"message_id"`
+	Content   json.RawMessage `json:"content"`
+	EditedBy  string          `json:"edited_by"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type MessageReaction struct {
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id"`
+	Emoji     string    `json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionSummary 是某个表情在一条消息上的聚合结果，Reacted 表示当前用户是否点过
+type ReactionSummary struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
 type Mention struct {
 	ID        string    `json:"id"`
 	MessageID string    `json:"message_id"`
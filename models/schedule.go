@@ -0,0 +1,34 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// 定时消息状态
+const (
+	ScheduleStatusPending  = "pending"
+	ScheduleStatusSending  = "sending"
+	ScheduleStatusSent     = "sent"
+	ScheduleStatusCanceled = "canceled"
+	ScheduleStatusFailed   = "failed"
+)
+
+// ScheduledMessage 是等待到点发送的消息，发送成功后 MessageID 为实际创建的消息，
+// 被取消或发送失败时 Error 说明原因
+type ScheduledMessage struct {
+	ID             string          `json:"id"`
+	ConversationID string          `json:"conversation_id"`
+	SenderID       string          `json:"sender_id"`
+	SenderType     string          `json:"sender_type"` // user, bot
+	Type           string          `json:"type"`
+	Content        json.RawMessage `json:"content"`
+	ReplyToID      string          `json:"reply_to_id,omitempty"`
+	ThreadRootID   string          `json:"thread_root_id,omitempty"`
+	SendAt         time.Time       `json:"send_at"`
+	Status         string          `json:"status"` // pending, sending, sent, canceled, failed
+	MessageID      string          `json:"message_id,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// TokenPair 是登录或刷新后签发的令牌。Token 为短期访问令牌，过期后用 RefreshToken 换取新的令牌对，
+// 每个刷新令牌只能使用一次
+type TokenPair struct {
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+}
+
+// Session 是用户的一个登录会话，对应一台设备。LastUsedAt 和 IP 在每次刷新令牌时更新
+type Session struct {
+	ID         string    `json:"id"`
+	DeviceName string    `json:"device_name"`
+	Platform   string    `json:"platform"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"` // 是否为发起请求的会话
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
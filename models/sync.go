@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// SyncResponse 是增量同步的结果。同一实体在一页内多次变更时只返回最终状态
+type SyncResponse struct {
+	Conversations        []ConversationResponse `json:"conversations"`
+	DeletedConversations []string               `json:"deleted_conversations"`
+	Members              []SyncMember           `json:"members"`
+	RemovedMembers       []SyncMemberRef        `json:"removed_members"`
+	Bots                 []SyncBot              `json:"bots"`
+	RemovedBots          []SyncBotRef           `json:"removed_bots"`
+	Messages             []MessageResponse      `json:"messages"`
+	ReadStates           []SyncReadState        `json:"read_states"`
+	Cursor               string                 `json:"cursor"`
+	HasMore              bool                   `json:"has_more"`
+	Reset                bool                   `json:"reset"` // 为 true 时客户端需要全量拉取后从 cursor 继续同步
+}
+
+type SyncMember struct {
+	ConversationID string `json:"conversation_id"`
+	MemberWithUser
+}
+
+type SyncMemberRef struct {
+	ConversationID string `json:"conversation_id"`
+	UserID         string `json:"user_id"`
+}
+
+type SyncBot struct {
+	ConversationID string `json:"conversation_id"`
+	BotResponse
+}
+
+type SyncBotRef struct {
+	ConversationID string `json:"conversation_id"`
+	BotID          string `json:"bot_id"`
+}
+
+type SyncReadState struct {
+	ConversationID    string     `json:"conversation_id"`
+	LastReadMessageID string     `json:"last_read_message_id,omitempty"`
+	LastReadAt        *time.Time `json:"last_read_at,omitempty"`
+}
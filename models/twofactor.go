@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// TwoFactorSetup 是开始绑定两步验证时返回的密钥，客户端将 ProvisioningURI 显示为二维码供验证器应用扫描，
+// 无法扫码时手动输入 Secret
+type TwoFactorSetup struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// TwoFactorStatus 是用户的两步验证状态，Required 表示管理员要求所有用户启用
+type TwoFactorStatus struct {
+	Enabled                bool `json:"enabled"`
+	Required               bool `json:"required"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// LoginChallenge 是密码校验通过后等待两步验证时的登录结果，不含访问令牌。
+// EnrollmentRequired 表示用户尚未启用两步验证而管理员要求启用，需先用挑战令牌完成绑定
+type LoginChallenge struct {
+	TwoFactorRequired  bool      `json:"two_factor_required"`
+	EnrollmentRequired bool      `json:"enrollment_required"`
+	ChallengeToken     string    `json:"challenge_token"`
+	ExpiresAt          time.Time `json:"expires_at"`
+}
+
+// ServerSettings 是管理员可在运行时修改的全局设置
+type ServerSettings struct {
+	RequireTwoFactor bool `json:"require_two_factor"`
+}
@@ -2,30 +2,67 @@ package models
 
 import "time"
 
+// DeletedUserNickname 是注销后的用户显示的昵称，客户端可根据 deleted 标记自行本地化
+const DeletedUserNickname = "Deleted User"
+
 type User struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Nickname  string    `json:"nickname"`
-	Avatar    string    `json:"avatar"`
-	Password  string    `json:"-"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         string     `json:"id"`
+	Username   string     `json:"username"`
+	Nickname   string     `json:"nickname"`
+	Avatar     string     `json:"avatar"`
+	Password   string     `json:"-"`
+	Status     string     `json:"status"` // online, away, busy, invisible
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
 }
 
 type UserResponse struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Nickname  string    `json:"nickname"`
-	Avatar    string    `json:"avatar"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         string     `json:"id"`
+	Username   string     `json:"username"`
+	Nickname   string     `json:"nickname"`
+	Avatar     string     `json:"avatar"`
+	Status     string     `json:"status,omitempty"` // 对他人展示的状态：online, away, busy, offline
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
 }
 
 func (u *User) ToResponse() *UserResponse {
 	return &UserResponse{
-		ID:        u.ID,
-		Username:  u.Username,
-		Nickname:  u.Nickname,
-		Avatar:    u.Avatar,
-		CreatedAt: u.CreatedAt,
+		ID:         u.ID,
+		Username:   u.Username,
+		Nickname:   u.Nickname,
+		Avatar:     u.Avatar,
+		Status:     u.Status,
+		LastSeenAt: u.LastSeenAt,
+		CreatedAt:  u.CreatedAt,
+	}
+}
+
+// NotificationSettings 是用户的免打扰时段，时间为 timezone 时区下的 HH:MM，结束早于开始时表示跨天
+type NotificationSettings struct {
+	DNDEnabled bool   `json:"dnd_enabled"`
+	DNDStart   string `json:"dnd_start"`
+	DNDEnd     string `json:"dnd_end"`
+	Timezone   string `json:"timezone"`
+}
+
+// InQuietHours 判断 now 是否处于免打扰时段
+func (s *NotificationSettings) InQuietHours(now time.Time) bool {
+	if !s.DNDEnabled || s.DNDStart == s.DNDEnd {
+		return false
+	}
+
+	loc := time.Local
+	if s.Timezone != "" {
+		if l, err := time.LoadLocation(s.Timezone); err == nil {
+			loc = l
+		}
+	}
+	current := now.In(loc).Format("15:04")
+
+	if s.DNDStart < s.DNDEnd {
+		return current >= s.DNDStart && current < s.DNDEnd
 	}
+	return current >= s.DNDStart || current < s.DNDEnd
 }
@@ -0,0 +1,162 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	apnsProductionURL = "https://api.push.apple.com"
+	apnsSandboxURL    = "https://api.sandbox.push.apple.com"
+	// APNs 要求鉴权 Token 在 20 到 60 分钟之间刷新
+	apnsTokenLifetime = 40 * time.Minute
+	apnsWorkers       = 16
+)
+
+// APNsProvider 使用基于 Token 的鉴权（.p8 密钥）通过 HTTP/2 发送 iOS 推送
+type APNsProvider struct {
+	baseURL string
+	topic   string
+	keyID   string
+	teamID  string
+	key     *ecdsa.PrivateKey
+	client  *http.Client
+
+	mu        sync.Mutex
+	token     string
+	tokenTime time.Time
+}
+
+func NewAPNsProvider(keyFile, keyID, teamID, topic string, sandbox bool) (*APNsProvider, error) {
+	pem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, fmt.Errorf("invalid APNs key: %w", err)
+	}
+
+	baseURL := apnsProductionURL
+	if sandbox {
+		baseURL = apnsSandboxURL
+	}
+
+	return &APNsProvider{
+		baseURL: baseURL,
+		topic:   topic,
+		keyID:   keyID,
+		teamID:  teamID,
+		key:     key,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *APNsProvider) Platform() string {
+	return PlatformIOS
+}
+
+func (p *APNsProvider) Send(ctx context.Context, notifications []*Notification) []Result {
+	return sendConcurrently(notifications, apnsWorkers, func(n *Notification) Result {
+		return p.send(ctx, n)
+	})
+}
+
+func (p *APNsProvider) send(ctx context.Context, n *Notification) Result {
+	token, err := p.authToken()
+	if err != nil {
+		return Result{Err: err}
+	}
+
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert":     map[string]string{"title": n.Title, "body": n.Body},
+			"badge":     n.Badge,
+			"sound":     "default",
+			"thread-id": n.ThreadID,
+		},
+	}
+	for k, v := range n.Data {
+		payload[k] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Result{Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/3/device/"+n.Token, bytes.NewReader(body))
+	if err != nil {
+		return Result{Err: err}
+	}
+	req.Header.Set("authorization", "bearer "+token)
+	req.Header.Set("apns-topic", p.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Result{Err: err, Retryable: true}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return Result{}
+	}
+
+	var apnsErr struct {
+		Reason string `json:"reason"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	json.Unmarshal(data, &apnsErr)
+	err = fmt.Errorf("apns: %d %s", resp.StatusCode, apnsErr.Reason)
+
+	switch {
+	case resp.StatusCode == http.StatusGone,
+		apnsErr.Reason == "BadDeviceToken", apnsErr.Reason == "Unregistered", apnsErr.Reason == "DeviceTokenNotForTopic":
+		return Result{Err: err, Invalid: true}
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return Result{Err: err, Retryable: true}
+	case apnsErr.Reason == "ExpiredProviderToken":
+		p.mu.Lock()
+		p.token = ""
+		p.mu.Unlock()
+		return Result{Err: err, Retryable: true}
+	default:
+		return Result{Err: err}
+	}
+}
+
+// authToken 返回缓存的鉴权 Token，过期前重新签发
+func (p *APNsProvider) authToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && time.Since(p.tokenTime) < apnsTokenLifetime {
+		return p.token, nil
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": p.teamID,
+		"iat": now.Unix(),
+	})
+	token.Header["kid"] = p.keyID
+
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		return "", err
+	}
+	p.token = signed
+	p.tokenTime = now
+	return signed, nil
+}
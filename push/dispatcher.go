@@ -0,0 +1,254 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"talkbox/database"
+)
+
+const (
+	queueSize     = 4096
+	batchSize     = 100
+	flushInterval = 500 * time.Millisecond
+	sendTimeout   = 30 * time.Second
+	maxAttempts   = 4
+	retryBackoff  = 2 * time.Second
+)
+
+// Job 是一次待推送的消息，接收者为单个用户
+type Job struct {
+	UserID           string
+	ConversationID   string
+	ConversationType string
+	ConversationName string
+	MessageID        string
+	MessageType      string
+	Content          json.RawMessage
+	SenderName       string
+	Mentioned        bool
+}
+
+// Dispatcher 批量处理推送任务：按用户查询设备 Token 和角标数，生成本地化文案后交给对应平台发送，
+// 临时错误按指数退避重试，服务端报告失效的 Token 会被删除
+type Dispatcher struct {
+	providers    map[string]Provider
+	jobs         chan *Job
+	retryBackoff time.Duration // 首次重试的等待时间，之后每次翻倍
+}
+
+func NewDispatcher(providers ...Provider) *Dispatcher {
+	d := &Dispatcher{
+		providers:    make(map[string]Provider),
+		jobs:         make(chan *Job, queueSize),
+		retryBackoff: retryBackoff,
+	}
+	for _, p := range providers {
+		d.providers[p.Platform()] = p
+	}
+	return d
+}
+
+func (d *Dispatcher) Start() {
+	go d.run()
+}
+
+// Enqueue 提交推送任务，队列已满时丢弃，不阻塞消息发送
+func (d *Dispatcher) Enqueue(job *Job) {
+	select {
+	case d.jobs <- job:
+	default:
+		log.Printf("push queue full, dropping notification for user %s", job.UserID)
+	}
+}
+
+func (d *Dispatcher) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Job, 0, batchSize)
+	for {
+		select {
+		case job := <-d.jobs:
+			batch = append(batch, job)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		d.process(batch)
+		batch = make([]*Job, 0, batchSize)
+	}
+}
+
+func (d *Dispatcher) process(jobs []*Job) {
+	userIDs := uniqueUserIDs(jobs)
+
+	devices, err := loadDevices(userIDs)
+	if err != nil {
+		log.Printf("failed to load device tokens: %v", err)
+		return
+	}
+	badges, err := loadBadges(userIDs)
+	if err != nil {
+		log.Printf("failed to load badge counts: %v", err)
+	}
+
+	byPlatform := make(map[string][]*Notification)
+	for _, job := range jobs {
+		for _, dev := range devices[job.UserID] {
+			if _, ok := d.providers[dev.platform]; !ok {
+				continue
+			}
+			title, body := localize(dev.locale, job)
+			byPlatform[dev.platform] = append(byPlatform[dev.platform], &Notification{
+				Platform: dev.platform,
+				Token:    dev.token,
+				Title:    title,
+				Body:     body,
+				Badge:    badges[job.UserID],
+				ThreadID: job.ConversationID,
+				Data: map[string]string{
+					"conversation_id": job.ConversationID,
+					"message_id":      job.MessageID,
+					"badge":           strconv.Itoa(badges[job.UserID]),
+				},
+			})
+		}
+	}
+
+	for platform, notifications := range byPlatform {
+		go d.send(d.providers[platform], notifications)
+	}
+}
+
+func (d *Dispatcher) send(provider Provider, notifications []*Notification) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	results := provider.Send(ctx, notifications)
+	cancel()
+
+	var retry []*Notification
+	for i, result := range results {
+		n := notifications[i]
+		switch {
+		case result.Err == nil:
+		case result.Invalid:
+			pruneToken(n.Platform, n.Token)
+		case result.Retryable && n.attempt+1 < maxAttempts:
+			n.attempt++
+			retry = append(retry, n)
+		default:
+			log.Printf("push to %s device failed: %v", n.Platform, result.Err)
+		}
+	}
+
+	if len(retry) > 0 {
+		// 同一批中重试次数相同，按 2s、4s、8s 退避
+		delay := d.retryBackoff << (retry[0].attempt - 1)
+		time.AfterFunc(delay, func() { d.send(provider, retry) })
+	}
+}
+
+type device struct {
+	platform string
+	token    string
+	locale   string
+}
+
+func uniqueUserIDs(jobs []*Job) []string {
+	seen := make(map[string]bool)
+	var userIDs []string
+	for _, job := range jobs {
+		if !seen[job.UserID] {
+			seen[job.UserID] = true
+			userIDs = append(userIDs, job.UserID)
+		}
+	}
+	return userIDs
+}
+
+func inClause(ids []string) (string, []interface{}) {
+	placeholders := strings.Repeat("?,", len(ids)-1) + "?"
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return placeholders, args
+}
+
+func loadDevices(userIDs []string) (map[string][]device, error) {
+	placeholders, args := inClause(userIDs)
+	rows, err := database.DB.Query(
+		"SELECT user_id, platform, token, locale FROM device_tokens WHERE user_id IN ("+placeholders+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make(map[string][]device)
+	for rows.Next() {
+		var userID string
+		var dev device
+		if err := rows.Scan(&userID, &dev.platform, &dev.token, &dev.locale); err != nil {
+			return nil, err
+		}
+		devices[userID] = append(devices[userID], dev)
+	}
+	return devices, rows.Err()
+}
+
+// loadBadges 统计每个用户所有会话计入角标的未读消息总数，等于会话列表中各会话 badge_count 之和：
+// 静音中的会话不计入，仅提及模式的会话只计入未读的 @ 消息。修改时需与会话列表的查询同步
+func loadBadges(userIDs []string) (map[string]int, error) {
+	placeholders, args := inClause(userIDs)
+	args = append(args, time.Now())
+	rows, err := database.DB.Query(`
+		SELECT m.user_id, COUNT(msg.id)
+		FROM conversation_members m
+		JOIN messages msg ON msg.conversation_id = m.conversation_id
+			AND msg.recalled_at IS NULL
+			AND msg.thread_root_id IS NULL
+			AND (msg.created_at > COALESCE(m.last_read_at, m.created_at)
+				OR (msg.created_at = m.last_read_at AND msg.id > COALESCE(m.last_read_message_id, '')))
+			AND NOT (msg.sender_type = 'user' AND msg.sender_id = m.user_id)
+		WHERE m.user_id IN (`+placeholders+`)
+			AND (m.muted_until IS NULL OR m.muted_until <= ?)
+			AND (m.notify_level = 'all'
+				OR EXISTS (SELECT 1 FROM mentions mn WHERE mn.message_id = msg.id AND mn.user_id = m.user_id))
+		GROUP BY m.user_id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	badges := make(map[string]int)
+	for rows.Next() {
+		var userID string
+		var count int
+		if err := rows.Scan(&userID, &count); err != nil {
+			return nil, err
+		}
+		badges[userID] = count
+	}
+	return badges, rows.Err()
+}
+
+func pruneToken(platform, token string) {
+	if _, err := database.DB.Exec(
+		"DELETE FROM device_tokens WHERE platform = ? AND token = ?",
+		platform, token,
+	); err != nil {
+		log.Printf("failed to prune device token: %v", err)
+	}
+}
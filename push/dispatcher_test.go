@@ -0,0 +1,213 @@
+package push
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"talkbox/database"
+)
+
+const (
+	devicesQuery = "SELECT user_id, platform, token, locale FROM device_tokens WHERE user_id IN"
+	badgesQuery  = "SELECT m.user_id, COUNT(msg.id)"
+)
+
+// dbMock 在整个测试包中替换 database.DB。重试和删除失效 Token 在后台 goroutine 中访问数据库，
+// 不在测试之间恢复；各测试使用不同的用户 ID 和 Token，预期互不干扰
+var dbMock sqlmock.Sqlmock
+
+func TestMain(m *testing.M) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	database.DB = db
+	dbMock = mock
+
+	os.Exit(m.Run())
+}
+
+type testDevice struct {
+	userID, platform, token, locale string
+}
+
+func expectDevices(userIDs []string, devices ...testDevice) {
+	rows := sqlmock.NewRows([]string{"user_id", "platform", "token", "locale"})
+	for _, d := range devices {
+		rows.AddRow(d.userID, d.platform, d.token, d.locale)
+	}
+	dbMock.ExpectQuery(regexp.QuoteMeta(devicesQuery)).WithArgs(stringArgs(userIDs)...).WillReturnRows(rows)
+}
+
+func expectBadges(userIDs []string, badges map[string]int) {
+	rows := sqlmock.NewRows([]string{"user_id", "count"})
+	for _, userID := range userIDs {
+		if n, ok := badges[userID]; ok {
+			rows.AddRow(userID, n)
+		}
+	}
+	args := append(stringArgs(userIDs), sqlmock.AnyArg())
+	dbMock.ExpectQuery(regexp.QuoteMeta(badgesQuery)).WithArgs(args...).WillReturnRows(rows)
+}
+
+func stringArgs(values []string) []driver.Value {
+	args := make([]driver.Value, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
+
+func textJob(userID string) *Job {
+	return &Job{
+		UserID:           userID,
+		ConversationID:   "conv-" + userID,
+		ConversationType: "private",
+		MessageID:        "msg-" + userID,
+		MessageType:      "text",
+		Content:          json.RawMessage(`{"text":"hello"}`),
+		SenderName:       "Alice",
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatcherBatchesJobs(t *testing.T) {
+	users := []string{"batch-1", "batch-2", "batch-3"}
+	expectDevices(users,
+		testDevice{"batch-1", PlatformIOS, "batch-tok-1", "en"},
+		testDevice{"batch-2", PlatformIOS, "batch-tok-2", "en"},
+		testDevice{"batch-3", PlatformIOS, "batch-tok-3", "en"},
+	)
+	expectBadges(users, nil)
+
+	fake := NewFakeProvider(PlatformIOS)
+	d := NewDispatcher(fake)
+	d.Start()
+	for _, userID := range users {
+		d.Enqueue(textJob(userID))
+	}
+
+	waitFor(t, "notifications", func() bool { return len(fake.Sent()) == len(users) })
+	if n := fake.Batches(); n != 1 {
+		t.Errorf("provider called %d times, want a single batch", n)
+	}
+	if err := dbMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDispatcherRetriesTransientErrors(t *testing.T) {
+	users := []string{"retry-1", "retry-2"}
+	expectDevices(users,
+		testDevice{"retry-1", PlatformAndroid, "retry-tok-1", "en"},
+		testDevice{"retry-2", PlatformAndroid, "retry-tok-2", "en"},
+	)
+	expectBadges(users, nil)
+
+	fake := NewFakeProvider(PlatformAndroid)
+	fake.TransientFailures["retry-tok-1"] = 2           // 第三次成功
+	fake.TransientFailures["retry-tok-2"] = maxAttempts // 始终失败，达到上限后放弃
+	d := NewDispatcher(fake)
+	d.retryBackoff = 10 * time.Millisecond
+
+	d.process([]*Job{textJob("retry-1"), textJob("retry-2")})
+
+	waitFor(t, "all attempts", func() bool { return fake.Batches() == maxAttempts })
+	time.Sleep(100 * time.Millisecond)
+
+	if n := fake.Batches(); n != maxAttempts {
+		t.Errorf("provider called %d times, want %d", n, maxAttempts)
+	}
+	sent := fake.Sent()
+	if len(sent) != 1 || sent[0].Token != "retry-tok-1" {
+		t.Fatalf("sent %d notifications, want only retry-tok-1", len(sent))
+	}
+}
+
+func TestDispatcherPrunesInvalidTokens(t *testing.T) {
+	users := []string{"prune-1"}
+	expectDevices(users,
+		testDevice{"prune-1", PlatformIOS, "prune-dead", "en"},
+		testDevice{"prune-1", PlatformIOS, "prune-live", "en"},
+	)
+	expectBadges(users, nil)
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM device_tokens WHERE platform = ? AND token = ?")).
+		WithArgs(PlatformIOS, "prune-dead").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	fake := NewFakeProvider(PlatformIOS)
+	fake.InvalidTokens["prune-dead"] = true
+	d := NewDispatcher(fake)
+
+	d.process([]*Job{textJob("prune-1")})
+
+	waitFor(t, "invalid token pruned", func() bool { return dbMock.ExpectationsWereMet() == nil })
+	sent := fake.Sent()
+	if len(sent) != 1 || sent[0].Token != "prune-live" {
+		t.Fatalf("sent %v, want only prune-live", sent)
+	}
+}
+
+func TestDispatcherBadgeAndLocalizedPayload(t *testing.T) {
+	users := []string{"l10n-1"}
+	expectDevices(users,
+		testDevice{"l10n-1", PlatformIOS, "l10n-en", "en-US"},
+		testDevice{"l10n-1", PlatformIOS, "l10n-zh", "zh-Hans"},
+		testDevice{"l10n-1", PlatformIOS, "l10n-fr", "fr"},
+	)
+	expectBadges(users, map[string]int{"l10n-1": 7})
+
+	fake := NewFakeProvider(PlatformIOS)
+	d := NewDispatcher(fake)
+
+	d.process([]*Job{{
+		UserID:           "l10n-1",
+		ConversationID:   "group-1",
+		ConversationType: "group",
+		ConversationName: "Team",
+		MessageID:        "msg-1",
+		MessageType:      "image",
+		Content:          json.RawMessage(`{"url":"https://example.com/a.png"}`),
+		SenderName:       "Alice",
+		Mentioned:        true,
+	}})
+
+	waitFor(t, "notifications", func() bool { return len(fake.Sent()) == 3 })
+
+	want := map[string]string{
+		"l10n-en": "Alice mentioned you: [Photo]",
+		"l10n-zh": "Alice 提到了你: [图片]",
+		"l10n-fr": "Alice 提到了你: [图片]", // 不支持的语言回退到默认语言
+	}
+	for _, n := range fake.Sent() {
+		if n.Title != "Team" {
+			t.Errorf("%s: title = %q, want Team", n.Token, n.Title)
+		}
+		if n.Body != want[n.Token] {
+			t.Errorf("%s: body = %q, want %q", n.Token, n.Body, want[n.Token])
+		}
+		if n.Badge != 7 || n.Data["badge"] != "7" {
+			t.Errorf("%s: badge = %d / %q, want 7", n.Token, n.Badge, n.Data["badge"])
+		}
+		if n.ThreadID != "group-1" || n.Data["conversation_id"] != "group-1" || n.Data["message_id"] != "msg-1" {
+			t.Errorf("%s: unexpected thread or data %v", n.Token, n.Data)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	errFakeInvalidToken = errors.New("fake: invalid token")
+	errFakeUnavailable  = errors.New("fake: service unavailable")
+)
+
+// FakeProvider 记录收到的通知而不真正发送，用于测试和本地开发。
+// InvalidTokens 中的 Token 会被报告为失效；TransientFailures 为 Token 在成功前返回临时错误的次数
+type FakeProvider struct {
+	platform string
+
+	mu                sync.Mutex
+	sent              []*Notification
+	batches           int
+	InvalidTokens     map[string]bool
+	TransientFailures map[string]int
+}
+
+func NewFakeProvider(platform string) *FakeProvider {
+	return &FakeProvider{
+		platform:          platform,
+		InvalidTokens:     make(map[string]bool),
+		TransientFailures: make(map[string]int),
+	}
+}
+
+func (p *FakeProvider) Platform() string {
+	return p.platform
+}
+
+func (p *FakeProvider) Send(ctx context.Context, notifications []*Notification) []Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.batches++
+	results := make([]Result, len(notifications))
+	for i, n := range notifications {
+		if p.InvalidTokens[n.Token] {
+			results[i] = Result{Err: errFakeInvalidToken, Invalid: true}
+			continue
+		}
+		if p.TransientFailures[n.Token] > 0 {
+			p.TransientFailures[n.Token]--
+			results[i] = Result{Err: errFakeUnavailable, Retryable: true}
+			continue
+		}
+		p.sent = append(p.sent, n)
+	}
+	return results
+}
+
+// Sent 返回已发送的通知
+func (p *FakeProvider) Sent() []*Notification {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Notification(nil), p.sent...)
+}
+
+// Batches 返回 Send 被调用的次数
+func (p *FakeProvider) Batches() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.batches
+}
@@ -0,0 +1,228 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	fcmScope       = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmSendURL     = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	fcmDefaultAuth = "https://oauth2.googleapis.com/token"
+	fcmWorkers     = 16
+)
+
+// FCMProvider 使用服务账号通过 FCM HTTP v1 接口发送 Android 推送
+type FCMProvider struct {
+	projectID   string
+	clientEmail string
+	tokenURI    string
+	key         *rsa.PrivateKey
+	client      *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func NewFCMProvider(credentialsFile string) (*FCMProvider, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid FCM credentials: %w", err)
+	}
+	if creds.ProjectID == "" || creds.ClientEmail == "" {
+		return nil, fmt.Errorf("invalid FCM credentials: project_id and client_email are required")
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(creds.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid FCM private key: %w", err)
+	}
+
+	tokenURI := creds.TokenURI
+	if tokenURI == "" {
+		tokenURI = fcmDefaultAuth
+	}
+
+	return &FCMProvider{
+		projectID:   creds.ProjectID,
+		clientEmail: creds.ClientEmail,
+		tokenURI:    tokenURI,
+		key:         key,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *FCMProvider) Platform() string {
+	return PlatformAndroid
+}
+
+func (p *FCMProvider) Send(ctx context.Context, notifications []*Notification) []Result {
+	accessToken, err := p.token(ctx)
+	if err != nil {
+		results := make([]Result, len(notifications))
+		for i := range results {
+			results[i] = Result{Err: err, Retryable: true}
+		}
+		return results
+	}
+
+	return sendConcurrently(notifications, fcmWorkers, func(n *Notification) Result {
+		return p.send(ctx, accessToken, n)
+	})
+}
+
+func (p *FCMProvider) send(ctx context.Context, accessToken string, n *Notification) Result {
+	notification := map[string]interface{}{
+		"tag":                n.ThreadID,
+		"notification_count": n.Badge,
+	}
+	message := map[string]interface{}{
+		"token": n.Token,
+		"notification": map[string]string{
+			"title": n.Title,
+			"body":  n.Body,
+		},
+		"android": map[string]interface{}{
+			"priority":     "high",
+			"notification": notification,
+		},
+	}
+	if len(n.Data) > 0 {
+		message["data"] = n.Data
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"message": message})
+	if err != nil {
+		return Result{Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(fcmSendURL, p.projectID), bytes.NewReader(body))
+	if err != nil {
+		return Result{Err: err}
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Result{Err: err, Retryable: true}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return Result{}
+	}
+
+	var fcmErr struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	json.Unmarshal(data, &fcmErr)
+
+	errorCode := fcmErr.Error.Status
+	for _, d := range fcmErr.Error.Details {
+		if d.ErrorCode != "" {
+			errorCode = d.ErrorCode
+		}
+	}
+	err = fmt.Errorf("fcm: %d %s %s", resp.StatusCode, errorCode, fcmErr.Error.Message)
+
+	switch {
+	case errorCode == "UNREGISTERED",
+		errorCode == "INVALID_ARGUMENT" && strings.Contains(fcmErr.Error.Message, "registration token"):
+		return Result{Err: err, Invalid: true}
+	case resp.StatusCode == http.StatusUnauthorized:
+		p.mu.Lock()
+		p.accessToken = ""
+		p.mu.Unlock()
+		return Result{Err: err, Retryable: true}
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return Result{Err: err, Retryable: true}
+	default:
+		return Result{Err: err}
+	}
+}
+
+// token 用服务账号签发的 JWT 换取 OAuth2 访问令牌，过期前一分钟刷新
+func (p *FCMProvider) token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.accessToken != "" && time.Now().Before(p.expiresAt.Add(-time.Minute)) {
+		return p.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   p.clientEmail,
+		"scope": fcmScope,
+		"aud":   p.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(p.key)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("fcm: failed to obtain access token: %d %s", resp.StatusCode, data)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	p.accessToken = result.AccessToken
+	p.expiresAt = now.Add(time.Duration(result.ExpiresIn) * time.Second)
+	return p.accessToken, nil
+}
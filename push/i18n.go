@@ -0,0 +1,110 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// 未注册语言或不支持的语言使用中文
+const defaultLocale = "zh"
+
+const maxPreviewLength = 100
+
+type localeStrings struct {
+	image, video, file, card string
+	merged                   string
+	groupBody                string // 发送者: 内容
+	mention                  string // 发送者 @ 了你: 内容
+	newMessage               string // 会话名缺失时的标题
+}
+
+var translations = map[string]localeStrings{
+	"zh": {
+		image:      "[图片]",
+		video:      "[视频]",
+		file:       "[文件] %s",
+		card:       "[卡片] %s",
+		merged:     "[聊天记录]",
+		groupBody:  "%s: %s",
+		mention:    "%s 提到了你: %s",
+		newMessage: "新消息",
+	},
+	"en": {
+		image:      "[Photo]",
+		video:      "[Video]",
+		file:       "[File] %s",
+		card:       "[Card] %s",
+		merged:     "[Chat history]",
+		groupBody:  "%s: %s",
+		mention:    "%s mentioned you: %s",
+		newMessage: "New message",
+	},
+}
+
+// translationsFor 按语言标签查找文案，zh-CN、zh_Hans 等回退到 zh
+func translationsFor(locale string) localeStrings {
+	tag := strings.ToLower(locale)
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	if t, ok := translations[tag]; ok {
+		return t
+	}
+	return translations[defaultLocale]
+}
+
+// localize 生成通知的标题和正文。私聊以发送者为标题，群聊以群名为标题并在正文前加发送者
+func localize(locale string, job *Job) (string, string) {
+	t := translationsFor(locale)
+	preview := messagePreview(t, job.MessageType, job.Content)
+
+	title := job.SenderName
+	body := preview
+	if job.ConversationType == "group" {
+		title = job.ConversationName
+		if job.Mentioned {
+			body = fmt.Sprintf(t.mention, job.SenderName, preview)
+		} else {
+			body = fmt.Sprintf(t.groupBody, job.SenderName, preview)
+		}
+	}
+	if title == "" {
+		title = t.newMessage
+	}
+	return title, body
+}
+
+func messagePreview(t localeStrings, msgType string, content json.RawMessage) string {
+	var c struct {
+		Text  string `json:"text"`
+		Name  string `json:"name"`
+		Title string `json:"title"`
+	}
+	json.Unmarshal(content, &c)
+
+	switch msgType {
+	case "text":
+		return truncate(c.Text, maxPreviewLength)
+	case "image":
+		return t.image
+	case "video":
+		return t.video
+	case "file":
+		return fmt.Sprintf(t.file, truncate(c.Name, maxPreviewLength))
+	case "card":
+		return fmt.Sprintf(t.card, truncate(c.Title, maxPreviewLength))
+	case "merged":
+		return t.merged
+	default:
+		return ""
+	}
+}
+
+func truncate(s string, maxLength int) string {
+	if utf8.RuneCountInString(s) <= maxLength {
+		return s
+	}
+	return string([]rune(s)[:maxLength]) + "…"
+}
@@ -0,0 +1,106 @@
+package push
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"talkbox/config"
+)
+
+// 设备平台，与 device_tokens.platform 一致
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+)
+
+// Notification 是发往单个设备的通知
+type Notification struct {
+	Platform string
+	Token    string
+	Title    string
+	Body     string
+	Badge    int
+	// ThreadID 用于在系统通知栏按会话分组
+	ThreadID string
+	Data     map[string]string
+
+	attempt int
+}
+
+// Result 是单个通知的发送结果
+type Result struct {
+	Err error
+	// Invalid 表示设备 Token 已失效，应从数据库中删除
+	Invalid bool
+	// Retryable 表示临时错误（限流、服务不可用等），可稍后重试
+	Retryable bool
+}
+
+// Provider 是推送服务（APNs、FCM）的抽象
+type Provider interface {
+	Platform() string
+	// Send 发送一批通知，返回的结果与 notifications 一一对应
+	Send(ctx context.Context, notifications []*Notification) []Result
+}
+
+// Default 是全局的推送分发器，未配置任何推送服务时为 nil
+var Default *Dispatcher
+
+// Init 按配置创建推送服务并启动分发器
+func Init() error {
+	var providers []Provider
+
+	if config.Cfg.APNsKeyFile != "" {
+		apns, err := NewAPNsProvider(config.Cfg.APNsKeyFile, config.Cfg.APNsKeyID, config.Cfg.APNsTeamID,
+			config.Cfg.APNsTopic, config.Cfg.APNsSandbox)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, apns)
+	}
+
+	if config.Cfg.FCMCredentialsFile != "" {
+		fcm, err := NewFCMProvider(config.Cfg.FCMCredentialsFile)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, fcm)
+	}
+
+	if len(providers) == 0 {
+		log.Println("Push notifications disabled: no provider configured")
+		return nil
+	}
+
+	Default = NewDispatcher(providers...)
+	Default.Start()
+	return nil
+}
+
+// Enqueue 将推送任务交给全局分发器，未启用推送时忽略
+func Enqueue(job *Job) {
+	if Default != nil {
+		Default.Enqueue(job)
+	}
+}
+
+// sendConcurrently 以固定并发数逐个发送，供不支持批量接口的推送服务使用
+func sendConcurrently(notifications []*Notification, workers int, send func(*Notification) Result) []Result {
+	results := make([]Result, len(notifications))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for i, n := range notifications {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, n *Notification) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = send(n)
+		}(i, n)
+	}
+
+	wg.Wait()
+	return results
+}
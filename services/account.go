@@ -0,0 +1,142 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"talkbox/database"
+	"talkbox/utils"
+)
+
+// 重置令牌由管理员通过其他渠道交给用户，有效期较短
+const passwordResetTTL = time.Hour
+
+var (
+	ErrWrongPassword     = errors.New("password is incorrect")
+	ErrSamePassword      = errors.New("new password must differ from the current password")
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+	ErrUserNotFound      = errors.New("user not found")
+)
+
+// VerifyPassword 校验用户的当前密码
+func VerifyPassword(userID, password string) error {
+	var hash string
+	err := database.DB.QueryRow("SELECT password FROM users WHERE id = ? AND deleted_at IS NULL", userID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// ChangePassword 校验当前密码后修改密码，并下线当前会话以外的所有会话
+func ChangePassword(userID, sessionID, current, next string) error {
+	if err := VerifyPassword(userID, current); err != nil {
+		return err
+	}
+	if current == next {
+		return ErrSamePassword
+	}
+
+	if err := setPassword(database.DB, userID, next); err != nil {
+		return err
+	}
+	_, err := RevokeOtherSessions(userID, sessionID)
+	return err
+}
+
+// CreatePasswordReset 由管理员为用户生成一次性的密码重置令牌，之前未使用的令牌随即作废
+func CreatePasswordReset(userID, adminID string) (string, time.Time, error) {
+	var exists bool
+	err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND deleted_at IS NULL)", userID).Scan(&exists)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !exists {
+		return "", time.Time{}, ErrUserNotFound
+	}
+
+	token := utils.GeneratePasswordResetToken()
+	now := time.Now()
+	expiresAt := now.Add(passwordResetTTL)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = ?", userID); err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO password_resets (token_hash, user_id, created_by, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		utils.HashToken(token), userID, adminID, expiresAt, now,
+	); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// ResetPassword 使用重置令牌设置新密码，并下线该用户的所有会话
+func ResetPassword(token, password string) error {
+	tokenHash := utils.HashToken(token)
+	now := time.Now()
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(`
+		SELECT r.user_id FROM password_resets r
+		JOIN users u ON u.id = r.user_id AND u.deleted_at IS NULL
+		WHERE r.token_hash = ? AND r.used_at IS NULL AND r.expires_at > ?
+		FOR UPDATE
+	`, tokenHash, now).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE token_hash = ?", now, tokenHash); err != nil {
+		return err
+	}
+	if err := setPassword(tx, userID, password); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	_, err = RevokeOtherSessions(userID, "")
+	return err
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func setPassword(db execer, userID, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET password = ?, updated_at = ? WHERE id = ?", string(hashed), time.Now(), userID)
+	return err
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// AttemptStore 记录登录失败次数和锁定状态。单节点使用内存实现，
+// 多节点部署时使用 Redis 实现，使攻击者无法通过轮换节点绕过限制
+type AttemptStore interface {
+	// Get 返回 key 在窗口内的失败次数和锁定截止时间，未锁定时为零值
+	Get(key string) (failures int, lockedUntil time.Time, err error)
+	// Fail 记录一次失败并返回累计次数，window 内没有新的失败时计数清零
+	Fail(key string, window time.Duration) (int, error)
+	// Lock 锁定 key 直到 until，锁定期间计数保留
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+}
+
+type attemptRecord struct {
+	failures    int
+	lockedUntil time.Time
+	expiresAt   time.Time
+}
+
+// memoryAttemptStore 保存在本进程内，即单节点部署的行为
+type memoryAttemptStore struct {
+	mu      sync.Mutex
+	records map[string]*attemptRecord
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	return &memoryAttemptStore{records: make(map[string]*attemptRecord)}
+}
+
+func (s *memoryAttemptStore) Get(key string) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.live(key, time.Now())
+	if r == nil {
+		return 0, time.Time{}, nil
+	}
+	return r.failures, r.lockedUntil, nil
+}
+
+func (s *memoryAttemptStore) Fail(key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+	r := s.live(key, now)
+	if r == nil {
+		r = &attemptRecord{}
+		s.records[key] = r
+	}
+	r.failures++
+	if expiresAt := now.Add(window); expiresAt.After(r.expiresAt) {
+		r.expiresAt = expiresAt
+	}
+	return r.failures, nil
+}
+
+func (s *memoryAttemptStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.live(key, time.Now())
+	if r == nil {
+		r = &attemptRecord{}
+		s.records[key] = r
+	}
+	r.lockedUntil = until
+	if until.After(r.expiresAt) {
+		r.expiresAt = until
+	}
+	return nil
+}
+
+func (s *memoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+// live 返回未过期的记录，调用方需持有锁
+func (s *memoryAttemptStore) live(key string, now time.Time) *attemptRecord {
+	r := s.records[key]
+	if r == nil || now.After(r.expiresAt) {
+		return nil
+	}
+	return r
+}
+
+// prune 清理过期的记录，避免大量不同的用户名或 IP 使内存无限增长
+func (s *memoryAttemptStore) prune(now time.Time) {
+	for key, r := range s.records {
+		if now.After(r.expiresAt) {
+			delete(s.records, key)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisAttemptPrefix  = "talkbox:login_attempts:"
+	redisAttemptTimeout = 2 * time.Second
+)
+
+// redisAttemptStore 将计数保存在 Redis 哈希中，字段 failures 为失败次数，locked_until 为锁定截止的 Unix 毫秒
+type redisAttemptStore struct {
+	client *redis.Client
+}
+
+func NewRedisAttemptStore(client *redis.Client) AttemptStore {
+	return &redisAttemptStore{client: client}
+}
+
+func (s *redisAttemptStore) Get(key string) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisAttemptTimeout)
+	defer cancel()
+
+	values, err := s.client.HMGet(ctx, redisAttemptPrefix+key, "failures", "locked_until").Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var failures int
+	var lockedUntil time.Time
+	if v, ok := values[0].(string); ok {
+		failures, _ = strconv.Atoi(v)
+	}
+	if v, ok := values[1].(string); ok {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			lockedUntil = time.UnixMilli(ms)
+		}
+	}
+	return failures, lockedUntil, nil
+}
+
+func (s *redisAttemptStore) Fail(key string, window time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisAttemptTimeout)
+	defer cancel()
+
+	redisKey := redisAttemptPrefix + key
+	failures, err := s.client.HIncrBy(ctx, redisKey, "failures", 1).Result()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.extendTTL(ctx, redisKey, window); err != nil {
+		return 0, err
+	}
+	return int(failures), nil
+}
+
+func (s *redisAttemptStore) Lock(key string, until time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisAttemptTimeout)
+	defer cancel()
+
+	redisKey := redisAttemptPrefix + key
+	if err := s.client.HSet(ctx, redisKey, "locked_until", until.UnixMilli()).Err(); err != nil {
+		return err
+	}
+	return s.extendTTL(ctx, redisKey, time.Until(until))
+}
+
+func (s *redisAttemptStore) Reset(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisAttemptTimeout)
+	defer cancel()
+
+	return s.client.Del(ctx, redisAttemptPrefix+key).Err()
+}
+
+// extendTTL 将 key 的过期时间延长到至少 d，已有更长的过期时间时保持不变，
+// 短暂的退避锁定不会使失败计数提前过期
+func (s *redisAttemptStore) extendTTL(ctx context.Context, key string, d time.Duration) error {
+	ttl, err := s.client.TTL(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if ttl >= d {
+		return nil
+	}
+	return s.client.Expire(ctx, key, d).Err()
+}
@@ -0,0 +1,30 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"talkbox/database"
+)
+
+// 审计事件
+const (
+	AuditLoginLockout      = "login_lockout"
+	AuditTwoFactorEnabled  = "two_factor_enabled"
+	AuditTwoFactorDisabled = "two_factor_disabled"
+	AuditTwoFactorReset    = "two_factor_reset" // 管理员为用户关闭两步验证
+	AuditRecoveryCodeUsed  = "recovery_code_used"
+	AuditRequireTwoFactor  = "require_two_factor_changed"
+)
+
+// RecordAudit 写入一条审计记录，userID 为空表示无法对应到用户。写入失败只记录日志，不影响调用方
+func RecordAudit(userID, action, ip, detail string) {
+	_, err := database.DB.Exec(
+		"INSERT INTO audit_logs (user_id, action, ip, detail, created_at) VALUES (?, ?, ?, ?, ?)",
+		sql.NullString{String: userID, Valid: userID != ""}, action, truncate(ip, 64), truncate(detail, 255), time.Now(),
+	)
+	if err != nil {
+		log.Printf("failed to record audit %s for user %q: %v", action, userID, err)
+	}
+}
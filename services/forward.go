@@ -0,0 +1,198 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"talkbox/models"
+)
+
+const (
+	maxForwardMessages = 100
+	maxForwardTargets  = 20
+)
+
+// ForwardFailure 描述转发到某个目标会话失败的原因
+type ForwardFailure struct {
+	ConversationID string `json:"conversation_id"`
+	Error          string `json:"error"`
+}
+
+// ForwardMessages 将同一会话中的若干消息转发到多个目标会话，调用者必须是来源和所有目标会话的成员。
+// 逐条转发时每条消息保留最初的发送者和会话；合并转发时打包为一条 merged 消息，内容为各条消息的快照。
+// 消息按原发送时间排序，某个目标会话失败不影响其他目标
+func ForwardMessages(userID string, messageIDs, targetIDs []string, merged bool) ([]*models.MessageResponse, []ForwardFailure, error) {
+	messageIDs = uniqueStrings(messageIDs)
+	targetIDs = uniqueStrings(targetIDs)
+
+	verr := &ValidationError{}
+	if len(messageIDs) == 0 || len(messageIDs) > maxForwardMessages {
+		verr.add("message_ids", "out_of_range", "must contain between 1 and 100 messages")
+	}
+	if len(targetIDs) == 0 || len(targetIDs) > maxForwardTargets {
+		verr.add("conversation_ids", "out_of_range", "must contain between 1 and 20 conversations")
+	}
+	if err := verr.orNil(); err != nil {
+		return nil, nil, err
+	}
+
+	loaded, err := LoadMessages(messageIDs, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sources := make([]*models.MessageResponse, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		msg, ok := loaded[id]
+		if !ok || msg.RecalledAt != nil {
+			verr.add("message_ids", "not_found", "refers to a message that does not exist")
+			return nil, nil, verr
+		}
+		sources = append(sources, msg)
+	}
+
+	sourceConvID := sources[0].ConversationID
+	for _, msg := range sources {
+		if msg.ConversationID != sourceConvID {
+			verr.add("message_ids", "invalid", "must belong to the same conversation")
+			return nil, nil, verr
+		}
+	}
+
+	for _, convID := range append([]string{sourceConvID}, targetIDs...) {
+		isMember, err := isSenderMember(convID, userID, "user")
+		if err != nil {
+			return nil, nil, err
+		}
+		if !isMember {
+			return nil, nil, ErrNotMember
+		}
+	}
+
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].CreatedAt.Equal(sources[j].CreatedAt) {
+			return sources[i].ID < sources[j].ID
+		}
+		return sources[i].CreatedAt.Before(sources[j].CreatedAt)
+	})
+
+	var inputs []SendMessageInput
+	if merged {
+		input, err := mergedInput(userID, sourceConvID, sources)
+		if err != nil {
+			return nil, nil, err
+		}
+		inputs = append(inputs, *input)
+	} else {
+		for _, msg := range sources {
+			input, err := forwardInput(userID, msg)
+			if err != nil {
+				return nil, nil, err
+			}
+			inputs = append(inputs, *input)
+		}
+	}
+
+	var sent []*models.MessageResponse
+	var failed []ForwardFailure
+	for _, targetID := range targetIDs {
+		for _, input := range inputs {
+			input.ConversationID = targetID
+			msg, err := SendMessage(&input)
+			if err != nil {
+				failed = append(failed, ForwardFailure{ConversationID: targetID, Error: forwardError(err)})
+				break
+			}
+			sent = append(sent, msg)
+		}
+	}
+
+	return sent, failed, nil
+}
+
+// forwardInput 生成逐条转发的消息。文本中的 @ 只对原会话有意义，转发时去掉
+func forwardInput(userID string, msg *models.MessageResponse) (*SendMessageInput, error) {
+	origin := msg.ForwardedFrom
+	if origin == nil {
+		origin = &models.ForwardInfo{
+			MessageID:      msg.ID,
+			ConversationID: msg.ConversationID,
+			Sender:         msg.Sender,
+			CreatedAt:      msg.CreatedAt,
+		}
+	}
+
+	content := msg.Content
+	if msg.Type == "text" {
+		var text models.TextContent
+		if err := json.Unmarshal(content, &text); err != nil {
+			return nil, err
+		}
+		text.Mentions = nil
+		data, err := json.Marshal(text)
+		if err != nil {
+			return nil, err
+		}
+		content = data
+	}
+
+	return &SendMessageInput{
+		SenderID:      userID,
+		SenderType:    "user",
+		Type:          msg.Type,
+		Content:       content,
+		forwardedFrom: origin,
+		// 合并转发的内容由服务端生成，不接受客户端提交，因此不走内容校验
+		trusted: msg.Type == models.MessageTypeMerged,
+	}, nil
+}
+
+func mergedInput(userID, sourceConvID string, sources []*models.MessageResponse) (*SendMessageInput, error) {
+	content := models.MergedContent{
+		ConversationID: sourceConvID,
+		Messages:       make([]models.MergedMessage, 0, len(sources)),
+	}
+	for _, msg := range sources {
+		content.Messages = append(content.Messages, models.MergedMessage{
+			ID:        msg.ID,
+			Sender:    msg.Sender,
+			Type:      msg.Type,
+			Content:   msg.Content,
+			CreatedAt: msg.CreatedAt,
+		})
+	}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SendMessageInput{
+		SenderID:   userID,
+		SenderType: "user",
+		Type:       models.MessageTypeMerged,
+		Content:    data,
+		trusted:    true,
+	}, nil
+}
+
+func forwardError(err error) string {
+	var validationErr *ValidationError
+	if errors.Is(err, ErrNotMember) || errors.As(err, &validationErr) {
+		return err.Error()
+	}
+	return "failed to send message"
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var result []string
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"talkbox/config"
+	"talkbox/database"
+)
+
+// loginPolicy 描述一类 key 的限制：前 freeAttempts 次失败不受限制，之后每次失败按指数退避锁定
+// 1s、2s、4s……最长 maxBackoff；累计 lockoutAfter 次失败后锁定 lockout 并写入审计记录。
+// window 内没有新的失败时计数清零
+type loginPolicy struct {
+	prefix       string
+	freeAttempts int
+	lockoutAfter int
+	maxBackoff   time.Duration
+	lockout      time.Duration
+	window       time.Duration
+}
+
+var (
+	// 针对单个账号的猜测密码
+	usernamePolicy = loginPolicy{
+		prefix:       "user:",
+		freeAttempts: 3,
+		lockoutAfter: 10,
+		maxBackoff:   time.Minute,
+		lockout:      15 * time.Minute,
+		window:       time.Hour,
+	}
+	// 同一来源尝试大量账号。NAT 后的多个用户共享 IP，阈值更宽松
+	ipPolicy = loginPolicy{
+		prefix:       "ip:",
+		freeAttempts: 20,
+		lockoutAfter: 100,
+		maxBackoff:   time.Minute,
+		lockout:      15 * time.Minute,
+		window:       time.Hour,
+	}
+)
+
+var loginAttempts AttemptStore = newMemoryAttemptStore()
+
+// InitLoginGuard 按配置选择登录失败计数的存储后端
+func InitLoginGuard() error {
+	if config.Cfg.LoginLimiter == "redis" {
+		if database.Redis == nil {
+			return errors.New("redis is not connected")
+		}
+		loginAttempts = NewRedisAttemptStore(database.Redis)
+	}
+	return nil
+}
+
+// CheckLogin 返回用户名或 IP 剩余的锁定时间，未锁定时为 0。
+// 在查询用户之前调用，用户名是否存在都走同样的路径。存储不可用时放行，只记录日志
+func CheckLogin(username, ip string) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range loginKeys(username, ip) {
+		_, lockedUntil, err := loginAttempts.Get(k.key)
+		if err != nil {
+			log.Printf("failed to check login attempts of %s: %v", k.key, err)
+			continue
+		}
+		if d := lockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// RecordLoginFailure 为用户名和 IP 各记录一次失败，返回因此产生的锁定时间，未锁定时为 0。
+// userID 为空表示用户名不存在，用户名仍然计数，使不存在的账号与存在的账号表现一致
+func RecordLoginFailure(username, ip, userID string) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range loginKeys(username, ip) {
+		failures, err := loginAttempts.Fail(k.key, k.policy.window)
+		if err != nil {
+			log.Printf("failed to record login failure of %s: %v", k.key, err)
+			continue
+		}
+		d := k.policy.delay(failures)
+		if d == 0 {
+			continue
+		}
+		if err := loginAttempts.Lock(k.key, now.Add(d)); err != nil {
+			log.Printf("failed to lock %s: %v", k.key, err)
+			continue
+		}
+		if d > wait {
+			wait = d
+		}
+
+		if failures >= k.policy.lockoutAfter {
+			auditUserID := ""
+			if k.policy == usernamePolicy {
+				auditUserID = userID
+			}
+			RecordAudit(auditUserID, AuditLoginLockout, ip,
+				fmt.Sprintf("%s locked for %s after %d failed logins", k.key, d, failures))
+		}
+	}
+	return wait
+}
+
+// RecordLoginSuccess 清除用户名的失败计数。IP 的计数不清除，否则攻击者可以用自己的账号登录来重置
+func RecordLoginSuccess(username string) {
+	key := usernamePolicy.prefix + normalizeUsername(username)
+	if err := loginAttempts.Reset(key); err != nil {
+		log.Printf("failed to reset login attempts of %s: %v", key, err)
+	}
+}
+
+// delay 返回第 failures 次失败后的锁定时间
+func (p loginPolicy) delay(failures int) time.Duration {
+	if failures >= p.lockoutAfter {
+		return p.lockout
+	}
+	if failures <= p.freeAttempts {
+		return 0
+	}
+	exp := failures - p.freeAttempts - 1
+	if exp >= 32 {
+		return p.maxBackoff
+	}
+	return min(time.Duration(math.Pow(2, float64(exp)))*time.Second, p.maxBackoff)
+}
+
+type loginKey struct {
+	key    string
+	policy loginPolicy
+}
+
+// loginKeys 返回一次登录需要检查和计数的 key：用户名和来源 IP
+func loginKeys(username, ip string) []loginKey {
+	return []loginKey{
+		{key: usernamePolicy.prefix + normalizeUsername(username), policy: usernamePolicy},
+		{key: ipPolicy.prefix + ip, policy: ipPolicy},
+	}
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
@@ -0,0 +1,516 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"talkbox/database"
+	"talkbox/models"
+	"talkbox/utils"
+	"talkbox/websocket"
+)
+
+var ErrNotMember = errors.New("not a member of this conversation")
+
+// SendMessageInput 是 REST、WebSocket 和 Bot 三个入口共用的发送参数
+type SendMessageInput struct {
+	ConversationID string
+	SenderID       string
+	SenderType     string // user, bot
+	Type           string
+	Content        json.RawMessage
+	ReplyToID      string
+	ThreadRootID   string // 可选，回复到该根消息的话题中
+	ClientMsgID    string // 可选，同一发送者在同一会话中唯一，重试时返回已存在的消息
+
+	// 以下只由转发设置：转发来源，以及服务端生成的合并转发内容无需再校验
+	forwardedFrom *models.ForwardInfo
+	trusted       bool
+}
+
+const maxClientMsgIDLength = 64
+
+// SendMessage 校验并在事务中写入消息、提及记录和会话更新时间，
+// 提交后向会话成员广播完整的 new_message（话题回复改为 thread_reply / thread_updated），并向被提及的用户发送 mentioned
+func SendMessage(in *SendMessageInput) (*models.MessageResponse, error) {
+	isMember, err := isSenderMember(in.ConversationID, in.SenderID, in.SenderType)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrNotMember
+	}
+
+	if len(in.ClientMsgID) > maxClientMsgIDLength {
+		verr := &ValidationError{}
+		verr.add("client_msg_id", "too_long", "must be at most 64 characters")
+		return nil, verr
+	}
+
+	// 客户端重试：直接返回已存在的消息，不重复写入和广播
+	if in.ClientMsgID != "" {
+		existing, err := findByClientMsgID(in)
+		if err != nil || existing != nil {
+			return existing, err
+		}
+	}
+
+	if err := validateSendInput(in); err != nil {
+		return nil, err
+	}
+
+	mentions := ParseMentions(in.Type, in.Content)
+
+	msgID := utils.GenerateUUID()
+	now := time.Now()
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var fwdMessageID, fwdConversationID, fwdSenderID, fwdSenderType sql.NullString
+	var fwdCreatedAt sql.NullTime
+	if f := in.forwardedFrom; f != nil {
+		fwdMessageID = sql.NullString{String: f.MessageID, Valid: true}
+		fwdConversationID = sql.NullString{String: f.ConversationID, Valid: true}
+		fwdSenderID = sql.NullString{String: f.Sender.ID, Valid: true}
+		fwdSenderType = sql.NullString{String: f.Sender.Type, Valid: true}
+		fwdCreatedAt = sql.NullTime{Time: f.CreatedAt, Valid: true}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO messages (id, conversation_id, sender_id, sender_type, type, content, reply_to_id, thread_root_id, client_msg_id,
+			forwarded_message_id, forwarded_conversation_id, forwarded_sender_id, forwarded_sender_type, forwarded_created_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, msgID, in.ConversationID, in.SenderID, in.SenderType, in.Type, string(in.Content),
+		sql.NullString{String: in.ReplyToID, Valid: in.ReplyToID != ""},
+		sql.NullString{String: in.ThreadRootID, Valid: in.ThreadRootID != ""},
+		sql.NullString{String: in.ClientMsgID, Valid: in.ClientMsgID != ""},
+		fwdMessageID, fwdConversationID, fwdSenderID, fwdSenderType, fwdCreatedAt, now, now)
+	if err != nil {
+		// 并发重试同时到达时由唯一索引兜底
+		var mysqlErr *mysql.MySQLError
+		if in.ClientMsgID != "" && errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+			tx.Rollback()
+			return findByClientMsgID(in)
+		}
+		return nil, err
+	}
+
+	for _, mentionedUserID := range mentions {
+		_, err := tx.Exec(
+			"INSERT INTO mentions (id, message_id, user_id, created_at) VALUES (?, ?, ?, ?)",
+			utils.GenerateUUID(), msgID, mentionedUserID, now,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if in.ThreadRootID != "" {
+		if err := addThreadParticipants(tx, in, msgID, mentions, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE conversations SET updated_at = ? WHERE id = ?", now, in.ConversationID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	changes := []Change{{ConversationID: in.ConversationID, Entity: EntityMessage, EntityID: msgID, Action: ChangeUpsert}}
+	if in.ThreadRootID != "" {
+		// 根消息上的回复数和参与者随之变化
+		changes = append(changes, Change{ConversationID: in.ConversationID, Entity: EntityMessage, EntityID: in.ThreadRootID, Action: ChangeUpsert})
+	}
+	RecordChanges(changes...)
+
+	loaded, err := LoadMessages([]string{msgID}, "")
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := loaded[msgID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	if in.SenderType == "user" {
+		websocket.HubInstance.StopTyping(in.ConversationID, in.SenderID)
+	}
+
+	if in.ThreadRootID != "" {
+		broadcastThreadReply(msg)
+	} else {
+		websocket.BroadcastToConversation(in.ConversationID, &websocket.Message{
+			Event: "new_message",
+			Data:  msg,
+		})
+	}
+
+	SendMentionEvents(msg, mentions)
+
+	go notifyRecipients(msg, mentions)
+
+	return msg, nil
+}
+
+// SendMentionEvents 向被提及的用户发送 mentioned，静音了该会话的用户除外
+func SendMentionEvents(msg *models.MessageResponse, userIDs []string) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	mentionedEvent := map[string]interface{}{
+		"message_id":      msg.ID,
+		"conversation_id": msg.ConversationID,
+		"sender_name":     msg.Sender.Nickname,
+	}
+	if msg.ThreadRootID != "" {
+		mentionedEvent["thread_root_id"] = msg.ThreadRootID
+	}
+	muted := mutedMembers(msg.ConversationID, userIDs)
+	for _, userID := range userIDs {
+		if muted[userID] {
+			continue
+		}
+		websocket.HubInstance.SendToUser(userID, &websocket.Message{
+			Event: "mentioned",
+			Data:  mentionedEvent,
+		})
+	}
+}
+
+const mysqlErrDuplicateEntry = 1062
+
+// validateSendInput 校验消息内容以及引用消息、话题根消息是否有效，不检查发送者身份
+func validateSendInput(in *SendMessageInput) error {
+	if !in.trusted {
+		if err := ValidateContent(in.ConversationID, in.Type, in.Content); err != nil {
+			return err
+		}
+	}
+
+	if in.ReplyToID != "" {
+		var exists bool
+		err := database.DB.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND conversation_id = ? AND recalled_at IS NULL)",
+			in.ReplyToID, in.ConversationID,
+		).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			verr := &ValidationError{}
+			verr.add("reply_to_id", "not_found", "refers to a message that does not exist in this conversation")
+			return verr
+		}
+	}
+
+	if in.ThreadRootID != "" {
+		return validateThreadRoot(in.ConversationID, in.ThreadRootID)
+	}
+	return nil
+}
+
+func findByClientMsgID(in *SendMessageInput) (*models.MessageResponse, error) {
+	var msgID string
+	err := database.DB.QueryRow(
+		"SELECT id FROM messages WHERE sender_id = ? AND conversation_id = ? AND client_msg_id = ?",
+		in.SenderID, in.ConversationID, in.ClientMsgID,
+	).Scan(&msgID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	loaded, err := LoadMessages([]string{msgID}, "")
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := loaded[msgID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return msg, nil
+}
+
+func isSenderMember(convID, senderID, senderType string) (bool, error) {
+	query := "SELECT EXISTS(SELECT 1 FROM conversation_members WHERE conversation_id = ? AND user_id = ?)"
+	if senderType == "bot" {
+		query = "SELECT EXISTS(SELECT 1 FROM bot_conversations WHERE conversation_id = ? AND bot_id = ?)"
+	} else if senderType != "user" {
+		return false, nil
+	}
+
+	var exists bool
+	err := database.DB.QueryRow(query, convID, senderID).Scan(&exists)
+	return exists, err
+}
+
+// ParseMentions 解析文本消息中的 @ 用户列表并去重
+func ParseMentions(msgType string, content json.RawMessage) []string {
+	if msgType != "text" {
+		return nil
+	}
+
+	var textContent models.TextContent
+	if err := json.Unmarshal(content, &textContent); err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var mentions []string
+	for _, userID := range textContent.Mentions {
+		if userID == "" || seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		mentions = append(mentions, userID)
+	}
+	return mentions
+}
+
+// LoadMessages 按 ID 批量加载完整的消息：发送者、引用消息、话题聚合和置顶状态，viewerID 非空时附带表情聚合。
+// 返回 ID 到消息的映射，不存在的 ID 会被忽略
+func LoadMessages(ids []string, viewerID string) (map[string]*models.MessageResponse, error) {
+	result := make(map[string]*models.MessageResponse)
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	placeholders, args := InClause(ids)
+
+	// 使用 LEFT JOIN 一次性获取消息和发送者信息，解决 N+1 问题
+	rows, err := database.DB.Query(`
+		SELECT m.id, m.conversation_id, m.sender_id, m.sender_type, m.type, m.content, m.reply_to_id, COALESCE(m.thread_root_id, ''), m.edited_at, m.recalled_at, COALESCE(m.recalled_by, ''), COALESCE(m.client_msg_id, ''), m.created_at,
+			   COALESCE(u.nickname, ''), COALESCE(u.avatar, ''), u.deleted_at IS NOT NULL, COALESCE(b.name, ''), COALESCE(b.avatar, ''),
+			   m.forwarded_message_id, COALESCE(m.forwarded_conversation_id, ''), COALESCE(fc.name, ''),
+			   COALESCE(m.forwarded_sender_id, ''), COALESCE(m.forwarded_sender_type, ''), m.forwarded_created_at,
+			   COALESCE(fu.nickname, fb.name, ''), COALESCE(fu.avatar, fb.avatar, '')
+		FROM messages m
+		LEFT JOIN users u ON m.sender_type = 'user' AND m.sender_id = u.id
+		LEFT JOIN bots b ON m.sender_type = 'bot' AND m.sender_id = b.id
+		LEFT JOIN conversations fc ON fc.id = m.forwarded_conversation_id
+		LEFT JOIN users fu ON m.forwarded_sender_type = 'user' AND m.forwarded_sender_id = fu.id
+		LEFT JOIN bots fb ON m.forwarded_sender_type = 'bot' AND m.forwarded_sender_id = fb.id
+		WHERE m.id IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replyIDs, rootIDs []string
+	for rows.Next() {
+		var msg models.MessageResponse
+		var senderType string
+		var contentJSON []byte
+		var replyToID sql.NullString
+		var editedAt, recalledAt sql.NullTime
+		var userNickname, userAvatar, botName, botAvatar string
+		var userDeleted sql.NullBool
+		var fwdMessageID sql.NullString
+		var fwdCreatedAt sql.NullTime
+		var fwd models.ForwardInfo
+
+		if err := rows.Scan(&msg.ID, &msg.ConversationID, &msg.Sender.ID, &senderType, &msg.Type, &contentJSON, &replyToID, &msg.ThreadRootID,
+			&editedAt, &recalledAt, &msg.RecalledBy, &msg.ClientMsgID, &msg.CreatedAt, &userNickname, &userAvatar, &userDeleted, &botName, &botAvatar,
+			&fwdMessageID, &fwd.ConversationID, &fwd.ConversationName, &fwd.Sender.ID, &fwd.Sender.Type, &fwdCreatedAt,
+			&fwd.Sender.Nickname, &fwd.Sender.Avatar); err != nil {
+			continue
+		}
+		if fwdMessageID.Valid {
+			fwd.MessageID = fwdMessageID.String
+			fwd.CreatedAt = fwdCreatedAt.Time
+			msg.ForwardedFrom = &fwd
+		}
+
+		msg.Content = json.RawMessage(contentJSON)
+		msg.Sender.Type = senderType
+		if senderType == "user" {
+			msg.Sender.Nickname = userNickname
+			msg.Sender.Avatar = userAvatar
+			msg.Sender.Deleted = userDeleted.Bool
+		} else {
+			msg.Sender.Nickname = botName
+			msg.Sender.Avatar = botAvatar
+		}
+		if replyToID.Valid {
+			msg.ReplyToID = replyToID.String
+			replyIDs = append(replyIDs, replyToID.String)
+		}
+		if editedAt.Valid {
+			msg.EditedAt = &editedAt.Time
+		}
+		if recalledAt.Valid {
+			msg.RecalledAt = &recalledAt.Time
+		}
+		if msg.ThreadRootID == "" {
+			rootIDs = append(rootIDs, msg.ID)
+		}
+
+		result[msg.ID] = &msg
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(replyIDs) > 0 {
+		replies, err := loadReplies(replyIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range result {
+			if msg.ReplyToID != "" {
+				msg.ReplyTo = replies[msg.ReplyToID]
+			}
+		}
+	}
+
+	pinned, err := loadPinned(ids)
+	if err != nil {
+		return nil, err
+	}
+	for id := range pinned {
+		if msg, ok := result[id]; ok {
+			msg.Pinned = true
+		}
+	}
+
+	if len(rootIDs) > 0 {
+		summaries, err := loadThreadSummaries(rootIDs, viewerID)
+		if err != nil {
+			return nil, err
+		}
+		for id, summary := range summaries {
+			result[id].ThreadSummary = summary
+		}
+	}
+
+	if viewerID != "" {
+		reactions, err := LoadReactions(ids, viewerID)
+		if err != nil {
+			return nil, err
+		}
+		for id, msg := range result {
+			msg.Reactions = reactions[id]
+		}
+	}
+
+	return result, nil
+}
+
+// loadReplies 批量查询被引用消息的摘要信息
+func loadReplies(ids []string) (map[string]*models.ReplyInfo, error) {
+	placeholders, args := InClause(ids)
+
+	rows, err := database.DB.Query(`
+		SELECT m.id, m.type, m.content, m.sender_type, m.recalled_at IS NOT NULL,
+			   COALESCE(u.nickname, '') as user_nickname,
+			   COALESCE(b.name, '') as bot_name
+		FROM messages m
+		LEFT JOIN users u ON m.sender_type = 'user' AND m.sender_id = u.id
+		LEFT JOIN bots b ON m.sender_type = 'bot' AND m.sender_id = b.id
+		WHERE m.id IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]*models.ReplyInfo)
+	for rows.Next() {
+		var reply models.ReplyInfo
+		var senderType, userNickname, botName string
+		var content []byte
+
+		if err := rows.Scan(&reply.ID, &reply.Type, &content, &senderType, &reply.Recalled, &userNickname, &botName); err != nil {
+			continue
+		}
+
+		reply.Content = json.RawMessage(content)
+		if senderType == "user" {
+			reply.SenderName = userNickname
+		} else {
+			reply.SenderName = botName
+		}
+		result[reply.ID] = &reply
+	}
+
+	return result, rows.Err()
+}
+
+// loadPinned 返回 ids 中已置顶的消息
+func loadPinned(ids []string) (map[string]bool, error) {
+	placeholders, args := InClause(ids)
+	rows, err := database.DB.Query("SELECT message_id FROM message_pins WHERE message_id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pinned := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		pinned[id] = true
+	}
+	return pinned, rows.Err()
+}
+
+// LoadReactions 批量查询多条消息的表情聚合，避免逐条查询
+func LoadReactions(msgIDs []string, userID string) (map[string][]models.ReactionSummary, error) {
+	result := make(map[string][]models.ReactionSummary)
+	if len(msgIDs) == 0 {
+		return result, nil
+	}
+
+	placeholders, idArgs := InClause(msgIDs)
+	args := append([]interface{}{userID}, idArgs...)
+
+	rows, err := database.DB.Query(`
+		SELECT message_id, emoji, COUNT(*), SUM(user_id = ?) > 0
+		FROM message_reactions
+		WHERE message_id IN (`+placeholders+`)
+		GROUP BY message_id, emoji
+		ORDER BY MIN(created_at)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msgID string
+		var summary models.ReactionSummary
+		if err := rows.Scan(&msgID, &summary.Emoji, &summary.Count, &summary.Reacted); err != nil {
+			continue
+		}
+		result[msgID] = append(result[msgID], summary)
+	}
+
+	return result, rows.Err()
+}
+
+// InClause 生成 IN 子句的占位符和参数，ids 不能为空
+func InClause(ids []string) (string, []interface{}) {
+	placeholders := strings.Repeat("?,", len(ids)-1) + "?"
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return placeholders, args
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"talkbox/database"
+	"talkbox/models"
+	"talkbox/push"
+	"talkbox/websocket"
+)
+
+// notifyRecipients 为没有在线连接的成员以及被 @ 的成员生成推送任务，发送者本人不推送。
+// 静音中的会话不推送；仅提及模式只推送 @ 自己的消息；处于免打扰时段的用户不推送。
+// 话题回复只推送给话题参与者
+func notifyRecipients(msg *models.MessageResponse, mentions []string) {
+	if push.Default == nil {
+		return
+	}
+
+	var convType, convName string
+	err := database.DB.QueryRow(
+		"SELECT type, COALESCE(name, '') FROM conversations WHERE id = ?",
+		msg.ConversationID,
+	).Scan(&convType, &convName)
+	if err != nil {
+		log.Printf("failed to load conversation for push: %v", err)
+		return
+	}
+
+	query := `
+		SELECT m.user_id, m.notify_level, m.muted_until,
+			u.dnd_enabled, u.dnd_start, u.dnd_end, u.timezone
+		FROM conversation_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.conversation_id = ?`
+	args := []interface{}{msg.ConversationID}
+	if msg.ThreadRootID != "" {
+		query += " AND m.user_id IN (SELECT user_id FROM thread_participants WHERE thread_root_id = ?)"
+		args = append(args, msg.ThreadRootID)
+	}
+
+	now := time.Now()
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("failed to load members for push: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	mentioned := make(map[string]bool, len(mentions))
+	for _, userID := range mentions {
+		mentioned[userID] = true
+	}
+
+	for rows.Next() {
+		var userID, level string
+		var mutedUntil sql.NullTime
+		var settings models.NotificationSettings
+		err := rows.Scan(&userID, &level, &mutedUntil,
+			&settings.DNDEnabled, &settings.DNDStart, &settings.DNDEnd, &settings.Timezone)
+		if err != nil {
+			continue
+		}
+		if msg.Sender.Type == "user" && userID == msg.Sender.ID {
+			continue
+		}
+		if mutedUntil.Valid && mutedUntil.Time.After(now) {
+			continue
+		}
+		if level == models.NotifyMentions && !mentioned[userID] {
+			continue
+		}
+		if settings.InQuietHours(now) {
+			continue
+		}
+		if !mentioned[userID] && websocket.HubInstance.IsOnline(userID) {
+			continue
+		}
+
+		push.Enqueue(&push.Job{
+			UserID:           userID,
+			ConversationID:   msg.ConversationID,
+			ConversationType: convType,
+			ConversationName: convName,
+			MessageID:        msg.ID,
+			MessageType:      msg.Type,
+			Content:          msg.Content,
+			SenderName:       msg.Sender.Nickname,
+			Mentioned:        mentioned[userID],
+		})
+	}
+}
+
+// mutedMembers 返回 userIDs 中当前将会话设为静音的成员
+func mutedMembers(conversationID string, userIDs []string) map[string]bool {
+	muted := make(map[string]bool)
+	if len(userIDs) == 0 {
+		return muted
+	}
+
+	placeholders, args := InClause(userIDs)
+	rows, err := database.DB.Query(
+		"SELECT user_id FROM conversation_members WHERE conversation_id = ? AND muted_until > ? AND user_id IN ("+placeholders+")",
+		append([]interface{}{conversationID, time.Now()}, args...)...,
+	)
+	if err != nil {
+		log.Printf("failed to load muted members: %v", err)
+		return muted
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		if rows.Scan(&userID) == nil {
+			muted[userID] = true
+		}
+	}
+	return muted
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"talkbox/database"
+	"talkbox/models"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// MessageCursor 指向分页边界上的一条消息，对客户端不透明。
+// created_at 只精确到秒，同一秒内的消息再按 id 排序，翻页时不会重复或遗漏
+type MessageCursor struct {
+	At time.Time `json:"t"`
+	ID string    `json:"i"`
+}
+
+func (c MessageCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeMessageCursor(s string) (MessageCursor, error) {
+	var cursor MessageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &cursor) != nil || cursor.ID == "" || cursor.At.IsZero() {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// MessagePageRequest 描述一次分页查询，Before、After 和 Around 至多提供一个，都为空时返回最新的一页
+type MessagePageRequest struct {
+	Before *MessageCursor // 早于游标的消息
+	After  *MessageCursor // 晚于游标的消息
+	Around string         // 以该消息为中心，前后各取约一半
+	Limit  int
+}
+
+// messageScope 是分页查询的范围条件
+type messageScope struct {
+	where string
+	args  []interface{}
+}
+
+// ListConversationMessages 分页返回会话主时间线上的消息，不含话题内的回复
+func ListConversationMessages(convID, viewerID string, req MessagePageRequest) ([]models.MessageResponse, models.PageInfo, error) {
+	scope := messageScope{where: "conversation_id = ? AND thread_root_id IS NULL", args: []interface{}{convID}}
+	return pageMessages(scope, viewerID, req)
+}
+
+// ListThreadReplies 分页返回话题内的回复
+func ListThreadReplies(rootID, viewerID string, req MessagePageRequest) ([]models.MessageResponse, models.PageInfo, error) {
+	scope := messageScope{where: "thread_root_id = ?", args: []interface{}{rootID}}
+	return pageMessages(scope, viewerID, req)
+}
+
+// pageMessages 按 (created_at, id) 倒序返回一页消息。PrevCursor 指向本页最早的消息，作为 before 继续向前翻；
+// NextCursor 指向本页最新的消息，作为 after 加载更新的消息
+func pageMessages(scope messageScope, viewerID string, req MessagePageRequest) ([]models.MessageResponse, models.PageInfo, error) {
+	var page []MessageCursor
+	var info models.PageInfo
+
+	switch {
+	case req.Around != "":
+		anchor, err := scopedCursor(scope, req.Around)
+		if err != nil {
+			return nil, info, err
+		}
+
+		olderLimit := req.Limit / 2
+		newerLimit := req.Limit - olderLimit - 1
+		newer, err := messagesAfter(scope, anchor, newerLimit+1)
+		if err != nil {
+			return nil, info, err
+		}
+		older, err := messagesBefore(scope, anchor, olderLimit+1)
+		if err != nil {
+			return nil, info, err
+		}
+
+		info.HasMoreAfter = len(newer) > newerLimit
+		info.HasMoreBefore = len(older) > olderLimit
+		info.HasMore = info.HasMoreBefore || info.HasMoreAfter
+		newer = newer[:min(len(newer), newerLimit)]
+		older = older[:min(len(older), olderLimit)]
+
+		page = append(reverseCursors(newer), anchor)
+		page = append(page, older...)
+
+	case req.After != nil:
+		newer, err := messagesAfter(scope, *req.After, req.Limit+1)
+		if err != nil {
+			return nil, info, err
+		}
+		info.HasMoreAfter = len(newer) > req.Limit
+		info.HasMore = info.HasMoreAfter
+		page = reverseCursors(newer[:min(len(newer), req.Limit)])
+
+		edge := *req.After
+		if len(page) > 0 {
+			edge = page[len(page)-1]
+		}
+		if info.HasMoreBefore, err = hasMessagesBefore(scope, edge); err != nil {
+			return nil, info, err
+		}
+
+	default:
+		edge := req.Before
+		older, err := messagesBeforeCursor(scope, edge, req.Limit+1)
+		if err != nil {
+			return nil, info, err
+		}
+		info.HasMoreBefore = len(older) > req.Limit
+		info.HasMore = info.HasMoreBefore
+		page = older[:min(len(older), req.Limit)]
+
+		if len(page) > 0 {
+			edge = &page[0]
+		}
+		if edge != nil {
+			if info.HasMoreAfter, err = hasMessagesAfter(scope, *edge); err != nil {
+				return nil, info, err
+			}
+		}
+	}
+
+	if len(page) > 0 {
+		info.NextCursor = page[0].Encode()
+		info.PrevCursor = page[len(page)-1].Encode()
+	} else if req.Before != nil {
+		info.PrevCursor = req.Before.Encode()
+		info.NextCursor = info.PrevCursor
+	} else if req.After != nil {
+		info.NextCursor = req.After.Encode()
+		info.PrevCursor = info.NextCursor
+	}
+
+	ids := make([]string, 0, len(page))
+	for _, c := range page {
+		ids = append(ids, c.ID)
+	}
+	loaded, err := LoadMessages(ids, viewerID)
+	if err != nil {
+		return nil, info, err
+	}
+
+	messages := make([]models.MessageResponse, 0, len(ids))
+	for _, id := range ids {
+		if msg, ok := loaded[id]; ok {
+			messages = append(messages, *msg)
+		}
+	}
+	return messages, info, nil
+}
+
+// scopedCursor 返回范围内某条消息的游标，消息不存在或不在范围内时返回 ErrMessageNotFound
+func scopedCursor(scope messageScope, messageID string) (MessageCursor, error) {
+	cursor := MessageCursor{ID: messageID}
+	args := append([]interface{}{messageID}, scope.args...)
+	err := database.DB.QueryRow(`SELECT created_at FROM messages WHERE id = ? AND `+scope.where, args...).Scan(&cursor.At)
+	if err == sql.ErrNoRows {
+		return cursor, ErrMessageNotFound
+	}
+	return cursor, err
+}
+
+func messagesBefore(scope messageScope, c MessageCursor, limit int) ([]MessageCursor, error) {
+	return messagesBeforeCursor(scope, &c, limit)
+}
+
+// messagesBeforeCursor 按倒序返回早于游标的消息，游标为空时从最新的消息开始
+func messagesBeforeCursor(scope messageScope, c *MessageCursor, limit int) ([]MessageCursor, error) {
+	where := scope.where
+	args := append([]interface{}{}, scope.args...)
+	if c != nil {
+		where += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, c.At, c.At, c.ID)
+	}
+	args = append(args, limit)
+	return queryCursors(`SELECT id, created_at FROM messages WHERE `+where+` ORDER BY created_at DESC, id DESC LIMIT ?`, args...)
+}
+
+// messagesAfter 按正序返回晚于游标的消息
+func messagesAfter(scope messageScope, c MessageCursor, limit int) ([]MessageCursor, error) {
+	args := append(append([]interface{}{}, scope.args...), c.At, c.At, c.ID, limit)
+	return queryCursors(`
+		SELECT id, created_at FROM messages
+		WHERE `+scope.where+` AND (created_at > ? OR (created_at = ? AND id > ?))
+		ORDER BY created_at ASC, id ASC LIMIT ?
+	`, args...)
+}
+
+func hasMessagesBefore(scope messageScope, c MessageCursor) (bool, error) {
+	older, err := messagesBefore(scope, c, 1)
+	return len(older) > 0, err
+}
+
+func hasMessagesAfter(scope messageScope, c MessageCursor) (bool, error) {
+	newer, err := messagesAfter(scope, c, 1)
+	return len(newer) > 0, err
+}
+
+func queryCursors(query string, args ...interface{}) ([]MessageCursor, error) {
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cursors []MessageCursor
+	for rows.Next() {
+		var c MessageCursor
+		if err := rows.Scan(&c.ID, &c.At); err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, c)
+	}
+	return cursors, rows.Err()
+}
+
+func reverseCursors(cursors []MessageCursor) []MessageCursor {
+	reversed := make([]MessageCursor, len(cursors))
+	for i, c := range cursors {
+		reversed[len(cursors)-1-i] = c
+	}
+	return reversed
+}
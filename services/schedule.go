@@ -0,0 +1,417 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"talkbox/database"
+	"talkbox/models"
+	"talkbox/utils"
+	"talkbox/websocket"
+)
+
+const (
+	maxScheduleAhead     = 365 * 24 * time.Hour
+	maxPendingSchedules  = 100
+	schedulePollInterval = 2 * time.Second
+	scheduleBatchSize    = 100
+	// 处于 sending 超过该时间视为投递中途进程退出，重新放回队列
+	scheduleSendingTimeout = time.Minute
+	// 投递遇到临时错误时按指数退避重试，认领次数达到上限后标记失败
+	scheduleMaxAttempts  = 5
+	scheduleRetryBackoff = 10 * time.Second
+	scheduleMaxBackoff   = 5 * time.Minute
+)
+
+var (
+	ErrScheduleNotFound   = errors.New("scheduled message not found")
+	ErrScheduleNotPending = errors.New("scheduled message is no longer pending")
+)
+
+// ScheduleInput 是创建定时消息的参数，用户和 Bot 共用
+type ScheduleInput struct {
+	ConversationID string
+	SenderID       string
+	SenderType     string // user, bot
+	Type           string
+	Content        json.RawMessage
+	ReplyToID      string
+	ThreadRootID   string
+	SendAt         time.Time
+}
+
+// ScheduleUpdate 修改待发送的定时消息，字段为空表示不修改
+type ScheduleUpdate struct {
+	Type    string
+	Content json.RawMessage
+	SendAt  *time.Time
+}
+
+// ScheduleMessage 按发送时的规则校验后保存定时消息
+func ScheduleMessage(in *ScheduleInput) (*models.ScheduledMessage, error) {
+	isMember, err := isSenderMember(in.ConversationID, in.SenderID, in.SenderType)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrNotMember
+	}
+
+	if err := validateSendAt(in.SendAt); err != nil {
+		return nil, err
+	}
+
+	err = validateSendInput(&SendMessageInput{
+		ConversationID: in.ConversationID,
+		Type:           in.Type,
+		Content:        in.Content,
+		ReplyToID:      in.ReplyToID,
+		ThreadRootID:   in.ThreadRootID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var pending int
+	err = database.DB.QueryRow(
+		"SELECT COUNT(*) FROM scheduled_messages WHERE sender_id = ? AND sender_type = ? AND status = 'pending'",
+		in.SenderID, in.SenderType,
+	).Scan(&pending)
+	if err != nil {
+		return nil, err
+	}
+	if pending >= maxPendingSchedules {
+		verr := &ValidationError{}
+		verr.add("send_at", "out_of_range", "too many pending scheduled messages")
+		return nil, verr
+	}
+
+	id := utils.GenerateUUID()
+	now := time.Now()
+	_, err = database.DB.Exec(`
+		INSERT INTO scheduled_messages (id, conversation_id, sender_id, sender_type, type, content, reply_to_id, thread_root_id, send_at, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 'pending', ?, ?)
+	`, id, in.ConversationID, in.SenderID, in.SenderType, in.Type, string(in.Content),
+		sql.NullString{String: in.ReplyToID, Valid: in.ReplyToID != ""},
+		sql.NullString{String: in.ThreadRootID, Valid: in.ThreadRootID != ""},
+		in.SendAt, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := loadScheduledMessage(database.DB, id, false)
+	if err != nil {
+		return nil, err
+	}
+	notifyScheduleUpdated(s)
+	return s, nil
+}
+
+// ListScheduledMessages 按发送时间返回发送者待发送的定时消息，convID 非空时只返回该会话的
+func ListScheduledMessages(senderType, senderID, convID string) ([]models.ScheduledMessage, error) {
+	query := scheduledMessageColumns + " WHERE sender_id = ? AND sender_type = ? AND status = 'pending'"
+	args := []interface{}{senderID, senderType}
+	if convID != "" {
+		query += " AND conversation_id = ?"
+		args = append(args, convID)
+	}
+	query += " ORDER BY send_at, id"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []models.ScheduledMessage{}
+	for rows.Next() {
+		s, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *s)
+	}
+	return result, rows.Err()
+}
+
+// UpdateScheduledMessage 修改待发送的定时消息，已开始投递的不能再修改
+func UpdateScheduledMessage(id, senderType, senderID string, upd *ScheduleUpdate) (*models.ScheduledMessage, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 行锁与投递时的认领互斥
+	s, err := loadScheduledMessage(tx, id, true)
+	if err == sql.ErrNoRows || (err == nil && (s.SenderID != senderID || s.SenderType != senderType)) {
+		return nil, ErrScheduleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Status != models.ScheduleStatusPending {
+		return nil, ErrScheduleNotPending
+	}
+
+	if upd.Type != "" {
+		s.Type = upd.Type
+	}
+	if upd.Content != nil {
+		s.Content = upd.Content
+	}
+	if upd.SendAt != nil {
+		if err := validateSendAt(*upd.SendAt); err != nil {
+			return nil, err
+		}
+		s.SendAt = *upd.SendAt
+	}
+
+	err = validateSendInput(&SendMessageInput{
+		ConversationID: s.ConversationID,
+		Type:           s.Type,
+		Content:        s.Content,
+		ReplyToID:      s.ReplyToID,
+		ThreadRootID:   s.ThreadRootID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 修改后重新计算投递重试次数
+	_, err = tx.Exec(
+		"UPDATE scheduled_messages SET type = ?, content = ?, send_at = ?, attempts = 0, next_attempt_at = NULL, updated_at = ? WHERE id = ?",
+		s.Type, string(s.Content), s.SendAt, time.Now(), id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s, err = loadScheduledMessage(database.DB, id, false)
+	if err != nil {
+		return nil, err
+	}
+	notifyScheduleUpdated(s)
+	return s, nil
+}
+
+// CancelScheduledMessage 取消待发送的定时消息
+func CancelScheduledMessage(id, senderType, senderID string) (*models.ScheduledMessage, error) {
+	result, err := database.DB.Exec(
+		"UPDATE scheduled_messages SET status = 'canceled', updated_at = ? WHERE id = ? AND sender_id = ? AND sender_type = ? AND status = 'pending'",
+		time.Now(), id, senderID, senderType,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := loadScheduledMessage(database.DB, id, false)
+	if err == sql.ErrNoRows || (err == nil && (s.SenderID != senderID || s.SenderType != senderType)) {
+		return nil, ErrScheduleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return nil, ErrScheduleNotPending
+	}
+
+	notifyScheduleUpdated(s)
+	return s, nil
+}
+
+// StartScheduler 定期投递到期的定时消息。多个节点同时运行时通过条件更新认领，同一条只由一个节点投递；
+// 投递使用固定的 client_msg_id，进程在发送后、标记完成前退出时，重新投递会返回已发送的消息而不会重复发送
+func StartScheduler() {
+	go func() {
+		ticker := time.NewTicker(schedulePollInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			requeueStaleSchedules()
+			dispatchDueSchedules()
+		}
+	}()
+}
+
+// requeueStaleSchedules 将投递中途中断的定时消息放回队列，认领次数已达上限的直接标记失败，
+// 避免每次投递都导致进程退出的消息无限重试
+func requeueStaleSchedules() {
+	_, err := database.DB.Exec(`
+		UPDATE scheduled_messages
+		SET status = IF(attempts >= ?, 'failed', 'pending'),
+			error = IF(attempts >= ?, 'delivery was interrupted too many times', error)
+		WHERE status = 'sending' AND updated_at < ?
+	`, scheduleMaxAttempts, scheduleMaxAttempts, time.Now().Add(-scheduleSendingTimeout))
+	if err != nil {
+		log.Printf("failed to requeue scheduled messages: %v", err)
+	}
+}
+
+func dispatchDueSchedules() {
+	now := time.Now()
+	rows, err := database.DB.Query(`
+		SELECT id FROM scheduled_messages
+		WHERE status = 'pending' AND send_at <= ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)
+		ORDER BY send_at LIMIT ?
+	`, now, now, scheduleBatchSize)
+	if err != nil {
+		log.Printf("failed to load due scheduled messages: %v", err)
+		return
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		result, err := database.DB.Exec(
+			"UPDATE scheduled_messages SET status = 'sending', attempts = attempts + 1, updated_at = ? WHERE id = ? AND status = 'pending'",
+			time.Now(), id,
+		)
+		if err != nil {
+			log.Printf("failed to claim scheduled message %s: %v", id, err)
+			continue
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			continue
+		}
+		deliverScheduled(id)
+	}
+}
+
+// deliverScheduled 通过正常的发送流程投递已认领的定时消息。发送者已离开会话时取消，
+// 内容已失效（如引用的消息被撤回）时标记失败，其他错误按退避时间放回队列，达到重试上限后标记失败
+func deliverScheduled(id string) {
+	s, err := loadScheduledMessage(database.DB, id, false)
+	if err != nil {
+		log.Printf("failed to load scheduled message %s: %v", id, err)
+		return
+	}
+	var attempts int
+	if err := database.DB.QueryRow("SELECT attempts FROM scheduled_messages WHERE id = ?", id).Scan(&attempts); err != nil {
+		log.Printf("failed to load scheduled message %s: %v", id, err)
+		return
+	}
+
+	msg, err := SendMessage(&SendMessageInput{
+		ConversationID: s.ConversationID,
+		SenderID:       s.SenderID,
+		SenderType:     s.SenderType,
+		Type:           s.Type,
+		Content:        s.Content,
+		ReplyToID:      s.ReplyToID,
+		ThreadRootID:   s.ThreadRootID,
+		ClientMsgID:    "sched:" + s.ID,
+	})
+
+	var validationErr *ValidationError
+	var status, messageID, reason string
+	var nextAttemptAt sql.NullTime
+	switch {
+	case err == nil:
+		status, messageID = models.ScheduleStatusSent, msg.ID
+	case errors.Is(err, ErrNotMember):
+		status, reason = models.ScheduleStatusCanceled, "sender is no longer a member of this conversation"
+	case errors.As(err, &validationErr):
+		status, reason = models.ScheduleStatusFailed, validationErr.Error()
+	case attempts >= scheduleMaxAttempts:
+		log.Printf("failed to deliver scheduled message %s after %d attempts: %v", id, attempts, err)
+		status, reason = models.ScheduleStatusFailed, "delivery failed after repeated attempts"
+	default:
+		log.Printf("failed to deliver scheduled message %s (attempt %d): %v", id, attempts, err)
+		status = models.ScheduleStatusPending
+		nextAttemptAt = sql.NullTime{Time: time.Now().Add(scheduleBackoff(attempts)), Valid: true}
+	}
+
+	_, err = database.DB.Exec(`
+		UPDATE scheduled_messages SET status = ?, message_id = ?, error = ?, next_attempt_at = ?, updated_at = ?
+		WHERE id = ? AND status = 'sending'
+	`, status, sql.NullString{String: messageID, Valid: messageID != ""},
+		sql.NullString{String: reason, Valid: reason != ""}, nextAttemptAt, time.Now(), id)
+	if err != nil {
+		log.Printf("failed to update scheduled message %s: %v", id, err)
+		return
+	}
+
+	if status != models.ScheduleStatusPending {
+		s.Status, s.MessageID, s.Error = status, messageID, reason
+		notifyScheduleUpdated(s)
+	}
+}
+
+// scheduleBackoff 返回第 attempts 次投递失败后的等待时间，从 scheduleRetryBackoff 开始翻倍，不超过 scheduleMaxBackoff
+func scheduleBackoff(attempts int) time.Duration {
+	backoff := scheduleRetryBackoff
+	for i := 1; i < attempts && backoff < scheduleMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, scheduleMaxBackoff)
+}
+
+// notifyScheduleUpdated 将定时消息的变化同步给发送者的所有设备，Bot 没有 WebSocket 连接
+func notifyScheduleUpdated(s *models.ScheduledMessage) {
+	if s.SenderType != "user" {
+		return
+	}
+	websocket.HubInstance.SendToUser(s.SenderID, &websocket.Message{
+		Event: "scheduled_message_updated",
+		Data:  s,
+	})
+}
+
+func validateSendAt(sendAt time.Time) error {
+	now := time.Now()
+	verr := &ValidationError{}
+	switch {
+	case !sendAt.After(now):
+		verr.add("send_at", "out_of_range", "must be in the future")
+	case sendAt.Sub(now) > maxScheduleAhead:
+		verr.add("send_at", "out_of_range", "must be within one year")
+	}
+	return verr.orNil()
+}
+
+const scheduledMessageColumns = `
+	SELECT id, conversation_id, sender_id, sender_type, type, content, COALESCE(reply_to_id, ''), COALESCE(thread_root_id, ''),
+		send_at, status, COALESCE(message_id, ''), COALESCE(error, ''), created_at, updated_at
+	FROM scheduled_messages`
+
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func loadScheduledMessage(q rowQuerier, id string, forUpdate bool) (*models.ScheduledMessage, error) {
+	query := scheduledMessageColumns + " WHERE id = ?"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	return scanScheduledMessage(q.QueryRow(query, id))
+}
+
+func scanScheduledMessage(row rowScanner) (*models.ScheduledMessage, error) {
+	var s models.ScheduledMessage
+	var content []byte
+	err := row.Scan(&s.ID, &s.ConversationID, &s.SenderID, &s.SenderType, &s.Type, &content, &s.ReplyToID, &s.ThreadRootID,
+		&s.SendAt, &s.Status, &s.MessageID, &s.Error, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	s.Content = json.RawMessage(content)
+	return &s, nil
+}
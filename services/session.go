@@ -0,0 +1,268 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"talkbox/config"
+	"talkbox/database"
+	"talkbox/models"
+	"talkbox/utils"
+	"talkbox/websocket"
+)
+
+const sessionPruneInterval = time.Hour
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused 表示已使用过的刷新令牌再次出现，令牌可能已泄露，整个会话会被撤销
+	ErrRefreshTokenReused = errors.New("refresh token has already been used, session revoked")
+	ErrSessionNotFound    = errors.New("session not found")
+)
+
+// SessionDevice 是登录时记录的设备信息，用于在会话列表中辨认设备
+type SessionDevice struct {
+	Name      string
+	Platform  string
+	IP        string
+	UserAgent string
+}
+
+// CreateSession 为登录或注册的用户创建会话并签发令牌对
+func CreateSession(userID string, device SessionDevice) (*models.TokenPair, error) {
+	sessionID := utils.GenerateUUID()
+	refreshToken := utils.GenerateRefreshToken()
+	now := time.Now()
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO sessions (id, user_id, device_name, platform, ip, user_agent, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sessionID, userID, device.Name, device.Platform, device.IP, truncate(device.UserAgent, 255),
+		now, now, now.Add(config.Cfg.RefreshTokenTTL),
+	); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)",
+		utils.HashToken(refreshToken), sessionID, now,
+	); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return issueTokens(userID, sessionID, refreshToken)
+}
+
+// RefreshSession 用刷新令牌换取新的令牌对，旧的刷新令牌随即作废。
+// 已作废的令牌再次使用时撤销整个会话，使窃取令牌的一方和合法客户端都需要重新登录。
+// ip 和 userAgent 为本次请求的来源，更新到会话上
+func RefreshSession(refreshToken, ip, userAgent string) (*models.TokenPair, error) {
+	tokenHash := utils.HashToken(refreshToken)
+	now := time.Now()
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sessionID, userID string
+	var usedAt, revokedAt sql.NullTime
+	var expiresAt time.Time
+	err = tx.QueryRow(`
+		SELECT s.id, s.user_id, s.expires_at, s.revoked_at, rt.used_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = ?
+		FOR UPDATE
+	`, tokenHash).Scan(&sessionID, &userID, &expiresAt, &revokedAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid || now.After(expiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if usedAt.Valid {
+		tx.Rollback()
+		if err := RevokeSession(userID, sessionID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return nil, err
+		}
+		log.Printf("refresh token reuse detected for session %s, session revoked", sessionID)
+		return nil, ErrRefreshTokenReused
+	}
+	// 管理员开启两步验证要求后，未启用的用户在访问令牌过期时需要重新登录并完成绑定
+	if err := checkTwoFactorCompliance(userID); err != nil {
+		return nil, err
+	}
+
+	next := utils.GenerateRefreshToken()
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = ? WHERE token_hash = ?", now, tokenHash); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)",
+		utils.HashToken(next), sessionID, now,
+	); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE sessions SET ip = ?, user_agent = ?, last_used_at = ?, expires_at = ? WHERE id = ?",
+		ip, truncate(userAgent, 255), now, now.Add(config.Cfg.RefreshTokenTTL), sessionID,
+	); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return issueTokens(userID, sessionID, next)
+}
+
+// RevokeSession 撤销用户的会话：作废刷新令牌，将会话加入黑名单使已签发的访问令牌立即失效，
+// 断开该会话的 WebSocket 连接，并删除该设备的推送令牌
+func RevokeSession(userID, sessionID string) error {
+	result, err := database.DB.Exec(
+		"UPDATE sessions SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		time.Now(), sessionID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+
+	if _, err := database.DB.Exec("DELETE FROM refresh_tokens WHERE session_id = ?", sessionID); err != nil {
+		log.Printf("failed to delete refresh tokens of session %s: %v", sessionID, err)
+	}
+	if _, err := database.DB.Exec("DELETE FROM device_tokens WHERE session_id = ?", sessionID); err != nil {
+		log.Printf("failed to delete device tokens of session %s: %v", sessionID, err)
+	}
+	if err := database.DenySession(sessionID, config.Cfg.AccessTokenTTL); err != nil {
+		return err
+	}
+	websocket.HubInstance.CloseSession(userID, sessionID)
+	return nil
+}
+
+// ListSessions 返回用户未过期、未撤销的会话，按最近使用时间倒序
+func ListSessions(userID, currentSessionID string) ([]models.Session, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, device_name, platform, ip, user_agent, created_at, last_used_at
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_used_at DESC
+	`, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		if err := rows.Scan(&session.ID, &session.DeviceName, &session.Platform, &session.IP, &session.UserAgent,
+			&session.CreatedAt, &session.LastUsedAt); err != nil {
+			return nil, err
+		}
+		session.Current = session.ID == currentSessionID
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeOtherSessions 撤销用户除 keepSessionID 以外的所有会话，返回撤销的数量
+func RevokeOtherSessions(userID, keepSessionID string) (int, error) {
+	rows, err := database.DB.Query(
+		"SELECT id FROM sessions WHERE user_id = ? AND id != ? AND revoked_at IS NULL",
+		userID, keepSessionID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, id := range ids {
+		err := RevokeSession(userID, id)
+		if errors.Is(err, ErrSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+func issueTokens(userID, sessionID, refreshToken string) (*models.TokenPair, error) {
+	token, expiresAt, err := utils.GenerateToken(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.TokenPair{Token: token, ExpiresAt: expiresAt, RefreshToken: refreshToken}, nil
+}
+
+// StartSessionPruner 定期清理过期或已撤销的会话。撤销的会话保留到其访问令牌全部过期之后
+func StartSessionPruner() {
+	go func() {
+		ticker := time.NewTicker(sessionPruneInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			now := time.Now()
+			if _, err := database.DB.Exec(
+				"DELETE FROM sessions WHERE expires_at < ? OR revoked_at < ?",
+				now, now.Add(-config.Cfg.AccessTokenTTL),
+			); err != nil {
+				log.Printf("failed to prune sessions: %v", err)
+				continue
+			}
+			if _, err := database.DB.Exec(
+				"DELETE rt FROM refresh_tokens rt LEFT JOIN sessions s ON s.id = rt.session_id WHERE s.id IS NULL",
+			); err != nil {
+				log.Printf("failed to prune refresh tokens: %v", err)
+			}
+			// 过期的会话不会经过 RevokeSession，其设备令牌在这里清理
+			if _, err := database.DB.Exec(`
+				DELETE dt FROM device_tokens dt LEFT JOIN sessions s ON s.id = dt.session_id AND s.revoked_at IS NULL
+				WHERE s.id IS NULL
+			`); err != nil {
+				log.Printf("failed to prune device tokens: %v", err)
+			}
+		}
+	}()
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"talkbox/database"
+	"talkbox/models"
+)
+
+const settingRequireTwoFactor = "require_two_factor"
+
+// GetSettings 返回全局设置，未设置过的项为默认值
+func GetSettings() (*models.ServerSettings, error) {
+	required, err := TwoFactorRequired()
+	if err != nil {
+		return nil, err
+	}
+	return &models.ServerSettings{RequireTwoFactor: required}, nil
+}
+
+// SetRequireTwoFactor 设置是否要求所有用户启用两步验证
+func SetRequireTwoFactor(required bool, adminID string) error {
+	_, err := database.DB.Exec(`
+		INSERT INTO settings (name, value, updated_by, updated_at) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE value = VALUES(value), updated_by = VALUES(updated_by), updated_at = VALUES(updated_at)
+	`, settingRequireTwoFactor, strconv.FormatBool(required), adminID, time.Now())
+	return err
+}
+
+// TwoFactorRequired 判断管理员是否要求所有用户启用两步验证。每次读取数据库，修改后所有节点立即生效
+func TwoFactorRequired() (bool, error) {
+	var value string
+	err := database.DB.QueryRow("SELECT value FROM settings WHERE name = ?", settingRequireTwoFactor).Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return value == "true", nil
+}
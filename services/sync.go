@@ -0,0 +1,192 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"talkbox/database"
+)
+
+// 增量同步记录的实体类型
+const (
+	EntityConversation = "conversation"
+	EntityMember       = "member"
+	EntityBot          = "bot"
+	EntityMessage      = "message"
+	EntityReadState    = "read_state"
+)
+
+const (
+	ChangeUpsert = "upsert"
+	ChangeDelete = "delete"
+)
+
+const (
+	// 变更记录保留时间，游标早于该时间时客户端需要全量同步
+	syncRetention     = 90 * 24 * time.Hour
+	syncPruneInterval = time.Hour
+	// 只返回至少这么久之前写入的变更，避免并发事务按 id 乱序提交导致游标跳过尚未提交的记录
+	syncSettleDelay = 2 * time.Second
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Change 描述一次变更。UserID 为空时会话内所有成员可见，否则只对该用户可见，
+// 用于新成员加入、被移出或会话被删除等成员本身无法再通过会话看到的情况
+type Change struct {
+	UserID         string
+	ConversationID string
+	Entity         string
+	EntityID       string
+	Action         string
+}
+
+// SyncChange 是从变更记录中读出的一条变更
+type SyncChange struct {
+	ID int64
+	Change
+	CreatedAt time.Time
+}
+
+// RecordChanges 写入变更记录，失败只记录日志，不影响已完成的业务操作
+func RecordChanges(changes ...Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	now := time.Now()
+	placeholders := make([]string, 0, len(changes))
+	args := make([]interface{}, 0, len(changes)*6)
+	for _, ch := range changes {
+		var userID interface{}
+		if ch.UserID != "" {
+			userID = ch.UserID
+		}
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?)")
+		args = append(args, userID, ch.ConversationID, ch.Entity, ch.EntityID, ch.Action, now)
+	}
+
+	_, err := database.DB.Exec(
+		"INSERT INTO sync_changes (user_id, conversation_id, entity, entity_id, action, created_at) VALUES "+
+			strings.Join(placeholders, ", "),
+		args...,
+	)
+	if err != nil {
+		log.Printf("failed to record sync changes: %v", err)
+	}
+}
+
+// MemberChanges 为会话的每个成员生成只对其本人可见的变更
+func MemberChanges(convID string, userIDs []string, entity, entityID, action string) []Change {
+	changes := make([]Change, 0, len(userIDs))
+	for _, userID := range userIDs {
+		changes = append(changes, Change{
+			UserID:         userID,
+			ConversationID: convID,
+			Entity:         entity,
+			EntityID:       entityID,
+			Action:         action,
+		})
+	}
+	return changes
+}
+
+// SyncCursor 是同步游标的内容，对客户端不透明。
+// At 之后的变更一定仍被保留，用于判断游标是否已过期
+type SyncCursor struct {
+	ID int64 `json:"i"`
+	At int64 `json:"t"`
+}
+
+func (c SyncCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeSyncCursor(s string) (SyncCursor, error) {
+	var cursor SyncCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &cursor) != nil || cursor.ID < 0 {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// Expired 判断游标之后的变更是否可能已被清理
+func (c SyncCursor) Expired(now time.Time) bool {
+	return time.Unix(c.At, 0).Before(now.Add(-syncRetention))
+}
+
+// LatestSyncCursor 返回指向当前最新变更的游标，用于首次同步或全量同步之后
+func LatestSyncCursor() (SyncCursor, error) {
+	now := time.Now()
+	var id int64
+	err := database.DB.QueryRow(
+		"SELECT COALESCE(MAX(id), 0) FROM sync_changes WHERE created_at <= ?",
+		now.Add(-syncSettleDelay),
+	).Scan(&id)
+	return SyncCursor{ID: id, At: now.Unix()}, err
+}
+
+// ListChanges 返回游标之后对用户可见的变更，最多 limit 条，以及下一页的游标
+func ListChanges(userID string, cursor SyncCursor, limit int) ([]SyncChange, SyncCursor, bool, error) {
+	now := time.Now()
+	rows, err := database.DB.Query(`
+		SELECT id, COALESCE(user_id, ''), conversation_id, entity, entity_id, action, created_at
+		FROM sync_changes
+		WHERE id > ? AND created_at <= ?
+		AND (user_id = ? OR (user_id IS NULL AND conversation_id IN
+			(SELECT conversation_id FROM conversation_members WHERE user_id = ?)))
+		ORDER BY id
+		LIMIT ?
+	`, cursor.ID, now.Add(-syncSettleDelay), userID, userID, limit+1)
+	if err != nil {
+		return nil, cursor, false, err
+	}
+	defer rows.Close()
+
+	var changes []SyncChange
+	for rows.Next() {
+		var ch SyncChange
+		if err := rows.Scan(&ch.ID, &ch.UserID, &ch.ConversationID, &ch.Entity, &ch.EntityID, &ch.Action, &ch.CreatedAt); err != nil {
+			return nil, cursor, false, err
+		}
+		changes = append(changes, ch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, cursor, false, err
+	}
+
+	hasMore := len(changes) > limit
+	next := SyncCursor{ID: cursor.ID, At: now.Unix()}
+	if hasMore {
+		changes = changes[:limit]
+		// 还有未返回的变更，它们不早于本页最后一条，以此判断下一页是否过期
+		next.At = changes[limit-1].CreatedAt.Unix()
+	}
+	if len(changes) > 0 {
+		next.ID = changes[len(changes)-1].ID
+	}
+	return changes, next, hasMore, nil
+}
+
+// StartSyncPruner 定期清理过期的变更记录
+func StartSyncPruner() {
+	go func() {
+		ticker := time.NewTicker(syncPruneInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if _, err := database.DB.Exec(
+				"DELETE FROM sync_changes WHERE created_at < ?",
+				time.Now().Add(-syncRetention),
+			); err != nil {
+				log.Printf("failed to prune sync changes: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"talkbox/database"
+	"talkbox/models"
+	"talkbox/websocket"
+)
+
+// 根消息上最多展示的参与者头像数
+const threadParticipantPreview = 3
+
+// validateThreadRoot 校验话题根消息存在于会话中且未撤回，话题不能嵌套
+func validateThreadRoot(convID, rootID string) error {
+	var parentRootID sql.NullString
+	var recalled bool
+	err := database.DB.QueryRow(
+		"SELECT thread_root_id, recalled_at IS NOT NULL FROM messages WHERE id = ? AND conversation_id = ?",
+		rootID, convID,
+	).Scan(&parentRootID, &recalled)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	verr := &ValidationError{}
+	switch {
+	case err == sql.ErrNoRows || recalled:
+		verr.add("thread_root_id", "not_found", "refers to a message that does not exist in this conversation")
+	case parentRootID.Valid:
+		verr.add("thread_root_id", "nested_thread", "cannot start a thread from a thread reply")
+	}
+	return verr.orNil()
+}
+
+// addThreadParticipants 将根消息的发送者和被 @ 的用户加入话题，回复者加入话题并将话题已读位置推进到本条回复
+func addThreadParticipants(tx *sql.Tx, in *SendMessageInput, msgID string, mentions []string, now time.Time) error {
+	var rootSenderID, rootSenderType string
+	err := tx.QueryRow(
+		"SELECT sender_id, sender_type FROM messages WHERE id = ?",
+		in.ThreadRootID,
+	).Scan(&rootSenderID, &rootSenderType)
+	if err != nil {
+		return err
+	}
+
+	userIDs := mentions
+	if rootSenderType == "user" {
+		userIDs = append([]string{rootSenderID}, mentions...)
+	}
+	for _, userID := range userIDs {
+		_, err := tx.Exec(
+			"INSERT IGNORE INTO thread_participants (thread_root_id, conversation_id, user_id, created_at) VALUES (?, ?, ?, ?)",
+			in.ThreadRootID, in.ConversationID, userID, now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if in.SenderType != "user" {
+		return nil
+	}
+	_, err = tx.Exec(`
+		INSERT INTO thread_participants (thread_root_id, conversation_id, user_id, last_read_message_id, last_read_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE last_read_message_id = VALUES(last_read_message_id), last_read_at = VALUES(last_read_at)
+	`, in.ThreadRootID, in.ConversationID, in.SenderID, msgID, now, now)
+	return err
+}
+
+// broadcastThreadReply 向仍在会话中的话题参与者发送完整的 thread_reply，
+// 并向会话所有成员广播 thread_updated 以更新根消息上的回复数和参与者
+func broadcastThreadReply(msg *models.MessageResponse) {
+	summaries, err := loadThreadSummaries([]string{msg.ThreadRootID}, "")
+	if err != nil {
+		log.Printf("failed to load thread summary: %v", err)
+		return
+	}
+	summary, ok := summaries[msg.ThreadRootID]
+	if !ok {
+		return
+	}
+
+	participants, err := threadParticipantIDs(msg.ThreadRootID)
+	if err != nil {
+		log.Printf("failed to load thread participants: %v", err)
+	}
+	websocket.HubInstance.SendToUsers(participants, &websocket.Message{
+		Event: "thread_reply",
+		Data: map[string]interface{}{
+			"conversation_id": msg.ConversationID,
+			"thread_root_id":  msg.ThreadRootID,
+			"message":         msg,
+		},
+	})
+
+	websocket.BroadcastToConversation(msg.ConversationID, &websocket.Message{
+		Event: "thread_updated",
+		Data: map[string]interface{}{
+			"conversation_id":     msg.ConversationID,
+			"thread_root_id":      msg.ThreadRootID,
+			"thread_reply_count":  summary.ReplyCount,
+			"last_reply_at":       summary.LastReplyAt,
+			"thread_participants": summary.Participants,
+		},
+	})
+}
+
+// threadParticipantIDs 返回仍是会话成员的话题参与者
+func threadParticipantIDs(rootID string) ([]string, error) {
+	rows, err := database.DB.Query(`
+		SELECT tp.user_id FROM thread_participants tp
+		JOIN conversation_members m ON m.conversation_id = tp.conversation_id AND m.user_id = tp.user_id
+		WHERE tp.thread_root_id = ?
+	`, rootID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+// loadThreadSummaries 批量统计根消息的话题回复数、最后回复时间和最早回复的几位参与者，
+// viewerID 非空时附带其话题未读数。已撤回的回复不计入，没有回复的根消息不出现在结果中
+func loadThreadSummaries(rootIDs []string, viewerID string) (map[string]*models.ThreadSummary, error) {
+	placeholders, args := InClause(rootIDs)
+
+	rows, err := database.DB.Query(`
+		SELECT thread_root_id, COUNT(*), MAX(created_at)
+		FROM messages
+		WHERE thread_root_id IN (`+placeholders+`) AND recalled_at IS NULL
+		GROUP BY thread_root_id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]*models.ThreadSummary)
+	var activeIDs []string
+	for rows.Next() {
+		var rootID string
+		summary := &models.ThreadSummary{Participants: []models.ThreadParticipant{}}
+		if err := rows.Scan(&rootID, &summary.ReplyCount, &summary.LastReplyAt); err != nil {
+			return nil, err
+		}
+		result[rootID] = summary
+		activeIDs = append(activeIDs, rootID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(activeIDs) == 0 {
+		return result, nil
+	}
+
+	placeholders, args = InClause(activeIDs)
+	participantRows, err := database.DB.Query(`
+		SELECT t.thread_root_id, t.sender_id,
+			COALESCE(u.nickname, b.name, ''), COALESCE(u.avatar, b.avatar, '')
+		FROM (
+			SELECT thread_root_id, sender_type, sender_id,
+				ROW_NUMBER() OVER (PARTITION BY thread_root_id ORDER BY MIN(created_at)) AS rn
+			FROM messages
+			WHERE thread_root_id IN (`+placeholders+`) AND recalled_at IS NULL
+			GROUP BY thread_root_id, sender_type, sender_id
+		) t
+		LEFT JOIN users u ON t.sender_type = 'user' AND t.sender_id = u.id
+		LEFT JOIN bots b ON t.sender_type = 'bot' AND t.sender_id = b.id
+		WHERE t.rn <= ?
+		ORDER BY t.thread_root_id, t.rn
+	`, append(args, threadParticipantPreview)...)
+	if err != nil {
+		return nil, err
+	}
+	defer participantRows.Close()
+
+	for participantRows.Next() {
+		var rootID string
+		var p models.ThreadParticipant
+		if err := participantRows.Scan(&rootID, &p.ID, &p.Nickname, &p.Avatar); err != nil {
+			return nil, err
+		}
+		result[rootID].Participants = append(result[rootID].Participants, p)
+	}
+	if err := participantRows.Err(); err != nil {
+		return nil, err
+	}
+
+	if viewerID == "" {
+		return result, nil
+	}
+
+	// 已读位置是 (last_read_at, last_read_message_id)，与分页游标一样按 (created_at, id) 比较，
+	// 同一秒内晚于已读位置的回复仍计为未读；从未打开过话题的参与者，所有他人的回复都计为未读
+	unreadRows, err := database.DB.Query(`
+		SELECT tp.thread_root_id, COUNT(msg.id)
+		FROM thread_participants tp
+		JOIN messages msg ON msg.thread_root_id = tp.thread_root_id
+			AND msg.recalled_at IS NULL
+			AND (tp.last_read_at IS NULL OR msg.created_at > tp.last_read_at
+				OR (msg.created_at = tp.last_read_at AND msg.id > COALESCE(tp.last_read_message_id, '')))
+			AND NOT (msg.sender_type = 'user' AND msg.sender_id = tp.user_id)
+		WHERE tp.user_id = ? AND tp.thread_root_id IN (`+placeholders+`)
+		GROUP BY tp.thread_root_id
+	`, append([]interface{}{viewerID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer unreadRows.Close()
+
+	for unreadRows.Next() {
+		var rootID string
+		var count int
+		if err := unreadRows.Scan(&rootID, &count); err != nil {
+			return nil, err
+		}
+		result[rootID].UnreadCount = count
+	}
+	return result, unreadRows.Err()
+}
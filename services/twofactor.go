@@ -0,0 +1,340 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"talkbox/database"
+	"talkbox/models"
+	"talkbox/utils"
+)
+
+// twoFactorClock 是两步验证使用的时钟，替换为固定时间即可离线生成和校验验证码与挑战令牌
+var twoFactorClock = time.Now
+
+const (
+	totpIssuer = "TalkBox"
+	// 挑战令牌在密码校验通过后签发，只需覆盖输入验证码的时间；绑定需要安装验证器应用，时间更长
+	loginChallengeTTL  = 5 * time.Minute
+	enrollChallengeTTL = 15 * time.Minute
+	recoveryCodeCount  = 10
+)
+
+var (
+	ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorSetupRequired  = errors.New("two-factor setup has not been started")
+	ErrInvalidTwoFactorCode    = errors.New("invalid two-factor code")
+	// ErrTwoFactorRequired 表示管理员要求启用两步验证，用户不能关闭，未启用的用户需要重新登录并完成绑定
+	ErrTwoFactorRequired = errors.New("two-factor authentication is required")
+	ErrInvalidChallenge  = errors.New("invalid or expired challenge token")
+)
+
+// GetTwoFactorStatus 返回用户的两步验证状态
+func GetTwoFactorStatus(userID string) (*models.TwoFactorStatus, error) {
+	required, err := TwoFactorRequired()
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := twoFactorEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &models.TwoFactorStatus{Enabled: enabled, Required: required}
+	if enabled {
+		err = database.DB.QueryRow(
+			"SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID,
+		).Scan(&status.RecoveryCodesRemaining)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// BeginTwoFactorSetup 为用户生成新的 TOTP 密钥，在 EnableTwoFactor 验证通过前不生效。
+// 重复调用会替换尚未启用的密钥
+func BeginTwoFactorSetup(userID string) (*models.TwoFactorSetup, error) {
+	var username string
+	err := database.DB.QueryRow("SELECT username FROM users WHERE id = ? AND deleted_at IS NULL", userID).Scan(&username)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	enabled, err := twoFactorEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTwoFactorAlreadyEnabled
+	}
+
+	secret := utils.GenerateTOTPSecret()
+	_, err = database.DB.Exec(`
+		INSERT INTO user_totp (user_id, secret, created_at) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), last_step = 0, created_at = VALUES(created_at)
+	`, userID, secret, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorSetup{
+		Secret:          secret,
+		ProvisioningURI: utils.TOTPProvisioningURI(secret, totpIssuer, username),
+	}, nil
+}
+
+// EnableTwoFactor 用验证器应用生成的验证码确认绑定并启用两步验证，返回一组新的恢复码。
+// 恢复码只在这里返回一次，服务端只保存其哈希
+func EnableTwoFactor(userID, code string) ([]string, error) {
+	var secret string
+	var enabledAt sql.NullTime
+	err := database.DB.QueryRow("SELECT secret, enabled_at FROM user_totp WHERE user_id = ?", userID).Scan(&secret, &enabledAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTwoFactorSetupRequired
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		return nil, ErrTwoFactorAlreadyEnabled
+	}
+
+	step, ok := utils.ValidateTOTP(secret, strings.TrimSpace(code), twoFactorClock())
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE user_totp SET enabled_at = ?, last_step = ? WHERE user_id = ? AND secret = ? AND enabled_at IS NULL",
+		time.Now(), step, userID, secret,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// 并发的另一次绑定已经启用或替换了密钥
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyTwoFactorCode 校验已启用两步验证的用户提交的验证码。code 为 6 位数字时按 TOTP 校验，
+// 否则按恢复码校验，两者都只能使用一次。返回是否使用了恢复码
+func VerifyTwoFactorCode(userID, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+
+	var secret string
+	var lastStep int64
+	err := database.DB.QueryRow(
+		"SELECT secret, last_step FROM user_totp WHERE user_id = ? AND enabled_at IS NOT NULL", userID,
+	).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if isTOTPCode(code) {
+		step, ok := utils.ValidateTOTP(secret, code, twoFactorClock())
+		if !ok || step <= lastStep {
+			return false, ErrInvalidTwoFactorCode
+		}
+		// 条件更新保证并发提交同一验证码时只有一次成功
+		result, err := database.DB.Exec(
+			"UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?", step, userID, step,
+		)
+		if err != nil {
+			return false, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return false, ErrInvalidTwoFactorCode
+		}
+		return false, nil
+	}
+
+	result, err := database.DB.Exec(
+		"UPDATE recovery_codes SET used_at = ? WHERE code_hash = ? AND user_id = ? AND used_at IS NULL",
+		time.Now(), utils.HashToken(normalizeRecoveryCode(code)), userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, ErrInvalidTwoFactorCode
+	}
+	return true, nil
+}
+
+// RegenerateRecoveryCodes 作废用户现有的恢复码并生成一组新的
+func RegenerateRecoveryCodes(userID string) ([]string, error) {
+	enabled, err := twoFactorEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrTwoFactorNotEnabled
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor 删除用户的 TOTP 密钥和恢复码。是否允许关闭由调用方判断
+func DisableTwoFactor(userID string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LoginChallengeFor 在密码校验通过后判断是否需要两步验证，需要时签发挑战令牌，不需要时返回 nil
+func LoginChallengeFor(userID string, device SessionDevice) (*models.LoginChallenge, error) {
+	enabled, err := twoFactorEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		required, err := TwoFactorRequired()
+		if err != nil {
+			return nil, err
+		}
+		if !required {
+			return nil, nil
+		}
+	}
+
+	ttl := loginChallengeTTL
+	if !enabled {
+		ttl = enrollChallengeTTL
+	}
+	claims := utils.ChallengeClaims{
+		UserID:     userID,
+		Enroll:     !enabled,
+		DeviceName: device.Name,
+		Platform:   device.Platform,
+	}
+	token, expiresAt, err := utils.GenerateChallengeToken(claims, twoFactorClock(), ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.LoginChallenge{
+		TwoFactorRequired:  true,
+		EnrollmentRequired: !enabled,
+		ChallengeToken:     token,
+		ExpiresAt:          expiresAt,
+	}, nil
+}
+
+// ParseLoginChallenge 校验挑战令牌，返回其中的用户和设备信息
+func ParseLoginChallenge(token string) (*utils.ChallengeClaims, error) {
+	claims, err := utils.ParseChallengeToken(token, twoFactorClock())
+	if err != nil {
+		return nil, ErrInvalidChallenge
+	}
+	return claims, nil
+}
+
+// checkTwoFactorCompliance 在管理员要求两步验证而用户尚未启用时返回 ErrTwoFactorRequired
+func checkTwoFactorCompliance(userID string) error {
+	required, err := TwoFactorRequired()
+	if err != nil || !required {
+		return err
+	}
+	enabled, err := twoFactorEnabled(userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrTwoFactorRequired
+	}
+	return nil
+}
+
+func twoFactorEnabled(userID string) (bool, error) {
+	var enabled bool
+	err := database.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = ? AND enabled_at IS NOT NULL)", userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := utils.GenerateRecoveryCode()
+		if _, err := tx.Exec(
+			"INSERT INTO recovery_codes (code_hash, user_id, created_at) VALUES (?, ?, ?)",
+			utils.HashToken(normalizeRecoveryCode(code)), userID, now,
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != 6 {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeRecoveryCode 忽略大小写、空格和连字符，用户手动输入时格式不必完全一致
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
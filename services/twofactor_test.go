@@ -0,0 +1,287 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"talkbox/config"
+	"talkbox/database"
+	"talkbox/utils"
+)
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// testNow 是测试中固定的两步验证时钟
+var testNow = time.Unix(1700000000, 0)
+
+func TestMain(m *testing.M) {
+	config.Cfg = &config.Config{JWTSecret: "test-secret", AccessTokenTTL: time.Minute}
+	twoFactorClock = func() time.Time { return testNow }
+	os.Exit(m.Run())
+}
+
+// mockDB 为单个测试替换 database.DB，结束时检查所有预期的语句都已执行
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	prev := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		database.DB = prev
+		db.Close()
+	})
+	return mock
+}
+
+func expectTOTPRow(mock sqlmock.Sqlmock, userID string, lastStep int64) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT secret, last_step FROM user_totp")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "last_step"}).AddRow(testTOTPSecret, lastStep))
+}
+
+func testStep(offset int64) int64 {
+	return testNow.Unix()/30 + offset
+}
+
+func testCode(t *testing.T, offset int64) string {
+	t.Helper()
+
+	code, err := utils.TOTPCode(testTOTPSecret, testNow.Add(time.Duration(offset*30)*time.Second))
+	if err != nil {
+		t.Fatalf("TOTPCode: %v", err)
+	}
+	return code
+}
+
+func TestVerifyTwoFactorCodeRejectsReplay(t *testing.T) {
+	mock := mockDB(t)
+	code := testCode(t, 0)
+
+	expectTOTPRow(mock, "u1", 0)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user_totp SET last_step = ?")).
+		WithArgs(testStep(0), "u1", testStep(0)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	usedRecovery, err := VerifyTwoFactorCode("u1", code)
+	if err != nil || usedRecovery {
+		t.Fatalf("first use = (%v, %v), want (false, nil)", usedRecovery, err)
+	}
+
+	// 再次提交同一验证码时 last_step 已推进，不再执行更新
+	expectTOTPRow(mock, "u1", testStep(0))
+	if _, err := VerifyTwoFactorCode("u1", code); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("replay err = %v, want ErrInvalidTwoFactorCode", err)
+	}
+
+	// 上一个时间步的验证码同样不能在之后使用
+	expectTOTPRow(mock, "u1", testStep(0))
+	if _, err := VerifyTwoFactorCode("u1", testCode(t, -1)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("older step err = %v, want ErrInvalidTwoFactorCode", err)
+	}
+}
+
+func TestVerifyTwoFactorCodeConcurrentReplay(t *testing.T) {
+	mock := mockDB(t)
+
+	// 并发请求已先一步推进 last_step，条件更新没有命中
+	expectTOTPRow(mock, "u1", 0)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user_totp SET last_step = ?")).
+		WithArgs(testStep(0), "u1", testStep(0)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if _, err := VerifyTwoFactorCode("u1", testCode(t, 0)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("err = %v, want ErrInvalidTwoFactorCode", err)
+	}
+}
+
+func TestVerifyTwoFactorCodeSkew(t *testing.T) {
+	mock := mockDB(t)
+
+	for _, offset := range []int64{-1, 1} {
+		expectTOTPRow(mock, "u1", 0)
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE user_totp SET last_step = ?")).
+			WithArgs(testStep(offset), "u1", testStep(offset)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		if _, err := VerifyTwoFactorCode("u1", testCode(t, offset)); err != nil {
+			t.Errorf("offset %d: err = %v, want nil", offset, err)
+		}
+	}
+
+	for _, offset := range []int64{-2, 2} {
+		expectTOTPRow(mock, "u1", 0)
+		if _, err := VerifyTwoFactorCode("u1", testCode(t, offset)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+			t.Errorf("offset %d: err = %v, want ErrInvalidTwoFactorCode", offset, err)
+		}
+	}
+}
+
+func TestVerifyTwoFactorCodeRecoveryCodeSingleUse(t *testing.T) {
+	mock := mockDB(t)
+	code := utils.GenerateRecoveryCode()
+	hash := utils.HashToken(normalizeRecoveryCode(code))
+
+	// 大小写和连字符不影响匹配
+	expectTOTPRow(mock, "u1", 0)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE recovery_codes SET used_at = ?")).
+		WithArgs(sqlmock.AnyArg(), hash, "u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	usedRecovery, err := VerifyTwoFactorCode("u1", " "+strings.ToUpper(strings.ReplaceAll(code, "-", ""))+" ")
+	if err != nil || !usedRecovery {
+		t.Fatalf("first use = (%v, %v), want (true, nil)", usedRecovery, err)
+	}
+
+	// 已使用的恢复码不再匹配 used_at IS NULL
+	expectTOTPRow(mock, "u1", 0)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE recovery_codes SET used_at = ?")).
+		WithArgs(sqlmock.AnyArg(), hash, "u1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if _, err := VerifyTwoFactorCode("u1", code); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("second use err = %v, want ErrInvalidTwoFactorCode", err)
+	}
+}
+
+func expectTwoFactorEnabled(mock sqlmock.Sqlmock, userID string, enabled bool) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM user_totp")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(enabled))
+}
+
+func expectRequireTwoFactor(mock sqlmock.Sqlmock, required bool) {
+	value := "false"
+	if required {
+		value = "true"
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT value FROM settings")).
+		WithArgs(settingRequireTwoFactor).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(value))
+}
+
+func TestLoginChallengeForNotRequired(t *testing.T) {
+	mock := mockDB(t)
+
+	expectTwoFactorEnabled(mock, "u1", false)
+	expectRequireTwoFactor(mock, false)
+
+	challenge, err := LoginChallengeFor("u1", SessionDevice{})
+	if err != nil || challenge != nil {
+		t.Fatalf("LoginChallengeFor = (%+v, %v), want (nil, nil)", challenge, err)
+	}
+}
+
+func TestLoginChallengeForEnabled(t *testing.T) {
+	mock := mockDB(t)
+
+	expectTwoFactorEnabled(mock, "u1", true)
+
+	challenge, err := LoginChallengeFor("u1", SessionDevice{Name: "iPhone", Platform: "ios"})
+	if err != nil {
+		t.Fatalf("LoginChallengeFor: %v", err)
+	}
+	if !challenge.TwoFactorRequired || challenge.EnrollmentRequired {
+		t.Errorf("challenge = %+v, want two-factor without enrollment", challenge)
+	}
+	if !challenge.ExpiresAt.Equal(testNow.Add(loginChallengeTTL)) {
+		t.Errorf("expires_at = %v, want %v", challenge.ExpiresAt, testNow.Add(loginChallengeTTL))
+	}
+
+	claims, err := ParseLoginChallenge(challenge.ChallengeToken)
+	if err != nil {
+		t.Fatalf("ParseLoginChallenge: %v", err)
+	}
+	if claims.UserID != "u1" || claims.Enroll || claims.DeviceName != "iPhone" || claims.Platform != "ios" {
+		t.Errorf("claims = %+v", claims)
+	}
+}
+
+// 管理员要求两步验证而用户尚未启用时，签发绑定用的挑战令牌，有效期更长
+func TestLoginChallengeForEnrollment(t *testing.T) {
+	mock := mockDB(t)
+
+	expectTwoFactorEnabled(mock, "u1", false)
+	expectRequireTwoFactor(mock, true)
+
+	challenge, err := LoginChallengeFor("u1", SessionDevice{})
+	if err != nil {
+		t.Fatalf("LoginChallengeFor: %v", err)
+	}
+	if !challenge.TwoFactorRequired || !challenge.EnrollmentRequired {
+		t.Errorf("challenge = %+v, want enrollment required", challenge)
+	}
+	if !challenge.ExpiresAt.Equal(testNow.Add(enrollChallengeTTL)) {
+		t.Errorf("expires_at = %v, want %v", challenge.ExpiresAt, testNow.Add(enrollChallengeTTL))
+	}
+
+	t.Cleanup(func() { twoFactorClock = func() time.Time { return testNow } })
+
+	// 登录挑战的有效期已过，绑定挑战仍然有效
+	twoFactorClock = func() time.Time { return testNow.Add(loginChallengeTTL + time.Minute) }
+	claims, err := ParseLoginChallenge(challenge.ChallengeToken)
+	if err != nil {
+		t.Fatalf("ParseLoginChallenge: %v", err)
+	}
+	if !claims.Enroll {
+		t.Error("claims.Enroll = false, want true")
+	}
+
+	twoFactorClock = func() time.Time { return testNow.Add(enrollChallengeTTL + time.Second) }
+	if _, err := ParseLoginChallenge(challenge.ChallengeToken); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("expired challenge err = %v, want ErrInvalidChallenge", err)
+	}
+}
+
+// 通过绑定挑战完成的启用流程：验证码正确后记录时间步并生成恢复码
+func TestEnableTwoFactor(t *testing.T) {
+	mock := mockDB(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT secret, enabled_at FROM user_totp")).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled_at"}).AddRow(testTOTPSecret, nil))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user_totp SET enabled_at = ?")).
+		WithArgs(sqlmock.AnyArg(), testStep(0), "u1", testTOTPSecret).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM recovery_codes")).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < recoveryCodeCount; i++ {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO recovery_codes")).
+			WithArgs(sqlmock.AnyArg(), "u1", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	codes, err := EnableTwoFactor("u1", testCode(t, 0))
+	if err != nil {
+		t.Fatalf("EnableTwoFactor: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+}
+
+func TestEnableTwoFactorWrongCode(t *testing.T) {
+	mock := mockDB(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT secret, enabled_at FROM user_totp")).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled_at"}).AddRow(testTOTPSecret, nil))
+
+	if _, err := EnableTwoFactor("u1", testCode(t, 2)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("err = %v, want ErrInvalidTwoFactorCode", err)
+	}
+}
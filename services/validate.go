@@ -0,0 +1,251 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"talkbox/config"
+	"talkbox/database"
+	"talkbox/models"
+)
+
+const (
+	maxTextLength        = 5000
+	maxMentions          = 50
+	maxFileNameLength    = 255
+	maxMimeTypeLength    = 100
+	maxCardTitleLength   = 100
+	maxCardContentLength = 2000
+	maxCardNoteLength    = 200
+	maxMediaDimension    = 20000
+)
+
+var cardColorPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// FieldError 描述单个字段的校验失败，Field 使用 content.url、content.mentions[0] 这样的路径
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"` // required, invalid, too_long, out_of_range, unknown_field, not_found, not_member
+	Message string `json:"message"`
+}
+
+// ValidationError 汇总一次校验中的所有字段错误
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Errors) == 0 {
+		return "invalid message"
+	}
+	return "invalid message: " + e.Errors[0].Field + " " + e.Errors[0].Message
+}
+
+func (e *ValidationError) add(field, code, message string) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Code: code, Message: message})
+}
+
+func (e *ValidationError) orNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ValidateContent 按消息类型严格校验内容：必填字段、长度限制、上传文件是否存在以及 @ 的用户是否为当前成员。
+// 所有发送和编辑入口共用此校验
+func ValidateContent(convID, msgType string, content json.RawMessage) error {
+	verr := &ValidationError{}
+
+	switch msgType {
+	case "text":
+		var c models.TextContent
+		if decodeContent(content, &c, verr) {
+			validateText(convID, &c, verr)
+		}
+	case "image":
+		var c models.ImageContent
+		if decodeContent(content, &c, verr) {
+			validateUploadURL("content.url", c.URL, true, verr)
+			validateUploadURL("content.thumbnail", c.Thumbnail, false, verr)
+			validateRange("content.width", int64(c.Width), maxMediaDimension, verr)
+			validateRange("content.height", int64(c.Height), maxMediaDimension, verr)
+			validateRange("content.size", c.Size, -1, verr)
+		}
+	case "video":
+		var c models.VideoContent
+		if decodeContent(content, &c, verr) {
+			validateUploadURL("content.url", c.URL, true, verr)
+			validateUploadURL("content.thumbnail", c.Thumbnail, false, verr)
+			validateRange("content.duration", int64(c.Duration), -1, verr)
+			validateRange("content.size", c.Size, -1, verr)
+		}
+	case "file":
+		var c models.FileContent
+		if decodeContent(content, &c, verr) {
+			validateUploadURL("content.url", c.URL, true, verr)
+			validateString("content.name", c.Name, true, maxFileNameLength, verr)
+			validateString("content.mime_type", c.MimeType, false, maxMimeTypeLength, verr)
+			validateRange("content.size", c.Size, -1, verr)
+		}
+	case "card":
+		var c models.CardContent
+		if decodeContent(content, &c, verr) {
+			validateString("content.title", c.Title, true, maxCardTitleLength, verr)
+			validateString("content.content", c.Content, false, maxCardContentLength, verr)
+			validateString("content.note", c.Note, false, maxCardNoteLength, verr)
+			if c.Color != "" && !cardColorPattern.MatchString(c.Color) {
+				verr.add("content.color", "invalid", "must be a hex color like #1890FF")
+			}
+			if c.URL != "" {
+				validateLinkURL("content.url", c.URL, verr)
+			}
+		}
+	default:
+		verr.add("type", "invalid", "must be one of text, image, video, file, card")
+	}
+
+	return verr.orNil()
+}
+
+// decodeContent 严格解析内容 JSON：必须是对象，不允许未知字段和类型不匹配
+func decodeContent(content json.RawMessage, v interface{}, verr *ValidationError) bool {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		verr.add("content", "invalid", "must be a JSON object")
+		return false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeErr):
+			verr.add("content."+typeErr.Field, "invalid", "must be of type "+typeErr.Type.String())
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			verr.add("content."+field, "unknown_field", "is not allowed")
+		default:
+			verr.add("content", "invalid", "must be valid JSON")
+		}
+		return false
+	}
+	if decoder.More() {
+		verr.add("content", "invalid", "must contain a single JSON object")
+		return false
+	}
+	return true
+}
+
+func validateText(convID string, c *models.TextContent, verr *ValidationError) {
+	validateString("content.text", c.Text, true, maxTextLength, verr)
+
+	if len(c.Mentions) > maxMentions {
+		verr.add("content.mentions", "too_long", fmt.Sprintf("must contain at most %d users", maxMentions))
+		return
+	}
+	if len(c.Mentions) == 0 {
+		return
+	}
+
+	members, err := currentMembers(convID, c.Mentions)
+	if err != nil {
+		verr.add("content.mentions", "invalid", "could not be verified")
+		return
+	}
+	for i, userID := range c.Mentions {
+		if !members[userID] {
+			verr.add(fmt.Sprintf("content.mentions[%d]", i), "not_member", "is not a member of this conversation")
+		}
+	}
+}
+
+func validateString(field, value string, required bool, maxLength int, verr *ValidationError) {
+	if strings.TrimSpace(value) == "" {
+		if required {
+			verr.add(field, "required", "is required")
+		}
+		return
+	}
+	if utf8.RuneCountInString(value) > maxLength {
+		verr.add(field, "too_long", fmt.Sprintf("must be at most %d characters", maxLength))
+	}
+}
+
+// validateRange 校验数值不能为负数，max 小于 0 表示不限上限
+func validateRange(field string, value, max int64, verr *ValidationError) {
+	if value < 0 || (max >= 0 && value > max) {
+		verr.add(field, "out_of_range", "is out of range")
+	}
+}
+
+// validateUploadURL 要求地址指向本服务上传的文件（/files/<filename>）且文件确实存在
+func validateUploadURL(field, value string, required bool, verr *ValidationError) {
+	if value == "" {
+		if required {
+			verr.add(field, "required", "is required")
+		}
+		return
+	}
+
+	if !strings.HasPrefix(value, "/files/") {
+		verr.add(field, "invalid", "must be an uploaded file URL starting with /files/")
+		return
+	}
+
+	filename := strings.TrimPrefix(value, "/files/")
+	if filename == "" || filename != filepath.Base(filepath.Clean(filename)) || filename == "." || filename == ".." {
+		verr.add(field, "invalid", "is not a valid file URL")
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(config.Cfg.UploadDir, filename)); err != nil {
+		verr.add(field, "not_found", "refers to a file that does not exist")
+	}
+}
+
+// validateLinkURL 允许 http(s) 链接或本服务上传的文件
+func validateLinkURL(field, value string, verr *ValidationError) {
+	if strings.HasPrefix(value, "/files/") {
+		validateUploadURL(field, value, true, verr)
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		verr.add(field, "invalid", "must be an http or https URL")
+	}
+}
+
+// currentMembers 返回 userIDs 中属于该会话成员的用户
+func currentMembers(convID string, userIDs []string) (map[string]bool, error) {
+	placeholders, idArgs := InClause(userIDs)
+	args := append([]interface{}{convID}, idArgs...)
+
+	rows, err := database.DB.Query(
+		"SELECT user_id FROM conversation_members WHERE conversation_id = ? AND user_id IN ("+placeholders+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[string]bool)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err == nil {
+			members[userID] = true
+		}
+	}
+	return members, rows.Err()
+}
@@ -0,0 +1,70 @@
+package utils
+
+import "strings"
+
+// IsEmoji 判断 s 是否为单个 emoji：国旗、键帽，或由零宽连接符组合的表情序列，
+// 每个表情可带变体选择符、肤色修饰和标签序列。不依赖完整的 Unicode emoji 数据，按码位范围近似判断
+func IsEmoji(s string) bool {
+	runes := []rune(s)
+	n := len(runes)
+	if n == 0 {
+		return false
+	}
+
+	if n == 2 && isRegionalIndicator(runes[0]) && isRegionalIndicator(runes[1]) {
+		return true
+	}
+	if (n == 2 || n == 3) && strings.ContainsRune("0123456789#*", runes[0]) && runes[n-1] == 0x20E3 &&
+		(n == 2 || runes[1] == 0xFE0F) {
+		return true
+	}
+
+	i := 0
+	for {
+		if i >= n || !isPictographic(runes[i]) {
+			return false
+		}
+		i++
+		if i < n && runes[i] == 0xFE0F {
+			i++
+		}
+		if i < n && runes[i] >= 0x1F3FB && runes[i] <= 0x1F3FF {
+			i++
+		}
+		for i < n && runes[i] >= 0xE0020 && runes[i] <= 0xE007F {
+			i++
+		}
+		if i == n {
+			return true
+		}
+		if runes[i] != 0x200D {
+			return false
+		}
+		i++
+	}
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// pictographicRanges 是可作为 emoji 主体的码位范围
+var pictographicRanges = [][2]rune{
+	{0x00A9, 0x00A9}, {0x00AE, 0x00AE}, {0x203C, 0x203C}, {0x2049, 0x2049},
+	{0x2122, 0x2122}, {0x2139, 0x2139}, {0x2194, 0x2199}, {0x21A9, 0x21AA},
+	{0x231A, 0x231B}, {0x2328, 0x2328}, {0x23CF, 0x23CF}, {0x23E9, 0x23F3},
+	{0x23F8, 0x23FA}, {0x24C2, 0x24C2}, {0x25AA, 0x25AB}, {0x25B6, 0x25B6},
+	{0x25C0, 0x25C0}, {0x25FB, 0x25FE}, {0x2600, 0x27BF}, {0x2934, 0x2935},
+	{0x2B05, 0x2B07}, {0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55},
+	{0x3030, 0x3030}, {0x303D, 0x303D}, {0x3297, 0x3297}, {0x3299, 0x3299},
+	{0x1F000, 0x1F1E5}, {0x1F200, 0x1F3FA}, {0x1F400, 0x1FAFF},
+}
+
+func isPictographic(r rune) bool {
+	for _, rg := range pictographicRanges {
+		if r >= rg[0] && r <= rg[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package utils
+
+import "testing"
+
+func TestIsEmoji(t *testing.T) {
+	valid := []string{
+		"👍", "❤️", "👍🏽", "🇨🇳", "1️⃣", "#⃣",
+		"👨‍👩‍👧", "🏳️‍🌈", "🏴󠁧󠁢󠁳󠁣󠁴󠁿", "🧑🏿‍💻",
+	}
+	for _, s := range valid {
+		if !IsEmoji(s) {
+			t.Errorf("IsEmoji(%q) = false, want true", s)
+		}
+	}
+
+	invalid := []string{
+		"", "a", "ok", "1", " 👍", "👍 ", "👍👍", "👍\n", "\u0000",
+		"‍👍", "👍‍", "🇨", "<script>",
+	}
+	for _, s := range invalid {
+		if IsEmoji(s) {
+			t.Errorf("IsEmoji(%q) = true, want false", s)
+		}
+	}
+}
@@ -8,36 +8,93 @@ import (
 	"talkbox/config"
 )
 
+// Claims 是访问令牌的内容，SessionID 指向签发该令牌的登录会话，会话被撤销后令牌随之失效
 type Claims struct {
-	UserID string `json:"user_id"`
+	UserID    string `json:"user_id"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(userID string) (string, error) {
+// GenerateToken 为会话签发短期访问令牌，返回令牌和过期时间
+func GenerateToken(userID, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(config.Cfg.AccessTokenTTL)
 	claims := Claims{
-		UserID: userID,
+		UserID:    userID,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.Cfg.JWTSecret))
+	signed, err := token.SignedString([]byte(config.Cfg.JWTSecret))
+	return signed, expiresAt, err
 }
 
+// ParseToken 校验访问令牌的签名和有效期。不带会话的旧版令牌无法撤销，一律视为无效
 func ParseToken(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		return []byte(config.Cfg.JWTSecret), nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && claims.SessionID != "" {
 		return claims, nil
 	}
 
 	return nil, errors.New("invalid token")
 }
+
+// challengeAudience 区分两步验证的挑战令牌和访问令牌，两者不能互换使用
+const challengeAudience = "2fa-challenge"
+
+// ChallengeClaims 是密码校验通过、等待两步验证时签发的挑战令牌内容。
+// Enroll 表示用户尚未启用两步验证但管理员要求启用，需先完成绑定。
+// 设备信息在登录时上报，完成验证后用于创建会话
+type ChallengeClaims struct {
+	UserID     string `json:"user_id"`
+	Enroll     bool   `json:"enroll,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// GenerateChallengeToken 签发挑战令牌，now 为签发时间
+func GenerateChallengeToken(claims ChallengeClaims, now time.Time, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := now.Add(ttl)
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{challengeAudience},
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString([]byte(config.Cfg.JWTSecret))
+	return signed, expiresAt, err
+}
+
+// ParseChallengeToken 校验挑战令牌，now 为校验时间
+func ParseChallengeToken(tokenString string, now time.Time) (*ChallengeClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &ChallengeClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return []byte(config.Cfg.JWTSecret), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithAudience(challengeAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims, ok := token.Claims.(*ChallengeClaims); ok && token.Valid && claims.UserID != "" {
+		return claims, nil
+	}
+
+	return nil, errors.New("invalid challenge token")
+}
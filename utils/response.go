@@ -1,6 +1,12 @@
 package utils
 
-import "github.com/gin-gonic/gin"
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
 
 type Response struct {
 	Code    int         `json:"code"`
@@ -26,6 +32,15 @@ func BadRequest(c *gin.Context, message string) {
 	Error(c, 400, message)
 }
 
+// BadRequestWithData 返回 400 并在 data 中附带详细错误，例如字段级校验结果
+func BadRequestWithData(c *gin.Context, message string, data interface{}) {
+	c.JSON(400, Response{
+		Code:    400,
+		Message: message,
+		Data:    data,
+	})
+}
+
 func Unauthorized(c *gin.Context, message string) {
 	Error(c, 401, message)
 }
@@ -38,6 +53,17 @@ func NotFound(c *gin.Context, message string) {
 	Error(c, 404, message)
 }
 
+// TooManyRequests 返回 429，Retry-After 头和 data.retry_after 为需要等待的秒数
+func TooManyRequests(c *gin.Context, message string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(429, Response{
+		Code:    429,
+		Message: message,
+		Data:    gin.H{"retry_after": seconds},
+	})
+}
+
 func InternalError(c *gin.Context, message string) {
 	Error(c, 500, message)
 }
@@ -2,7 +2,10 @@ package utils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
 	"encoding/hex"
+	"strings"
 
 	"github.com/google/uuid"
 )
@@ -12,9 +15,39 @@ func GenerateUUID() string {
 }
 
 func GenerateBotToken() string {
-	bytes := make([]byte, 32)
+	return randomHex(32)
+}
+
+// GenerateRefreshToken 生成不透明的刷新令牌，服务端只保存其哈希
+func GenerateRefreshToken() string {
+	return randomHex(32)
+}
+
+// GeneratePasswordResetToken 生成一次性的密码重置令牌，服务端只保存其哈希
+func GeneratePasswordResetToken() string {
+	return randomHex(32)
+}
+
+// GenerateRecoveryCode 生成两步验证的恢复码，形如 abcde-fghij，服务端只保存其哈希
+func GenerateRecoveryCode() string {
+	bytes := make([]byte, 10)
+	if _, err := rand.Read(bytes); err != nil {
+		panic("failed to generate recovery code: " + err.Error())
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(bytes))[:10]
+	return code[:5] + "-" + code[5:]
+}
+
+func randomHex(n int) string {
+	bytes := make([]byte, n)
 	if _, err := rand.Read(bytes); err != nil {
 		panic("failed to generate random token: " + err.Error())
 	}
 	return hex.EncodeToString(bytes)
 }
+
+// HashToken 返回令牌的 SHA-256 十六进制摘要，用于存储和查找
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"talkbox/config"
+)
+
+// rfc6238Secret 是 RFC 6238 附录 B 中 SHA1 测试向量的密钥 "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 给出的是 8 位验证码，6 位验证码取其后 6 位
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		code, err := TOTPCode(rfc6238Secret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatalf("TOTPCode(%d): %v", v.unix, err)
+		}
+		if code != v.code {
+			t.Errorf("TOTPCode(%d) = %s, want %s", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	for _, offset := range []int64{-1, 0, 1} {
+		code, _ := TOTPCode(rfc6238Secret, now.Add(time.Duration(offset*totpPeriod)*time.Second))
+		step, ok := ValidateTOTP(rfc6238Secret, code, now)
+		if !ok || step != current+offset {
+			t.Errorf("offset %d: ValidateTOTP = (%d, %v), want (%d, true)", offset, step, ok, current+offset)
+		}
+	}
+
+	for _, offset := range []int64{-2, 2} {
+		code, _ := TOTPCode(rfc6238Secret, now.Add(time.Duration(offset*totpPeriod)*time.Second))
+		if _, ok := ValidateTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("offset %d: code outside the skew window was accepted", offset)
+		}
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := ValidateTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("ValidateTOTP(%q) = true, want false", code)
+		}
+	}
+}
+
+func setTestJWTSecret(t *testing.T) {
+	t.Helper()
+
+	prev := config.Cfg
+	config.Cfg = &config.Config{JWTSecret: "test-secret", AccessTokenTTL: time.Minute}
+	t.Cleanup(func() { config.Cfg = prev })
+}
+
+func TestChallengeTokenExpiry(t *testing.T) {
+	setTestJWTSecret(t)
+
+	now := time.Unix(1700000000, 0)
+	token, expiresAt, err := GenerateChallengeToken(ChallengeClaims{UserID: "u1", Enroll: true}, now, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateChallengeToken: %v", err)
+	}
+	if !expiresAt.Equal(now.Add(5 * time.Minute)) {
+		t.Errorf("expiresAt = %v, want %v", expiresAt, now.Add(5*time.Minute))
+	}
+
+	claims, err := ParseChallengeToken(token, now.Add(4*time.Minute))
+	if err != nil {
+		t.Fatalf("ParseChallengeToken before expiry: %v", err)
+	}
+	if claims.UserID != "u1" || !claims.Enroll {
+		t.Errorf("claims = %+v, want user u1 with enroll", claims)
+	}
+
+	if _, err := ParseChallengeToken(token, now.Add(6*time.Minute)); err == nil {
+		t.Error("ParseChallengeToken accepted an expired token")
+	}
+}
+
+func TestChallengeTokenAudience(t *testing.T) {
+	setTestJWTSecret(t)
+
+	// 访问令牌不能当作挑战令牌使用
+	access, _, err := GenerateToken("u1", "s1")
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	if _, err := ParseChallengeToken(access, time.Now()); err == nil {
+		t.Error("ParseChallengeToken accepted an access token")
+	}
+
+	// 同一密钥签发但受众不同的令牌
+	now := time.Now()
+	other := jwt.NewWithClaims(jwt.SigningMethodHS256, ChallengeClaims{
+		UserID: "u1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{"other"},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	})
+	signed, err := other.SignedString([]byte(config.Cfg.JWTSecret))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := ParseChallengeToken(signed, now); err == nil {
+		t.Error("ParseChallengeToken accepted a token with another audience")
+	}
+
+	// 挑战令牌也不能当作访问令牌使用
+	challenge, _, err := GenerateChallengeToken(ChallengeClaims{UserID: "u1"}, now, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateChallengeToken: %v", err)
+	}
+	if _, err := ParseToken(challenge); err == nil {
+		t.Error("ParseToken accepted a challenge token")
+	}
+}
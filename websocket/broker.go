@@ -0,0 +1,48 @@
+package websocket
+
+import "encoding/json"
+
+// Envelope 是在节点间分发的事件，由每个节点投递给本节点上的目标用户连接
+type Envelope struct {
+	UserIDs   []string        `json:"user_ids"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Transient bool            `json:"transient,omitempty"` // 不分配 seq、不写入事件日志
+}
+
+// Broker 负责事件扇出和集群范围的在线状态。单节点使用内存实现，
+// 多节点部署时使用 Redis 实现，使任意节点发出的事件都能到达所有节点上的连接
+type Broker interface {
+	// Start 开始接收事件，deliver 将事件投递到本节点的连接，localUsers 返回本节点有连接的用户
+	Start(deliver func(*Envelope), localUsers func() []string) error
+	Publish(env *Envelope) error
+	// SetOnline 在用户于本节点的第一个连接建立、最后一个连接断开时调用
+	SetOnline(userID string, online bool)
+	// IsOnline 判断用户是否在其他节点上有连接
+	IsOnline(userID string) bool
+}
+
+// memoryBroker 直接投递到本节点，即单节点部署的行为
+type memoryBroker struct {
+	deliver func(*Envelope)
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{}
+}
+
+func (b *memoryBroker) Start(deliver func(*Envelope), localUsers func() []string) error {
+	b.deliver = deliver
+	return nil
+}
+
+func (b *memoryBroker) Publish(env *Envelope) error {
+	b.deliver(env)
+	return nil
+}
+
+func (b *memoryBroker) SetOnline(userID string, online bool) {}
+
+func (b *memoryBroker) IsOnline(userID string) bool {
+	return false
+}
@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisEventChannel = "talkbox:events"
+	redisOnlinePrefix = "talkbox:online:"
+	// 节点定期续期本节点在线用户，节点异常退出后其记录在 TTL 后自动失效
+	redisOnlineTTL     = 60 * time.Second
+	redisOnlineRefresh = 20 * time.Second
+	redisTimeout       = 3 * time.Second
+)
+
+// redisBroker 通过 Redis pub/sub 在节点间分发事件。
+// 在线状态保存在每个用户的有序集合中，成员为节点 ID，分数为过期时间
+type redisBroker struct {
+	client  *redis.Client
+	nodeID  string
+	deliver func(*Envelope)
+}
+
+func NewRedisBroker(client *redis.Client) Broker {
+	return &redisBroker{client: client, nodeID: uuid.New().String()}
+}
+
+func (b *redisBroker) Start(deliver func(*Envelope), localUsers func() []string) error {
+	b.deliver = deliver
+
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, redisEventChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	// 连接断开后 go-redis 会自动重连并重新订阅
+	go func() {
+		for msg := range pubsub.Channel() {
+			var env Envelope
+			if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+				log.Printf("invalid event from redis: %v", err)
+				continue
+			}
+			deliver(&env)
+		}
+	}()
+
+	go b.refreshOnline(localUsers)
+	return nil
+}
+
+// Publish 发布到所有节点（包括本节点），发布失败时至少投递给本节点的连接
+func (b *redisBroker) Publish(env *Envelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := b.client.Publish(ctx, redisEventChannel, payload).Err(); err != nil {
+		log.Printf("failed to publish event to redis: %v", err)
+		b.deliver(env)
+		return err
+	}
+	return nil
+}
+
+func (b *redisBroker) SetOnline(userID string, online bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	key := redisOnlinePrefix + userID
+	var err error
+	if online {
+		_, err = b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			b.markOnline(ctx, pipe, key, time.Now())
+			return nil
+		})
+	} else {
+		err = b.client.ZRem(ctx, key, b.nodeID).Err()
+	}
+	if err != nil {
+		log.Printf("failed to update online state in redis: %v", err)
+	}
+}
+
+func (b *redisBroker) IsOnline(userID string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	count, err := b.client.ZCount(ctx, redisOnlinePrefix+userID, "("+now, "+inf").Result()
+	return err == nil && count > 0
+}
+
+func (b *redisBroker) markOnline(ctx context.Context, pipe redis.Pipeliner, key string, now time.Time) {
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.Add(redisOnlineTTL).Unix()), Member: b.nodeID})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Unix(), 10))
+	pipe.Expire(ctx, key, redisOnlineTTL)
+}
+
+func (b *redisBroker) refreshOnline(localUsers func() []string) {
+	ticker := time.NewTicker(redisOnlineRefresh)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		userIDs := localUsers()
+		if len(userIDs) == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, userID := range userIDs {
+				b.markOnline(ctx, pipe, redisOnlinePrefix+userID, now)
+			}
+			return nil
+		})
+		cancel()
+		if err != nil {
+			log.Printf("failed to refresh online state in redis: %v", err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package websocket
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"talkbox/database"
+)
+
+// startRedisHub 启动一个连接到 mr 的 Hub，模拟集群中的一个节点
+func startRedisHub(t *testing.T, mr *miniredis.Miniredis) *Hub {
+	t.Helper()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	hub := NewHub(NewRedisBroker(client))
+	if err := hub.broker.Start(hub.deliver, hub.localUsers); err != nil {
+		t.Fatalf("start broker: %v", err)
+	}
+	go hub.Run()
+	return hub
+}
+
+// connectClient 在 hub 上注册一个用户连接并读掉 connected 帧
+func connectClient(t *testing.T, hub *Hub, userID string) *Client {
+	t.Helper()
+
+	client := &Client{ID: uuid.New().String(), UserID: userID, Hub: hub, Send: make(chan []byte, 16)}
+	hub.register <- client
+	if event := readEvent(t, client); event.Event != "connected" {
+		t.Fatalf("first event = %q, want connected", event.Event)
+	}
+	return client
+}
+
+func readEvent(t *testing.T, client *Client) Message {
+	t.Helper()
+
+	select {
+	case frame := <-client.Send:
+		var msg Message
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			t.Fatalf("invalid frame %s: %v", frame, err)
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return Message{}
+	}
+}
+
+// dbMock 在整个测试包中替换 database.DB。Hub 的后台 goroutine 在测试结束后仍会异步读写 users 表，
+// 因此不在测试之间恢复；这些调用没有预期，返回错误后被忽略
+var dbMock sqlmock.Sqlmock
+
+func TestMain(m *testing.M) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	database.DB = db
+	dbMock = mock
+
+	os.Exit(m.Run())
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisBrokerSendToUserAcrossNodes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	nodeA := startRedisHub(t, mr)
+	nodeB := startRedisHub(t, mr)
+
+	client := connectClient(t, nodeB, "alice")
+
+	nodeA.SendToUser("alice", &Message{Event: "new_message", Data: map[string]string{"id": "m1"}})
+
+	event := readEvent(t, client)
+	if event.Event != "new_message" {
+		t.Fatalf("event = %q, want new_message", event.Event)
+	}
+	if event.Seq == 0 {
+		t.Error("reliable event delivered without seq")
+	}
+	if data, _ := event.Data.(map[string]interface{}); data["id"] != "m1" {
+		t.Errorf("data = %v, want id m1", event.Data)
+	}
+}
+
+func TestRedisBrokerBroadcastToConversationAcrossNodes(t *testing.T) {
+	dbMock.ExpectQuery("SELECT user_id FROM conversation_members").
+		WithArgs("conv1").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("alice").AddRow("bob"))
+
+	mr := miniredis.RunT(t)
+	nodeA := startRedisHub(t, mr)
+	nodeB := startRedisHub(t, mr)
+
+	alice := connectClient(t, nodeA, "alice")
+	bob := connectClient(t, nodeB, "bob")
+
+	previous := HubInstance
+	HubInstance = nodeA
+	t.Cleanup(func() { HubInstance = previous })
+
+	BroadcastToConversation("conv1", &Message{Event: "new_message", Data: map[string]string{"id": "m1"}})
+
+	for _, client := range []*Client{alice, bob} {
+		if event := readEvent(t, client); event.Event != "new_message" {
+			t.Errorf("%s got %q, want new_message", client.UserID, event.Event)
+		}
+	}
+}
+
+func TestRedisBrokerIsOnlineClusterWide(t *testing.T) {
+	mr := miniredis.RunT(t)
+	nodeA := startRedisHub(t, mr)
+	nodeB := startRedisHub(t, mr)
+
+	if nodeA.IsOnline("alice") {
+		t.Fatal("alice online before connecting")
+	}
+
+	client := connectClient(t, nodeB, "alice")
+	waitFor(t, "alice online on node A", func() bool { return nodeA.IsOnline("alice") })
+
+	nodeB.unregister <- client
+	waitFor(t, "alice offline on node A", func() bool { return !nodeA.IsOnline("alice") })
+}
+
+// 快速断开再重连时，在线状态按连接事件的顺序生效，最终为在线
+func TestRedisBrokerReconnectStaysOnline(t *testing.T) {
+	mr := miniredis.RunT(t)
+	nodeA := startRedisHub(t, mr)
+	nodeB := startRedisHub(t, mr)
+
+	for i := 0; i < 20; i++ {
+		client := connectClient(t, nodeB, "alice")
+		nodeB.unregister <- client
+	}
+	connectClient(t, nodeB, "alice")
+
+	waitFor(t, "alice online on node A", func() bool { return nodeA.IsOnline("alice") })
+	// 等待队列中的更新全部应用后再确认
+	time.Sleep(100 * time.Millisecond)
+	if !nodeA.IsOnline("alice") {
+		t.Fatal("alice offline after reconnecting")
+	}
+}
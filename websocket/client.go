@@ -1,10 +1,10 @@
 package websocket
 
 import (
-	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,7 +13,6 @@ import (
 	"github.com/gorilla/websocket"
 	"talkbox/config"
 	"talkbox/database"
-	"talkbox/models"
 	"talkbox/utils"
 )
 
@@ -58,11 +57,33 @@ var upgrader = websocket.Upgrader{
 }
 
 type Client struct {
-	ID     string
-	UserID string
-	Hub    *Hub
-	Conn   *websocket.Conn
-	Send   chan []byte
+	ID        string
+	UserID    string
+	SessionID string
+	Hub       *Hub
+	Conn      *websocket.Conn
+	Send      chan []byte
+
+	protocol      int
+	typingLimiter *tokenBucket
+
+	// 重连时客户端提供的 epoch 和最后收到的 seq
+	resume      bool
+	resumeEpoch string
+	resumeSeq   uint64
+	// 发送缓冲区已满或会话已撤销、即将被断开，受 Hub.mu 保护
+	lagging bool
+}
+
+// ActionHandler 处理客户端发来的业务动作。业务逻辑在 handlers 包中实现，
+// 由 main 通过 HandleAction 注册，避免 websocket 包反向依赖业务包。
+type ActionHandler func(c *Client, msg *ClientMessage)
+
+var actionHandlers = make(map[string]ActionHandler)
+
+// HandleAction 注册动作处理函数，需在服务启动前调用
+func HandleAction(action string, handler ActionHandler) {
+	actionHandlers[action] = handler
 }
 
 func (c *Client) ReadPump() {
@@ -129,105 +150,89 @@ func (c *Client) WritePump() {
 func (c *Client) handleMessage(message []byte) {
 	var msg ClientMessage
 	if err := json.Unmarshal(message, &msg); err != nil {
+		c.Error(&msg, ErrCodeInvalidPayload, "invalid JSON", nil)
 		return
 	}
 
 	switch msg.Action {
+	case "hello":
+		c.handleHello(&msg)
 	case "ping":
-		c.sendPong()
-	case "send_message":
-		c.handleSendMessage(&msg)
+		c.sendPong(&msg)
+	case "typing_start":
+		c.handleTyping(&msg, true)
+	case "typing_stop":
+		c.handleTyping(&msg, false)
+	default:
+		handler, ok := actionHandlers[msg.Action]
+		if !ok {
+			c.Error(&msg, ErrCodeInvalidPayload, "unknown action", nil)
+			return
+		}
+		handler(c, &msg)
 	}
 }
 
-func (c *Client) sendPong() {
-	response := &Message{Event: "pong"}
-	data, _ := json.Marshal(response)
-	c.Send <- data
-}
-
-func (c *Client) handleSendMessage(msg *ClientMessage) {
-	if !c.isConversationMember(msg.ConversationID) {
+// SendEvent 仅向当前连接发送事件，用于 ack/error 等只回给请求方的帧。
+// 持有 Hub 读锁保证连接未被注销（Send 未关闭），缓冲区已满时丢弃
+func (c *Client) SendEvent(msg *Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
 		return
 	}
 
-	msgID := uuid.New().String()
-	now := time.Now()
+	c.Hub.mu.RLock()
+	defer c.Hub.mu.RUnlock()
 
-	// 正确处理 reply_to_id：空字符串应为 NULL
-	replyToID := sql.NullString{String: msg.ReplyToID, Valid: msg.ReplyToID != ""}
+	if _, ok := c.Hub.clients[c.ID]; !ok || c.lagging {
+		return
+	}
+	select {
+	case c.Send <- data:
+	default:
+	}
+}
 
-	_, err := database.DB.Exec(`
-		INSERT INTO messages (id, conversation_id, sender_id, sender_type, type, content, reply_to_id, created_at, updated_at)
-		VALUES (?, ?, ?, 'user', ?, ?, ?, ?, ?)
-	`, msgID, msg.ConversationID, c.UserID, msg.Type, string(msg.Content), replyToID, now, now)
+func (c *Client) sendPong(msg *ClientMessage) {
+	c.SendEvent(&Message{Event: "pong", RequestID: msg.RequestID})
+}
 
-	if err != nil {
+// handleTyping 处理输入状态。每个连接单独限流，每次开始或刷新都校验成员身份，已被移出会话的用户的输入状态随即清除
+func (c *Client) handleTyping(msg *ClientMessage, typing bool) {
+	if msg.ConversationID == "" {
+		c.Error(msg, ErrCodeInvalidPayload, "conversation_id is required", nil)
+		return
+	}
+	if !c.typingLimiter.Allow() {
+		c.Error(msg, ErrCodeRateLimited, "too many typing updates", nil)
 		return
 	}
 
-	database.DB.Exec("UPDATE conversations SET updated_at = ? WHERE id = ?", now, msg.ConversationID)
-
-	var user models.User
-	database.DB.QueryRow(
-		"SELECT id, username, nickname, avatar FROM users WHERE id = ?",
-		c.UserID,
-	).Scan(&user.ID, &user.Username, &user.Nickname, &user.Avatar)
-
-	broadcastMsg := &Message{
-		Event: "new_message",
-		Data: map[string]interface{}{
-			"id":              msgID,
-			"conversation_id": msg.ConversationID,
-			"sender": map[string]interface{}{
-				"id":       c.UserID,
-				"type":     "user",
-				"nickname": user.Nickname,
-				"avatar":   user.Avatar,
-			},
-			"type":       msg.Type,
-			"content":    msg.Content,
-			"reply_to":   nil,
-			"created_at": now.Format(time.RFC3339),
-		},
+	if !typing {
+		c.Hub.typing.stop(msg.ConversationID, c.UserID)
+		c.Ack(msg, nil)
+		return
 	}
 
-	memberIDs := c.getConversationMembers(msg.ConversationID)
-	c.Hub.SendToUsers(memberIDs, broadcastMsg)
-
-	if msg.Type == "text" {
-		var textContent models.TextContent
-		if err := json.Unmarshal(msg.Content, &textContent); err == nil && len(textContent.Mentions) > 0 {
-			for _, mentionedUserID := range textContent.Mentions {
-				mentionID := uuid.New().String()
-				database.DB.Exec(
-					"INSERT INTO mentions (id, message_id, user_id, created_at) VALUES (?, ?, ?, ?)",
-					mentionID, msgID, mentionedUserID, now,
-				)
-
-				c.Hub.SendToUser(mentionedUserID, &Message{
-					Event: "mentioned",
-					Data: map[string]interface{}{
-						"message_id":      msgID,
-						"conversation_id": msg.ConversationID,
-						"sender_name":     user.Nickname,
-					},
-				})
-			}
-		}
+	if !c.Hub.typing.isMember(msg.ConversationID, c.UserID) {
+		c.Hub.typing.stop(msg.ConversationID, c.UserID)
+		c.Error(msg, ErrCodeNotMember, "not a member of this conversation", nil)
+		return
 	}
+	c.Hub.typing.start(msg.ConversationID, c.UserID)
+	c.Ack(msg, nil)
 }
 
-func (c *Client) isConversationMember(convID string) bool {
+func isConversationMember(convID, userID string) bool {
 	var exists bool
 	database.DB.QueryRow(
 		"SELECT EXISTS(SELECT 1 FROM conversation_members WHERE conversation_id = ? AND user_id = ?)",
-		convID, c.UserID,
+		convID, userID,
 	).Scan(&exists)
 	return exists
 }
 
-func (c *Client) getConversationMembers(convID string) []string {
+func getConversationMembers(convID string) []string {
 	rows, err := database.DB.Query(
 		"SELECT user_id FROM conversation_members WHERE conversation_id = ?",
 		convID,
@@ -260,6 +265,35 @@ func HandleWebSocket(c *gin.Context) {
 		return
 	}
 
+	denied, err := database.IsSessionDenied(claims.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify session"})
+		return
+	}
+	if denied {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "session has been revoked"})
+		return
+	}
+
+	protocol := ProtocolV1
+	if v := c.Query("protocol"); v != "" {
+		protocol, err = strconv.Atoi(v)
+		if err != nil || !isSupportedProtocol(protocol) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported protocol version"})
+			return
+		}
+	}
+
+	var resumeSeq uint64
+	sinceSeq := c.Query("since_seq")
+	if sinceSeq != "" {
+		resumeSeq, err = strconv.ParseUint(sinceSeq, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since_seq"})
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("websocket upgrade error: %v", err)
@@ -267,11 +301,19 @@ func HandleWebSocket(c *gin.Context) {
 	}
 
 	client := &Client{
-		ID:     uuid.New().String(),
-		UserID: claims.UserID,
-		Hub:    HubInstance,
-		Conn:   conn,
-		Send:   make(chan []byte, 256),
+		ID:        uuid.New().String(),
+		UserID:    claims.UserID,
+		SessionID: claims.SessionID,
+		Hub:       HubInstance,
+		Conn:      conn,
+		Send:      make(chan []byte, 256),
+
+		protocol:      protocol,
+		typingLimiter: newTokenBucket(5, 1),
+
+		resume:      sinceSeq != "",
+		resumeEpoch: c.Query("epoch"),
+		resumeSeq:   resumeSeq,
 	}
 
 	client.Hub.register <- client
@@ -281,22 +323,5 @@ func HandleWebSocket(c *gin.Context) {
 }
 
 func BroadcastToConversation(convID string, msg *Message) {
-	rows, err := database.DB.Query(
-		"SELECT user_id FROM conversation_members WHERE conversation_id = ?",
-		convID,
-	)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-
-	var members []string
-	for rows.Next() {
-		var userID string
-		if err := rows.Scan(&userID); err == nil {
-			members = append(members, userID)
-		}
-	}
-
-	HubInstance.SendToUsers(members, msg)
+	HubInstance.SendToUsers(getConversationMembers(convID), msg)
 }
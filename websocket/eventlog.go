@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// 每个用户最多保留的事件数，需小于连接发送缓冲区，保证补发时不会阻塞
+	eventLogSize = 200
+	// 事件保留时间，也是用户全部断开后日志的保留时间
+	eventLogRetention     = 5 * time.Minute
+	eventLogSweepInterval = time.Minute
+)
+
+type loggedEvent struct {
+	seq   uint64
+	at    time.Time
+	frame []byte
+}
+
+// eventLog 按用户记录最近发出的事件，用于断线重连后补发。
+// epoch 在日志创建时生成，服务重启或日志过期重建后 epoch 改变，客户端据此判断需要全量同步
+type eventLog struct {
+	epoch          string
+	lastSeq        uint64
+	events         []loggedEvent // 按 seq 升序
+	disconnectedAt time.Time     // 用户最后一个连接断开的时间，在线时为零值
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{epoch: uuid.New().String()}
+}
+
+func (l *eventLog) append(event string, data json.RawMessage, now time.Time) []byte {
+	l.lastSeq++
+	frame, _ := json.Marshal(&Message{Event: event, Seq: l.lastSeq, Data: data})
+
+	if len(l.events) == eventLogSize {
+		copy(l.events, l.events[1:])
+		l.events = l.events[:eventLogSize-1]
+	}
+	l.events = append(l.events, loggedEvent{seq: l.lastSeq, at: now, frame: frame})
+	return frame
+}
+
+// since 返回 seq 之后的事件；seq 之后的事件已被淘汰或 seq 不属于本日志时返回 false
+func (l *eventLog) since(seq uint64) ([][]byte, bool) {
+	if seq > l.lastSeq {
+		return nil, false
+	}
+	if seq == l.lastSeq {
+		return nil, true
+	}
+	if len(l.events) == 0 || l.events[0].seq > seq+1 {
+		return nil, false
+	}
+
+	frames := make([][]byte, 0, l.lastSeq-seq)
+	for _, e := range l.events {
+		if e.seq > seq {
+			frames = append(frames, e.frame)
+		}
+	}
+	return frames, true
+}
+
+func (l *eventLog) prune(before time.Time) {
+	i := 0
+	for i < len(l.events) && l.events[i].at.Before(before) {
+		i++
+	}
+	if i > 0 {
+		l.events = append(l.events[:0], l.events[i:]...)
+	}
+}
+
+// resume 在连接注册时调用（持有 h.mu），补发断线期间的事件或通知客户端全量同步
+func (h *Hub) resume(client *Client) {
+	log := h.logs[client.UserID]
+	if log == nil {
+		log = newEventLog()
+		h.logs[client.UserID] = log
+	}
+	log.disconnectedAt = time.Time{}
+
+	client.queue(&Message{
+		Event: "connected",
+		Data: map[string]interface{}{
+			"epoch": log.epoch,
+			"seq":   log.lastSeq,
+		},
+	})
+
+	if !client.resume {
+		return
+	}
+
+	var frames [][]byte
+	ok := client.resumeEpoch == log.epoch
+	if ok {
+		frames, ok = log.since(client.resumeSeq)
+	}
+	if !ok {
+		client.queue(&Message{
+			Event: "resync_required",
+			Data: map[string]interface{}{
+				"epoch": log.epoch,
+				"seq":   log.lastSeq,
+			},
+		})
+		return
+	}
+
+	for _, frame := range frames {
+		client.Send <- frame
+	}
+}
+
+// queue 向刚注册的连接写入控制帧，调用方需持有 h.mu
+func (c *Client) queue(msg *Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	select {
+	case c.Send <- data:
+	default:
+	}
+}
+
+func (h *Hub) sweepEventLogs() {
+	ticker := time.NewTicker(eventLogSweepInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		before := now.Add(-eventLogRetention)
+
+		h.mu.Lock()
+		for userID, log := range h.logs {
+			if !log.disconnectedAt.IsZero() && log.disconnectedAt.Before(before) {
+				delete(h.logs, userID)
+				continue
+			}
+			log.prune(before)
+		}
+		h.mu.Unlock()
+	}
+}
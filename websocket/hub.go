@@ -2,7 +2,12 @@ package websocket
 
 import (
 	"encoding/json"
+	"errors"
 	"sync"
+	"time"
+
+	"talkbox/config"
+	"talkbox/database"
 )
 
 type Hub struct {
@@ -12,34 +17,97 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	mu         sync.RWMutex
+
+	typing   *typingTracker
+	presence *presenceTracker
+	logs     map[string]*eventLog // 按用户保存的事件日志，受 mu 保护
+	broker   Broker
+	// 连接建立和断开引起的在线状态变化，由单个 goroutine 按顺序应用，
+	// 快速断开重连时离线不会晚于随后的上线生效
+	presenceUpdates *presenceQueue
+}
+
+type presenceUpdate struct {
+	userID string
+	online bool
+}
+
+// presenceQueue 是不限长度的在线状态变化队列。Run 入队时从不阻塞，
+// 应用状态变化需要 Redis I/O 和 Hub 的锁，不能让 Run 等待消费者
+type presenceQueue struct {
+	mu      sync.Mutex
+	pending []presenceUpdate
+	ready   chan struct{}
+}
+
+func newPresenceQueue() *presenceQueue {
+	return &presenceQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *presenceQueue) push(update presenceUpdate) {
+	q.mu.Lock()
+	q.pending = append(q.pending, update)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// drain 取出当前排队的所有状态变化，保持入队顺序
+func (q *presenceQueue) drain() []presenceUpdate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := q.pending
+	q.pending = nil
+	return pending
 }
 
 type Message struct {
-	Event string      `json:"event"`
-	Data  interface{} `json:"data"`
+	Event     string      `json:"event"`
+	Seq       uint64      `json:"seq,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	Data      interface{} `json:"data"`
 }
 
 type ClientMessage struct {
 	Action         string          `json:"action"`
+	RequestID      string          `json:"request_id,omitempty"`
+	Version        int             `json:"version,omitempty"`
 	ConversationID string          `json:"conversation_id,omitempty"`
 	Type           string          `json:"type,omitempty"`
 	Content        json.RawMessage `json:"content,omitempty"`
 	ReplyToID      string          `json:"reply_to_id,omitempty"`
+	ThreadRootID   string          `json:"thread_root_id,omitempty"`
+	MessageID      string          `json:"message_id,omitempty"`
+	ClientMsgID    string          `json:"client_msg_id,omitempty"`
 }
 
 var HubInstance *Hub
 
-func NewHub() *Hub {
-	return &Hub{
+func NewHub(broker Broker) *Hub {
+	h := &Hub{
+		broker:     broker,
 		clients:    make(map[string]*Client),
 		userConns:  make(map[string]map[*Client]bool),
 		broadcast:  make(chan *Message, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		logs:       make(map[string]*eventLog),
+
+		presenceUpdates: newPresenceQueue(),
 	}
+	h.typing = newTypingTracker(h)
+	h.presence = newPresenceTracker(h)
+	return h
 }
 
 func (h *Hub) Run() {
+	go h.typing.run()
+	go h.sweepEventLogs()
+	go h.applyPresenceUpdates()
+
 	for {
 		select {
 		case client := <-h.register:
@@ -49,9 +117,17 @@ func (h *Hub) Run() {
 				h.userConns[client.UserID] = make(map[*Client]bool)
 			}
 			h.userConns[client.UserID][client] = true
+			first := len(h.userConns[client.UserID]) == 1
+			// 在锁内补发，保证补发的事件先于之后的新事件
+			h.resume(client)
 			h.mu.Unlock()
 
+			if first {
+				h.presenceUpdates.push(presenceUpdate{userID: client.UserID, online: true})
+			}
+
 		case client := <-h.unregister:
+			lastConn := false
 			h.mu.Lock()
 			if _, ok := h.clients[client.ID]; ok {
 				delete(h.clients, client.ID)
@@ -59,60 +135,210 @@ func (h *Hub) Run() {
 					delete(h.userConns[client.UserID], client)
 					if len(h.userConns[client.UserID]) == 0 {
 						delete(h.userConns, client.UserID)
+						if log := h.logs[client.UserID]; log != nil {
+							log.disconnectedAt = time.Now()
+						}
+						// 最后一个连接断开，立即结束该用户的输入状态，离线状态延迟发布
+						go h.typing.clearUser(client.UserID)
+						lastConn = true
 					}
 				}
 				close(client.Send)
 			}
 			h.mu.Unlock()
+
+			if lastConn {
+				h.presenceUpdates.push(presenceUpdate{userID: client.UserID, online: false})
+			}
+		}
+	}
+}
+
+// applyPresenceUpdates 按连接事件发生的顺序更新集群在线状态并发布状态变化
+func (h *Hub) applyPresenceUpdates() {
+	for range h.presenceUpdates.ready {
+		for _, update := range h.presenceUpdates.drain() {
+			h.broker.SetOnline(update.userID, update.online)
+			if update.online {
+				h.presence.connected(update.userID)
+			} else {
+				h.presence.disconnected(update.userID)
+			}
 		}
 	}
 }
 
 func (h *Hub) SendToUser(userID string, msg *Message) {
-	h.mu.RLock()
-	clients := h.userConns[userID]
-	h.mu.RUnlock()
+	h.SendToUsers([]string{userID}, msg)
+}
+
+// SendToUsers 发送需要可靠送达的事件：每个节点为本节点的用户分配递增的 seq 并写入事件日志，
+// 断线的客户端重连时可通过 since_seq 补发。发送缓冲区已满的连接会被断开，由客户端重连补发
+func (h *Hub) SendToUsers(userIDs []string, msg *Message) {
+	h.publish(userIDs, msg, false)
+}
 
-	data, err := json.Marshal(msg)
+// sendTransient 发送无需补发的事件（输入状态、在线状态），不分配 seq，缓冲区已满时丢弃
+func (h *Hub) sendTransient(userIDs []string, msg *Message) {
+	h.publish(userIDs, msg, true)
+}
+
+func (h *Hub) publish(userIDs []string, msg *Message, transient bool) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(msg.Data)
 	if err != nil {
 		return
 	}
 
-	for client := range clients {
-		select {
-		case client.Send <- data:
-		default:
-			h.unregister <- client
+	h.broker.Publish(&Envelope{
+		UserIDs:   userIDs,
+		Event:     msg.Event,
+		Data:      data,
+		Transient: transient,
+	})
+}
+
+// CloseSession 断开会话在所有节点上的连接，连接断开前会收到 session_revoked 事件
+func (h *Hub) CloseSession(userID, sessionID string) {
+	h.sendTransient([]string{userID}, &Message{
+		Event: "session_revoked",
+		Data:  map[string]string{"session_id": sessionID},
+	})
+}
+
+// deliver 将事件投递给本节点上的连接
+func (h *Hub) deliver(env *Envelope) {
+	switch env.Event {
+	case "presence_changed":
+		h.presence.observe(env.Data)
+	case "session_revoked":
+		h.closeSession(env)
+		return
+	}
+
+	var transientFrame []byte
+	if env.Transient {
+		transientFrame, _ = json.Marshal(&Message{Event: env.Event, Data: env.Data})
+	}
+
+	now := time.Now()
+	var slow []*Client
+
+	h.mu.Lock()
+	for _, userID := range env.UserIDs {
+		frame := transientFrame
+		if !env.Transient {
+			log := h.logs[userID]
+			if log == nil {
+				// 在本节点没有连接且日志已过期，重连时只能全量同步，无需记录
+				continue
+			}
+			frame = log.append(env.Event, env.Data, now)
 		}
+
+		for client := range h.userConns[userID] {
+			if client.lagging {
+				continue
+			}
+			select {
+			case client.Send <- frame:
+			default:
+				if !env.Transient {
+					client.lagging = true
+					slow = append(slow, client)
+				}
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	for _, client := range slow {
+		go func(c *Client) { h.unregister <- c }(client)
 	}
 }
 
-func (h *Hub) SendToUsers(userIDs []string, msg *Message) {
-	data, err := json.Marshal(msg)
-	if err != nil {
+// closeSession 只通知并断开属于被撤销会话的连接，同一用户的其他会话不受影响
+func (h *Hub) closeSession(env *Envelope) {
+	var data struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := json.Unmarshal(env.Data, &data); err != nil {
 		return
 	}
+	frame, _ := json.Marshal(&Message{Event: env.Event, Data: env.Data})
 
-	h.mu.RLock()
-	for _, userID := range userIDs {
-		clients := h.userConns[userID]
-		for client := range clients {
+	var closing []*Client
+	h.mu.Lock()
+	for _, userID := range env.UserIDs {
+		for client := range h.userConns[userID] {
+			if client.SessionID != data.SessionID || client.lagging {
+				continue
+			}
 			select {
-			case client.Send <- data:
+			case client.Send <- frame:
 			default:
 			}
+			client.lagging = true
+			closing = append(closing, client)
 		}
 	}
-	h.mu.RUnlock()
+	h.mu.Unlock()
+
+	for _, client := range closing {
+		go func(c *Client) { h.unregister <- c }(client)
+	}
 }
 
-func (h *Hub) IsOnline(userID string) bool {
+// localUsers 返回在本节点有连接的用户
+func (h *Hub) localUsers() []string {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return len(h.userConns[userID]) > 0
+
+	userIDs := make([]string, 0, len(h.userConns))
+	for userID := range h.userConns {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// StopTyping 结束用户在会话中的输入状态，通常在用户发出消息后调用
+func (h *Hub) StopTyping(convID, userID string) {
+	h.typing.stop(convID, userID)
+}
+
+// MemberRemoved 在用户离开或被移出会话后清除其输入状态和本节点缓存的成员列表。
+// 其他节点上的状态在成员缓存过期后由 handleTyping 的成员校验拒绝
+func (h *Hub) MemberRemoved(convID, userID string) {
+	h.typing.invalidateMembers(convID)
+	h.typing.stop(convID, userID)
 }
 
-func InitHub() {
-	HubInstance = NewHub()
+// IsOnline 判断用户在任一节点上是否有连接
+func (h *Hub) IsOnline(userID string) bool {
+	h.mu.RLock()
+	local := len(h.userConns[userID]) > 0
+	h.mu.RUnlock()
+
+	return local || h.broker.IsOnline(userID)
+}
+
+// InitHub 按配置选择事件分发后端并启动 Hub
+func InitHub() error {
+	var broker Broker = newMemoryBroker()
+	if config.Cfg.PubSubBackend == "redis" {
+		if database.Redis == nil {
+			return errors.New("redis is not connected")
+		}
+		broker = NewRedisBroker(database.Redis)
+	}
+
+	HubInstance = NewHub(broker)
+	if err := broker.Start(HubInstance.deliver, HubInstance.localUsers); err != nil {
+		return err
+	}
 	go HubInstance.Run()
+	return nil
 }
@@ -0,0 +1,28 @@
+package websocket
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 入队不依赖消费者，积压超过原先的缓冲区长度也不会阻塞 Run，取出时保持顺序
+func TestPresenceQueueNeverBlocks(t *testing.T) {
+	q := newPresenceQueue()
+	for i := 0; i < 5000; i++ {
+		q.push(presenceUpdate{userID: fmt.Sprint(i), online: i%2 == 0})
+	}
+
+	<-q.ready
+	pending := q.drain()
+	if len(pending) != 5000 {
+		t.Fatalf("drained %d updates, want 5000", len(pending))
+	}
+	for i, update := range pending {
+		if update.userID != fmt.Sprint(i) {
+			t.Fatalf("update %d is for user %s, want %d", i, update.userID, i)
+		}
+	}
+	if pending := q.drain(); len(pending) != 0 {
+		t.Errorf("second drain returned %d updates, want 0", len(pending))
+	}
+}
@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"talkbox/database"
+)
+
+// 最后一个连接断开后延迟发布离线，期间重连不会产生任何事件，避免移动端网络抖动反复通知联系人
+const presenceOfflineGrace = 15 * time.Second
+
+// 用户可设置的状态
+const (
+	StatusOnline    = "online"
+	StatusAway      = "away"
+	StatusBusy      = "busy"
+	StatusInvisible = "invisible"
+	StatusOffline   = "offline"
+)
+
+type presenceTracker struct {
+	hub       *Hub
+	mu        sync.Mutex
+	pending   map[string]*time.Timer // 等待发布离线的用户
+	published map[string]string      // 最近一次对外发布的状态，不在表中视为 offline
+}
+
+func newPresenceTracker(hub *Hub) *presenceTracker {
+	return &presenceTracker{
+		hub:       hub,
+		pending:   make(map[string]*time.Timer),
+		published: make(map[string]string),
+	}
+}
+
+// connected 在用户的第一个连接建立时调用
+func (p *presenceTracker) connected(userID string) {
+	p.mu.Lock()
+	if timer, ok := p.pending[userID]; ok {
+		timer.Stop()
+		delete(p.pending, userID)
+	}
+	p.mu.Unlock()
+
+	database.DB.Exec("UPDATE users SET last_seen_at = ? WHERE id = ?", time.Now(), userID)
+	p.publish(userID)
+}
+
+// disconnected 在用户的最后一个连接断开时调用
+func (p *presenceTracker) disconnected(userID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.hub.IsOnline(userID) {
+		return
+	}
+	if timer, ok := p.pending[userID]; ok {
+		timer.Stop()
+	}
+	p.pending[userID] = time.AfterFunc(presenceOfflineGrace, func() {
+		p.mu.Lock()
+		delete(p.pending, userID)
+		p.mu.Unlock()
+
+		if p.hub.IsOnline(userID) {
+			return
+		}
+		database.DB.Exec("UPDATE users SET last_seen_at = ? WHERE id = ?", time.Now(), userID)
+		p.publish(userID)
+	})
+}
+
+// isPresent 判断用户是否在线，离线宽限期内仍视为在线
+func (p *presenceTracker) isPresent(userID string) bool {
+	if p.hub.IsOnline(userID) {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.pending[userID]
+	return ok
+}
+
+func (p *presenceTracker) effectiveStatus(userID, status string) string {
+	if status == StatusInvisible || !p.isPresent(userID) {
+		return StatusOffline
+	}
+	if status == "" {
+		return StatusOnline
+	}
+	return status
+}
+
+// publish 计算用户当前对外状态，与上次发布的不同才通知共同会话中的用户
+func (p *presenceTracker) publish(userID string) {
+	var status string
+	var lastSeenAt sql.NullTime
+	err := database.DB.QueryRow(
+		"SELECT status, last_seen_at FROM users WHERE id = ?",
+		userID,
+	).Scan(&status, &lastSeenAt)
+	if err != nil {
+		return
+	}
+
+	effective := p.effectiveStatus(userID, status)
+
+	p.mu.Lock()
+	previous, ok := p.published[userID]
+	if !ok {
+		previous = StatusOffline
+	}
+	if previous == effective {
+		p.mu.Unlock()
+		return
+	}
+	if effective == StatusOffline {
+		delete(p.published, userID)
+	} else {
+		p.published[userID] = effective
+	}
+	p.mu.Unlock()
+
+	data := map[string]interface{}{
+		"user_id": userID,
+		"status":  effective,
+	}
+	// 隐身用户不暴露最后在线时间
+	if lastSeenAt.Valid && status != StatusInvisible {
+		data["last_seen_at"] = lastSeenAt.Time
+	}
+
+	p.hub.sendTransient(append(getContacts(userID), userID), &Message{
+		Event: "presence_changed",
+		Data:  data,
+	})
+}
+
+// observe 记录任一节点发布的状态变化，使各节点判断状态是否变化时基于同一份最近发布的状态
+func (p *presenceTracker) observe(data json.RawMessage) {
+	var event struct {
+		UserID string `json:"user_id"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil || event.UserID == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if event.Status == StatusOffline {
+		delete(p.published, event.UserID)
+	} else {
+		p.published[event.UserID] = event.Status
+	}
+}
+
+// getContacts 返回与用户至少共同在一个会话中的其他用户
+func getContacts(userID string) []string {
+	rows, err := database.DB.Query(`
+		SELECT DISTINCT m2.user_id
+		FROM conversation_members m1
+		JOIN conversation_members m2 ON m1.conversation_id = m2.conversation_id
+		WHERE m1.user_id = ? AND m2.user_id != ?
+	`, userID, userID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var contacts []string
+	for rows.Next() {
+		var contactID string
+		if err := rows.Scan(&contactID); err == nil {
+			contacts = append(contacts, contactID)
+		}
+	}
+	return contacts
+}
+
+// Presence 返回用户对他人展示的状态（online/away/busy/offline），status 为用户设置的状态
+func (h *Hub) Presence(userID, status string) string {
+	return h.presence.effectiveStatus(userID, status)
+}
+
+// StatusChanged 在用户修改状态后立即通知联系人
+func (h *Hub) StatusChanged(userID string) {
+	h.presence.publish(userID)
+}
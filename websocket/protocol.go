@@ -0,0 +1,95 @@
+package websocket
+
+import "fmt"
+
+// 协议版本。未协商的连接按 v1 处理：无法识别的请求静默忽略，只有携带 request_id 或
+// client_msg_id 的请求才会收到 ack/error。v2 中每个出错的请求都会收到 error，
+// 携带 request_id 的请求成功时收到 ack。
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+)
+
+// error 帧的错误码
+const (
+	ErrCodeNotMember      = "not_member"
+	ErrCodeInvalidPayload = "invalid_payload"
+	ErrCodeRateLimited    = "rate_limited"
+	ErrCodeInternal       = "internal"
+)
+
+var supportedProtocols = []int{ProtocolV1, ProtocolV2}
+
+func isSupportedProtocol(version int) bool {
+	for _, v := range supportedProtocols {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate 设置连接使用的协议版本，版本不受支持时返回错误并保持原版本
+func (c *Client) negotiate(version int) error {
+	if !isSupportedProtocol(version) {
+		return fmt.Errorf("unsupported protocol version %d", version)
+	}
+	c.protocol = version
+	return nil
+}
+
+// handleHello 处理 hello 动作：客户端声明期望的协议版本，服务端回复实际使用的版本。
+// hello 总是会收到回复，无论是否携带 request_id
+func (c *Client) handleHello(msg *ClientMessage) {
+	if msg.Version != 0 {
+		if err := c.negotiate(msg.Version); err != nil {
+			c.SendEvent(&Message{
+				Event:     "error",
+				RequestID: msg.RequestID,
+				Data: map[string]interface{}{
+					"code":               ErrCodeInvalidPayload,
+					"message":            err.Error(),
+					"supported_versions": supportedProtocols,
+				},
+			})
+			return
+		}
+	}
+
+	c.SendEvent(&Message{
+		Event:     "ack",
+		RequestID: msg.RequestID,
+		Data: map[string]interface{}{
+			"version":            c.protocol,
+			"supported_versions": supportedProtocols,
+		},
+	})
+}
+
+// Ack 向发起请求的连接回复成功结果
+func (c *Client) Ack(req *ClientMessage, data interface{}) {
+	if req.RequestID == "" && req.ClientMsgID == "" {
+		return
+	}
+	c.SendEvent(&Message{Event: "ack", RequestID: req.RequestID, Data: data})
+}
+
+// Error 向发起请求的连接回复错误，extra 中的字段会合并到 data 中
+func (c *Client) Error(req *ClientMessage, code, message string, extra map[string]interface{}) {
+	if c.protocol < ProtocolV2 && req.RequestID == "" && req.ClientMsgID == "" {
+		return
+	}
+
+	data := map[string]interface{}{
+		"code":    code,
+		"message": message,
+	}
+	if req.ClientMsgID != "" {
+		data["client_msg_id"] = req.ClientMsgID
+	}
+	for key, value := range extra {
+		data[key] = value
+	}
+
+	c.SendEvent(&Message{Event: "error", RequestID: req.RequestID, Data: data})
+}
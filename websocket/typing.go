@@ -0,0 +1,190 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// 客户端需在该时间内刷新 typing_start，否则服务端视为已停止输入
+	typingTimeout = 6 * time.Second
+	// 同一用户在同一会话中 typing 事件的最短广播间隔，刷新过于频繁时只更新过期时间
+	typingBroadcastInterval = 3 * time.Second
+	typingSweepInterval     = time.Second
+	// 会话成员列表缓存时间，避免每次输入都查询数据库
+	typingMembersTTL = 10 * time.Second
+)
+
+type typingKey struct {
+	conversationID string
+	userID         string
+}
+
+type typingState struct {
+	expiresAt time.Time
+	lastSent  time.Time
+}
+
+type memberCache struct {
+	userIDs   []string
+	fetchedAt time.Time
+}
+
+// typingTracker 维护正在输入的状态。状态只保存在内存中，不落库
+type typingTracker struct {
+	hub     *Hub
+	mu      sync.Mutex
+	active  map[typingKey]*typingState
+	members map[string]*memberCache
+}
+
+func newTypingTracker(hub *Hub) *typingTracker {
+	return &typingTracker{
+		hub:     hub,
+		active:  make(map[typingKey]*typingState),
+		members: make(map[string]*memberCache),
+	}
+}
+
+func (t *typingTracker) run() {
+	ticker := time.NewTicker(typingSweepInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		t.sweep(now)
+	}
+}
+
+// start 记录或刷新输入状态，刷新过于频繁时不重复广播
+func (t *typingTracker) start(convID, userID string) {
+	key := typingKey{conversationID: convID, userID: userID}
+	now := time.Now()
+
+	t.mu.Lock()
+	state, ok := t.active[key]
+	if ok {
+		state.expiresAt = now.Add(typingTimeout)
+		if now.Sub(state.lastSent) < typingBroadcastInterval {
+			t.mu.Unlock()
+			return
+		}
+		state.lastSent = now
+	} else {
+		t.active[key] = &typingState{expiresAt: now.Add(typingTimeout), lastSent: now}
+	}
+	t.mu.Unlock()
+
+	t.broadcast(convID, userID, true)
+}
+
+// isMember 判断用户是否为会话成员。缓存的成员列表中有该用户时不查库，被移出的成员最多在缓存过期前
+// 还能刷新输入状态；缓存中没有时查库，新加入的成员不必等缓存过期，并使缓存失效
+func (t *typingTracker) isMember(convID, userID string) bool {
+	for _, memberID := range t.conversationMembers(convID) {
+		if memberID == userID {
+			return true
+		}
+	}
+
+	if !isConversationMember(convID, userID) {
+		return false
+	}
+	t.invalidateMembers(convID)
+	return true
+}
+
+func (t *typingTracker) invalidateMembers(convID string) {
+	t.mu.Lock()
+	delete(t.members, convID)
+	t.mu.Unlock()
+}
+
+func (t *typingTracker) stop(convID, userID string) {
+	key := typingKey{conversationID: convID, userID: userID}
+
+	t.mu.Lock()
+	_, ok := t.active[key]
+	delete(t.active, key)
+	t.mu.Unlock()
+
+	if ok {
+		t.broadcast(convID, userID, false)
+	}
+}
+
+// clearUser 在用户最后一个连接断开时清除其所有输入状态
+func (t *typingTracker) clearUser(userID string) {
+	var convIDs []string
+
+	t.mu.Lock()
+	for key := range t.active {
+		if key.userID == userID {
+			convIDs = append(convIDs, key.conversationID)
+			delete(t.active, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, convID := range convIDs {
+		t.broadcast(convID, userID, false)
+	}
+}
+
+func (t *typingTracker) sweep(now time.Time) {
+	var expired []typingKey
+
+	t.mu.Lock()
+	for key, state := range t.active {
+		if now.After(state.expiresAt) {
+			expired = append(expired, key)
+			delete(t.active, key)
+		}
+	}
+	for convID, cache := range t.members {
+		if now.Sub(cache.fetchedAt) > typingMembersTTL {
+			delete(t.members, convID)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, key := range expired {
+		t.broadcast(key.conversationID, key.userID, false)
+	}
+}
+
+// broadcast 将 typing 事件发送给会话中除本人外的其他成员
+func (t *typingTracker) broadcast(convID, userID string, typing bool) {
+	var recipients []string
+	for _, memberID := range t.conversationMembers(convID) {
+		if memberID != userID {
+			recipients = append(recipients, memberID)
+		}
+	}
+
+	t.hub.sendTransient(recipients, &Message{
+		Event: "typing",
+		Data: map[string]interface{}{
+			"conversation_id": convID,
+			"user_id":         userID,
+			"typing":          typing,
+		},
+	})
+}
+
+func (t *typingTracker) conversationMembers(convID string) []string {
+	t.mu.Lock()
+	cache, ok := t.members[convID]
+	t.mu.Unlock()
+
+	if ok && time.Since(cache.fetchedAt) < typingMembersTTL {
+		return cache.userIDs
+	}
+
+	userIDs := getConversationMembers(convID)
+
+	t.mu.Lock()
+	t.members[convID] = &memberCache{userIDs: userIDs, fetchedAt: time.Now()}
+	t.mu.Unlock()
+
+	return userIDs
+}